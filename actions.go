@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// Action types.
+const (
+	ActionLayout   = "layout"
+	ActionPlaylist = "playlist"
+	ActionLaunch   = "launch"
+	ActionClose    = "close"
+	ActionFocus    = "focus"
+	ActionDPMS     = "dpms"
+	ActionKeys     = "keys"
+	ActionRestart  = "restart"
+	// ActionCycleFocus raises and focuses the next visible client.
+	ActionCycleFocus = "cycle-focus"
+	// ActionMaintenance enters maintenance mode.
+	ActionMaintenance = "maintenance"
+	// ActionOverlay shows a message overlay.
+	ActionOverlay = "overlay"
+	// ActionHide and ActionShow hide and show the matching clients.
+	ActionHide = "hide"
+	ActionShow = "show"
+	// ActionRaise and ActionLower move the oldest matching client
+	// to the top or bottom of its layer.
+	ActionRaise = "raise"
+	ActionLower = "lower"
+	// ActionPlaylistNext and ActionPlaylistPrev step through the
+	// screen's playlist, as the operator.
+	ActionPlaylistNext = "playlist-next"
+	ActionPlaylistPrev = "playlist-prev"
+	// ActionScreenSaver activates or deactivates the screen saver,
+	// and ActionBlanking enables or disables screen blanking.
+	ActionScreenSaver = "screensaver"
+	ActionBlanking    = "blanking"
+	// ActionDiagnostics shows the diagnostics overlay.
+	ActionDiagnostics = "diagnostics"
+)
+
+// Action is something the WM can be told to do by a schedule, or
+// other automation. Which fields are used depends on the Type.
+type Action struct {
+	Type string `yaml:"type" json:"type"`
+	// Screen is the screen index for layout, the playlist actions
+	// and diagnostics.
+	Screen int `yaml:"screen" json:"screen"`
+	// Layout is the name of a layout from the config.
+	Layout string `yaml:"layout" json:"layout,omitempty"`
+	// Playlist is the name of a playlist from the config. An
+	// empty name stops the screen's playlist.
+	Playlist string `yaml:"playlist" json:"playlist,omitempty"`
+	// App is the name of an app from the config, for launch,
+	// close and restart.
+	App string `yaml:"app" json:"app,omitempty"`
+	// Match selects the clients for close, focus, hide, show, raise
+	// and lower, and limits the clients cycled through by
+	// cycle-focus.
+	Match *Match `yaml:"match" json:"match,omitempty"`
+	// Level is the DPMS power level: on, standby, suspend or off.
+	Level string `yaml:"level" json:"level,omitempty"`
+	// Active is whether screensaver activates the screen saver.
+	Active bool `yaml:"active" json:"active,omitempty"`
+	// Enabled is whether blanking enables blanking.
+	Enabled bool `yaml:"enabled" json:"enabled,omitempty"`
+	// Keys is a space-separated sequence of key chords to type,
+	// like "Ctrl+l Escape".
+	Keys string `yaml:"keys" json:"keys,omitempty"`
+	// Overlay is the message to show. Give it an expiry, unless
+	// another action deletes it.
+	Overlay *Overlay `yaml:"overlay" json:"overlay,omitempty"`
+}
+
+// Validate checks the action against the config it will run with.
+func (a *Action) Validate(cfg *Config) error {
+	if a.Screen < 0 {
+		return fmt.Errorf("bad screen %d", a.Screen)
+	}
+	if a.Match != nil {
+		if err := a.Match.Validate(); err != nil {
+			return fmt.Errorf("match: %v", err)
+		}
+	}
+	switch a.Type {
+	case ActionLayout:
+		if _, ok := cfg.Layouts[a.Layout]; !ok {
+			return fmt.Errorf("no layout %q", a.Layout)
+		}
+	case ActionPlaylist:
+		if _, ok := cfg.Playlists[a.Playlist]; a.Playlist != "" && !ok {
+			return fmt.Errorf("no playlist %q", a.Playlist)
+		}
+	case ActionLaunch, ActionRestart:
+		if cfg.app(a.App) == nil {
+			return fmt.Errorf("no app %q", a.App)
+		}
+	case ActionClose:
+		if a.App == "" && a.Match == nil {
+			return errors.New("close needs an app or a match")
+		}
+		if a.App != "" && cfg.app(a.App) == nil {
+			return fmt.Errorf("no app %q", a.App)
+		}
+	case ActionFocus, ActionHide, ActionShow, ActionRaise, ActionLower:
+		if a.Match == nil {
+			return fmt.Errorf("%s needs a match", a.Type)
+		}
+	case ActionDPMS:
+		if _, ok := dpmsLevels[a.Level]; !ok {
+			return fmt.Errorf("bad DPMS level %q", a.Level)
+		}
+	case ActionCycleFocus, ActionMaintenance, ActionPlaylistNext, ActionPlaylistPrev,
+		ActionScreenSaver, ActionBlanking, ActionDiagnostics:
+	case ActionKeys:
+		if _, err := parseKeySequence(a.Keys); err != nil {
+			return err
+		}
+	case ActionOverlay:
+		if a.Overlay == nil {
+			return errors.New("overlay missing")
+		}
+		if err := a.Overlay.Validate(); err != nil {
+			return fmt.Errorf("overlay: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+	return nil
+}
+
+// RunAction performs the action. The caller must hold wm.mu.
+func (wm *WM) RunAction(a *Action) error {
+	log.Printf("action: %s", a.Type)
+	switch a.Type {
+	case ActionLayout:
+		return wm.ApplyLayout(a.Screen, a.Layout)
+	case ActionPlaylist:
+		if a.Playlist == "" {
+			wm.StopPlaylist(a.Screen)
+			return nil
+		}
+		items, ok := wm.config.Playlists[a.Playlist]
+		if !ok {
+			return fmt.Errorf("no playlist %q", a.Playlist)
+		}
+		return wm.SetPlaylist(a.Screen, items)
+	case ActionLaunch:
+		return wm.LaunchApp(a.App)
+	case ActionClose:
+		if a.App != "" {
+			if err := wm.StopApp(a.App); err != nil {
+				return err
+			}
+		}
+		if a.Match != nil {
+			for _, c := range wm.FindClients(a.Match) {
+				if err := wm.CloseClient(c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case ActionFocus:
+		c := wm.FindClient(a.Match)
+		if c == nil {
+			return errors.New("no matching client")
+		}
+		return wm.FocusClient(c, xproto.TimeCurrentTime)
+	case ActionDPMS:
+		return wm.SetPowerLevel(a.Level)
+	case ActionKeys:
+		return wm.SendKeys(a.Keys)
+	case ActionRestart:
+		return wm.RestartApp(a.App)
+	case ActionCycleFocus:
+		return wm.CycleFocus(a.Match)
+	case ActionMaintenance:
+		return wm.EnterMaintenance("action", 0)
+	case ActionOverlay:
+		o := *a.Overlay
+		o.ID = 0
+		return wm.ShowOverlay(&o)
+	case ActionHide, ActionShow:
+		for _, c := range wm.FindClients(a.Match) {
+			var err error
+			if a.Type == ActionHide {
+				err = wm.HideClient(c)
+			} else {
+				err = wm.ShowClient(c)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case ActionRaise, ActionLower:
+		c := wm.FindClient(a.Match)
+		if c == nil {
+			return errors.New("no matching client")
+		}
+		if a.Type == ActionRaise {
+			return wm.RaiseClient(c, nil)
+		}
+		return wm.LowerClient(c, nil)
+	case ActionPlaylistNext:
+		return wm.StepPlaylist(a.Screen, 1)
+	case ActionPlaylistPrev:
+		return wm.StepPlaylist(a.Screen, -1)
+	case ActionScreenSaver:
+		return wm.ForceScreenSaver(a.Active)
+	case ActionBlanking:
+		return wm.SetBlanking(a.Enabled)
+	case ActionDiagnostics:
+		return wm.ShowDiagnostics(a.Screen)
+	}
+	return fmt.Errorf("unknown action %q", a.Type)
+}
+
+// CycleFocus raises and focuses the visible client after the active
+// one, in order of window IDs. If m is not nil, only the matching
+// clients are considered. The caller must hold wm.mu.
+func (wm *WM) CycleFocus(m *Match) error {
+	if m == nil {
+		m = &Match{}
+	}
+	clients := []*Client{}
+	for _, c := range wm.FindClients(m) {
+		if c.Visible {
+			clients = append(clients, c)
+		}
+	}
+	if len(clients) == 0 {
+		return errors.New("no client to focus")
+	}
+	next := clients[0]
+	for i, c := range clients {
+		if c == wm.activeClient {
+			next = clients[(i+1)%len(clients)]
+		}
+	}
+	next.StackMode = xproto.StackModeAbove
+	if err := next.Configure(); err != nil {
+		return err
+	}
+	return wm.FocusClient(next, xproto.TimeCurrentTime)
+}
+
+// runActions runs the actions in order, stopping at the first error.
+func (wm *WM) runActions(actions []Action) error {
+	for i := range actions {
+		if err := wm.RunAction(&actions[i]); err != nil {
+			return fmt.Errorf("%s: %v", actions[i].Type, err)
+		}
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/xgb/xproto"
@@ -13,14 +18,10 @@ import (
 	"nhooyr.io/websocket"
 )
 
-type WSClient struct {
-	ch chan interface{}
-}
-
 type APIServer struct {
-	server  *http.Server
-	wm      *WM
-	clients map[*WSClient]interface{}
+	server    *http.Server
+	wm        *WM
+	listeners map[string]net.Listener
 }
 
 func jsonResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
@@ -31,31 +32,97 @@ func jsonResponse(w http.ResponseWriter, r *http.Request, status int, data inter
 	e.Encode(data)
 }
 
-func NewAPIServer(wm *WM, listenAddr string) (as *APIServer) {
+func errorResponse(w http.ResponseWriter, r *http.Request, status int, err error) {
+	jsonResponse(w, r, status,
+		map[string]interface{}{
+			"error": err.Error(),
+		},
+	)
+}
+
+// locked wraps a handler so that it runs with the WM lock held.
+func (as *APIServer) locked(
+	handler func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		as.wm.mu.Lock()
+		defer as.wm.mu.Unlock()
+		handler(w, r)
+	}
+}
+
+// authenticate rejects requests without a valid token, if any tokens
+// are configured. The token is passed as "Authorization: Bearer
+// <token>", or as the "token" query parameter for websockets and
+// streams.
+func (as *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		as.wm.mu.Lock()
+		tokens := as.wm.config.Tokens
+		as.wm.mu.Unlock()
+		if len(tokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		given := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		jsonResponse(w, r, http.StatusUnauthorized, nil)
+	})
+}
+
+// connContextKey is the request context key of the request's
+// connection.
+type connContextKey struct{}
+
+// requestConn returns the connection a request came in on, so that
+// handlers can extend its deadlines.
+func requestConn(r *http.Request) net.Conn {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+func NewAPIServer(wm *WM) (as *APIServer) {
 	router := mux.NewRouter()
 	server := &http.Server{
-		Addr:           listenAddr,
 		Handler:        router,
 		ReadTimeout:    1 * time.Second,
 		WriteTimeout:   1 * time.Second,
 		MaxHeaderBytes: 1 << 16,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	as = &APIServer{
+		server:    server,
+		wm:        wm,
+		listeners: make(map[string]net.Listener),
 	}
+	router.Use(as.authenticate)
 
-	router.HandleFunc("/screens/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/screens/", as.locked(func(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, r, 200,
 			map[string]interface{}{
 				"items": as.wm.attachedScreens,
 			},
 		)
-	}).Methods("GET")
+	})).Methods("GET")
 
-	router.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/clients/", as.locked(func(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, r, 200,
 			map[string]interface{}{
 				"items": as.wm.clients,
 			},
 		)
-	}).Methods("GET")
+	})).Methods("GET")
 
 	getIdUint := func(r *http.Request) *uint64 {
 		vars := mux.Vars(r)
@@ -75,7 +142,7 @@ func NewAPIServer(wm *WM, listenAddr string) (as *APIServer) {
 		return nil
 	}
 
-	router.HandleFunc("/clients/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/clients/{id:[0-9]+}", as.locked(func(w http.ResponseWriter, r *http.Request) {
 		id := getIdUint(r)
 		if id == nil {
 			jsonResponse(w, r, http.StatusNotFound, nil)
@@ -116,12 +183,40 @@ func NewAPIServer(wm *WM, listenAddr string) (as *APIServer) {
 			if H := getInt("H", data); H != nil {
 				client.H = uint16(*H)
 			}
+			if stackMode := getInt("StackMode", data); stackMode != nil {
+				if *stackMode < 0 || *stackMode > xproto.StackModeOpposite {
+					errorResponse(w, r, http.StatusUnprocessableEntity,
+						fmt.Errorf("bad StackMode %d", *stackMode))
+					return
+				}
+				client.StackMode = uint32(*stackMode)
+			}
+			if layer, ok := data["Layer"].(string); ok {
+				if err := as.wm.SetLayer(client, layer); err != nil {
+					errorResponse(w, r, http.StatusUnprocessableEntity, err)
+					return
+				}
+			}
+			if opacity, ok := data["Opacity"].(float64); ok {
+				if err := as.wm.SetOpacity(client, opacity); err != nil {
+					errorResponse(w, r, http.StatusUnprocessableEntity, err)
+					return
+				}
+			}
 			client.Configure()
+			// StackMode doesn't know about layers.
+			if err := as.wm.enforceLayers(); err != nil {
+				log.Printf("restacking: %v", err)
+			}
+			as.wm.rememberLayout(client)
 			if focus := getInt("Focus", data); focus != nil && *focus == 1 {
-				client.Focus()
+				if err := as.wm.FocusClient(client, xproto.TimeCurrentTime); err != nil {
+					errorResponse(w, r, http.StatusConflict, err)
+					return
+				}
 			}
 		case "DELETE":
-			if err := client.CloseGracefully(); err != nil {
+			if err := as.wm.CloseClient(client); err != nil {
 				log.Print(err)
 			}
 			jsonResponse(w, r, 200, nil)
@@ -134,43 +229,234 @@ func NewAPIServer(wm *WM, listenAddr string) (as *APIServer) {
 				"item": client,
 			},
 		)
-	}).Methods("GET", "POST", "DELETE")
+	})).Methods("GET", "POST", "DELETE")
+
+	getClient := func(r *http.Request) *Client {
+		id := getIdUint(r)
+		if id == nil {
+			return nil
+		}
+		return as.wm.GetClient(xproto.Window(*id))
+	}
+	setVisible := func(visible bool) func(http.ResponseWriter, *http.Request) {
+		return as.locked(func(w http.ResponseWriter, r *http.Request) {
+			client := getClient(r)
+			if client == nil {
+				jsonResponse(w, r, http.StatusNotFound, nil)
+				return
+			}
+			var err error
+			if visible {
+				err = as.wm.ShowClient(client)
+			} else {
+				err = as.wm.HideClient(client)
+			}
+			if err != nil {
+				errorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			as.wm.rememberLayout(client)
+			jsonResponse(w, r, 200,
+				map[string]interface{}{
+					"item": client,
+				},
+			)
+		})
+	}
+	router.HandleFunc("/clients/{id:[0-9]+}/hide", setVisible(false)).Methods("POST")
+	router.HandleFunc("/clients/{id:[0-9]+}/minimize", setVisible(false)).Methods("POST")
+	router.HandleFunc("/clients/{id:[0-9]+}/show", setVisible(true)).Methods("POST")
+
+	restack := func(raise bool) func(http.ResponseWriter, *http.Request) {
+		return as.locked(func(w http.ResponseWriter, r *http.Request) {
+			client := getClient(r)
+			if client == nil {
+				jsonResponse(w, r, http.StatusNotFound, nil)
+				return
+			}
+			// The sibling to stack the client next to is optional.
+			var data struct{ Sibling xproto.Window }
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+					errorResponse(w, r, http.StatusUnprocessableEntity, err)
+					return
+				}
+			}
+			var sibling *Client
+			if data.Sibling != 0 {
+				if sibling = as.wm.GetClient(data.Sibling); sibling == nil {
+					errorResponse(w, r, http.StatusUnprocessableEntity,
+						fmt.Errorf("no client %d", data.Sibling))
+					return
+				}
+			}
+			var err error
+			if raise {
+				err = as.wm.RaiseClient(client, sibling)
+			} else {
+				err = as.wm.LowerClient(client, sibling)
+			}
+			if err != nil {
+				errorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			jsonResponse(w, r, 200,
+				map[string]interface{}{
+					"item": client,
+				},
+			)
+		})
+	}
+	router.HandleFunc("/clients/{id:[0-9]+}/raise", restack(true)).Methods("POST")
+	router.HandleFunc("/clients/{id:[0-9]+}/lower", restack(false)).Methods("POST")
+
+	router.HandleFunc("/config", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, r, 200,
+			map[string]interface{}{
+				"item": as.wm.config.Redacted(),
+			},
+		)
+	})).Methods("GET")
+
+	router.HandleFunc("/config/reload", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if err := as.wm.ReloadConfig(); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		jsonResponse(w, r, 200,
+			map[string]interface{}{
+				"item": as.wm.config.Redacted(),
+			},
+		)
+	})).Methods("POST")
+
+	router.HandleFunc("/admin/restart", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Path string }
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				jsonResponse(w, r, http.StatusUnprocessableEntity, nil)
+				return
+			}
+		}
+		if data.Path != "" {
+			if err := checkExecutable(data.Path); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		jsonResponse(w, r, http.StatusAccepted, nil)
+		// Give the response a moment to go out before we exec.
+		time.AfterFunc(100*time.Millisecond, func() {
+			as.wm.mu.Lock()
+			defer as.wm.mu.Unlock()
+			if err := as.wm.Restart(data.Path); err != nil {
+				log.Printf("restart failed: %v", err)
+				as.wm.emit("wm.restart.failed", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+		})
+	})).Methods("POST")
 
 	router.HandleFunc(
 		"/events/",
-		makeWSHandler(func(ctx context.Context, c *websocket.Conn) {
-			client := &WSClient{ch: make(chan interface{}, 10)}
-			as.clients[client] = nil
-			defer func() {
-				// Normally only the writer should ever close the
-				// channel.  However we never terminate the WS
-				// connection on our own so this seems fair.
-				close(client.ch)
-				delete(as.clients, client)
-			}()
-			for v := range client.ch {
-				data, err := json.Marshal(v)
-				if err != nil {
-					log.Print(err)
-					continue
+		func(w http.ResponseWriter, r *http.Request) {
+			// Subscribers pass the last sequence number they saw
+			// to resume after reconnecting.
+			since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+			makeWSHandler(func(ctx context.Context, c *websocket.Conn) {
+				ctx = c.CloseRead(ctx)
+				as.wm.mu.Lock()
+				queue := as.wm.config.Events.ClientQueue
+				as.wm.mu.Unlock()
+				client := as.wm.events.Subscribe(since, queue)
+				defer as.wm.events.Unsubscribe(client)
+				for {
+					select {
+					case data := <-client.ch:
+						if err := c.Write(ctx, websocket.MessageText, data); err != nil {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
 				}
-				c.Write(ctx, websocket.MessageText, data)
-			}
-			c.Close(websocket.StatusNormalClosure, "")
-		}),
+			})(w, r)
+		},
 	)
 
+	as.playlistRoutes(router)
+	as.layoutRoutes(router)
+	as.scheduleRoutes(router)
+	as.powerRoutes(router)
+	as.idleRoutes(router)
+	as.keyFilterRoutes(router)
+	as.hotkeyRoutes(router)
+	as.maintenanceRoutes(router)
+	as.focusRoutes(router)
+	as.focusHistoryRoutes(router)
+	as.stackingRoutes(router)
+	as.overlayRoutes(router)
+	as.backgroundRoutes(router)
+	as.cursorRoutes(router)
+	as.pointerRoutes(router)
+	as.deviceRoutes(router)
+	as.compositorRoutes(router)
+	as.screenshotRoutes(router)
+	as.streamRoutes(router)
+	as.remoteRoutes(router)
+
 	router.PathPrefix("/").Handler(http.NotFoundHandler())
-	as = &APIServer{
-		server:  server,
-		wm:      wm,
-		clients: make(map[*WSClient]interface{}),
-	}
 	wm.api = as
 	return as
 }
 
-func (as *APIServer) Start() {
-	log.Printf("Listening on http://%s", as.server.Addr)
-	log.Fatal(as.server.ListenAndServe())
+// Start starts serving the API on the configured addresses.
+func (as *APIServer) Start() error {
+	as.wm.mu.Lock()
+	defer as.wm.mu.Unlock()
+	return as.setListenAddrs(as.wm.config.Listen)
+}
+
+// setListenAddrs makes the API server listen on exactly the given
+// addresses. New listeners are opened before any old ones are closed,
+// so that on error nothing changes. The caller must hold wm.mu.
+func (as *APIServer) setListenAddrs(addrs []string) error {
+	wanted := map[string]bool{}
+	opened := []string{}
+	for _, addr := range addrs {
+		wanted[addr] = true
+		if _, ok := as.listeners[addr]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, addr := range opened {
+				as.listeners[addr].Close()
+				delete(as.listeners, addr)
+			}
+			return err
+		}
+		as.listeners[addr] = l
+		opened = append(opened, addr)
+	}
+	for addr, l := range as.listeners {
+		if !wanted[addr] {
+			log.Printf("Stopped listening on http://%s", addr)
+			l.Close()
+			delete(as.listeners, addr)
+		}
+	}
+	for _, addr := range opened {
+		log.Printf("Listening on http://%s", addr)
+		go as.serve(as.listeners[addr])
+	}
+	return nil
+}
+
+func (as *APIServer) serve(l net.Listener) {
+	err := as.server.Serve(l)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Print(err)
+	}
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// appRestartDelay is how long we wait before restarting an app that
+// exited.
+const appRestartDelay = 1 * time.Second
+
+// appKillTimeout is how long an app restarted by RestartApp has to
+// exit before it is killed.
+const appKillTimeout = 5 * time.Second
+
+// App is an external program launched (and possibly supervised) by
+// the WM.
+type App struct {
+	AppConfig
+	// PID is the process ID, or zero if the app is not running.
+	PID int
+	// Restarts counts how many times the app was restarted after
+	// exiting.
+	Restarts int
+
+	proc *os.Process
+	// stopping is set when we asked the app to exit, so that it is
+	// not restarted.
+	stopping bool
+	// restarting is set when the app should be started again as
+	// soon as it exits.
+	restarting bool
+}
+
+// updateApps reconciles the running apps with the config: removed
+// apps are stopped, new or changed apps are (re)started. The caller
+// must hold wm.mu.
+func (wm *WM) updateApps() {
+	wanted := map[string]AppConfig{}
+	for _, ac := range wm.config.Apps {
+		wanted[ac.Name] = ac
+	}
+	for name, app := range wm.apps {
+		ac, ok := wanted[name]
+		if ok && reflect.DeepEqual(ac, app.AppConfig) {
+			continue
+		}
+		app.Stop()
+		delete(wm.apps, name)
+	}
+	for _, ac := range wm.config.Apps {
+		if _, ok := wm.apps[ac.Name]; ok {
+			continue
+		}
+		app := &App{AppConfig: ac}
+		wm.apps[ac.Name] = app
+		if ac.Manual {
+			continue
+		}
+		if err := wm.startApp(app); err != nil {
+			log.Printf("app %s: %v", app.Name, err)
+		}
+	}
+}
+
+// LaunchApp starts the named app, unless it is already running. The
+// caller must hold wm.mu.
+func (wm *WM) LaunchApp(name string) error {
+	app, ok := wm.apps[name]
+	if !ok {
+		return fmt.Errorf("no app %q", name)
+	}
+	if app.proc != nil {
+		return nil
+	}
+	return wm.startApp(app)
+}
+
+// StopApp stops the named app. The caller must hold wm.mu.
+func (wm *WM) StopApp(name string) error {
+	app, ok := wm.apps[name]
+	if !ok {
+		return fmt.Errorf("no app %q", name)
+	}
+	app.Stop()
+	return nil
+}
+
+// RestartApp stops the named app, and starts it again once it exited.
+// The caller must hold wm.mu.
+func (wm *WM) RestartApp(name string) error {
+	app, ok := wm.apps[name]
+	if !ok {
+		return fmt.Errorf("no app %q", name)
+	}
+	proc := app.proc
+	if proc == nil {
+		return wm.startApp(app)
+	}
+	app.Stop()
+	app.restarting = true
+	time.AfterFunc(appKillTimeout, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if app.proc != proc {
+			return
+		}
+		log.Printf("app %s: did not exit, killing", app.Name)
+		if err := syscall.Kill(-proc.Pid, syscall.SIGKILL); err != nil {
+			log.Printf("app %s: %v", app.Name, err)
+		}
+	})
+	return nil
+}
+
+// startApp launches the app, and watches for it to exit. The caller
+// must hold wm.mu.
+func (wm *WM) startApp(app *App) error {
+	cmd := exec.Command(app.Command[0], app.Command[1:]...)
+	cmd.Env = append(os.Environ(), app.Env...)
+	cmd.Dir = app.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("app %s: started, pid %d", app.Name, cmd.Process.Pid)
+	app.stopping = false
+	app.restarting = false
+	wm.watchApp(app, cmd.Process)
+	return nil
+}
+
+// adoptApp takes over an app that is already running as our child,
+// e.g. one started before an in-place restart. The caller must hold
+// wm.mu.
+func (wm *WM) adoptApp(app *App) {
+	proc, err := os.FindProcess(app.PID)
+	if err != nil || proc.Signal(syscall.Signal(0)) != nil {
+		// Exited while we were restarting.
+		app.PID = 0
+		wm.apps[app.Name] = app
+		if app.Restart {
+			if err := wm.startApp(app); err != nil {
+				log.Printf("app %s: %v", app.Name, err)
+			}
+		}
+		return
+	}
+	wm.apps[app.Name] = app
+	wm.watchApp(app, proc)
+}
+
+// watchApp waits for the process to exit, and restarts the app if
+// so configured.
+func (wm *WM) watchApp(app *App, proc *os.Process) {
+	app.proc = proc
+	app.PID = proc.Pid
+	go func() {
+		state, err := proc.Wait()
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if err != nil {
+			log.Printf("app %s: %v", app.Name, err)
+		} else {
+			log.Printf("app %s: exited: %v", app.Name, state)
+		}
+		if app.proc != proc {
+			// Already replaced by a newer instance.
+			return
+		}
+		app.proc = nil
+		app.PID = 0
+		if app.restarting && wm.apps[app.Name] == app {
+			if err := wm.startApp(app); err != nil {
+				log.Printf("app %s: %v", app.Name, err)
+			}
+			return
+		}
+		if app.stopping || !app.Restart || wm.apps[app.Name] != app {
+			return
+		}
+		time.AfterFunc(appRestartDelay, func() {
+			wm.mu.Lock()
+			defer wm.mu.Unlock()
+			if app.proc != nil || app.stopping || wm.apps[app.Name] != app {
+				return
+			}
+			app.Restarts++
+			if err := wm.startApp(app); err != nil {
+				log.Printf("app %s: %v", app.Name, err)
+			}
+		})
+	}()
+}
+
+// Stop asks the app's process group to terminate. It will not be
+// restarted.
+func (app *App) Stop() {
+	app.stopping = true
+	if app.proc == nil {
+		return
+	}
+	if err := syscall.Kill(-app.proc.Pid, syscall.SIGTERM); err != nil {
+		log.Printf("app %s: %v", app.Name, err)
+	}
+}
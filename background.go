@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// Background image modes.
+const (
+	BackgroundScaled   = "scaled"
+	BackgroundCentered = "centered"
+	BackgroundTiled    = "tiled"
+)
+
+// What a screen's background shows.
+const (
+	BackgroundStateNormal    = "normal"
+	BackgroundStateSplash    = "splash"
+	BackgroundStateNoContent = "no-content"
+)
+
+// maxBackgroundUpload limits the size of uploaded images.
+const maxBackgroundUpload = 32 << 20
+
+// maxBackgroundPixels limits the dimensions of uploaded images, which
+// take 4 bytes per pixel once decoded, and twice that while they are
+// converted.
+const maxBackgroundPixels = 1 << 25
+
+// backgroundUploadTimeout is how long an image upload may take.
+const backgroundUploadTimeout = 30 * time.Second
+
+// Background is what a screen shows where no client covers it.
+type Background struct {
+	// Color is #rgb or #rrggbb. It fills the screen around the
+	// image. Defaults to black.
+	Color string `yaml:"color" json:"color"`
+	// Image is the path of a PNG or JPEG file. It is empty for
+	// images uploaded through the API.
+	Image string `yaml:"image" json:"image,omitempty"`
+	// Mode is scaled (to fit, the default), centered or tiled. It
+	// also applies to the splash and no-content images.
+	Mode string `yaml:"mode" json:"mode"`
+	// Uploaded is set if the image was uploaded.
+	Uploaded bool `yaml:"-" json:"uploaded,omitempty"`
+
+	img *image.RGBA
+}
+
+// BackgroundConfig configures the root window background.
+type BackgroundConfig struct {
+	// Background is the default for all screens.
+	Background `yaml:",inline"`
+	// Screens overrides the background for some screens, by index.
+	Screens map[int]*Background `yaml:"screens" json:"screens,omitempty"`
+	// Splash is an image shown at startup, on each screen until a
+	// client is mapped there, or SplashTimeout passes.
+	Splash        string   `yaml:"splash" json:"splash"`
+	SplashTimeout Duration `yaml:"splash_timeout" json:"splash_timeout"`
+	// NoContent is an image shown on screens without visible
+	// clients (after the splash).
+	NoContent string `yaml:"no_content" json:"no_content"`
+}
+
+// Validate checks the background for errors. Image files are only
+// loaded when the config is applied.
+func (bg *Background) Validate() error {
+	if bg.Color != "" {
+		if _, err := parseColor(bg.Color); err != nil {
+			return err
+		}
+	}
+	switch bg.Mode {
+	case "", BackgroundScaled, BackgroundCentered, BackgroundTiled:
+	default:
+		return fmt.Errorf("unknown mode %q", bg.Mode)
+	}
+	return nil
+}
+
+// Validate checks the background config for errors.
+func (bc *BackgroundConfig) Validate() error {
+	if err := bc.Background.Validate(); err != nil {
+		return err
+	}
+	for screen, bg := range bc.Screens {
+		if screen < 0 {
+			return fmt.Errorf("screens: bad screen %d", screen)
+		}
+		if bg == nil {
+			return fmt.Errorf("screens.%d: empty", screen)
+		}
+		if err := bg.Validate(); err != nil {
+			return fmt.Errorf("screens.%d: %v", screen, err)
+		}
+	}
+	if bc.SplashTimeout < 0 {
+		return errors.New("splash_timeout: must not be negative")
+	}
+	return nil
+}
+
+// parseColor parses #rgb or #rrggbb.
+func parseColor(spec string) (color.RGBA, error) {
+	if !strings.HasPrefix(spec, "#") || len(spec) != 4 && len(spec) != 7 {
+		return color.RGBA{}, fmt.Errorf("bad colour %q", spec)
+	}
+	v, err := strconv.ParseUint(spec[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("bad colour %q", spec)
+	}
+	if len(spec) == 4 {
+		return color.RGBA{
+			R: uint8(v>>8) * 0x11,
+			G: uint8(v>>4&0xf) * 0x11,
+			B: uint8(v&0xf) * 0x11,
+			A: 0xff,
+		}, nil
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// decodeImage decodes a PNG or JPEG image.
+func decodeImage(r io.Reader) (*image.RGBA, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+func loadImage(path string) (*image.RGBA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeImage(f)
+}
+
+// loadBackgroundImages loads the images named in the config. Images
+// that can't be loaded are logged and left out. The caller must hold
+// wm.mu.
+func (wm *WM) loadBackgroundImages(bc *BackgroundConfig) {
+	wm.images = map[string]*image.RGBA{}
+	paths := []string{bc.Image, bc.Splash, bc.NoContent}
+	for _, bg := range bc.Screens {
+		paths = append(paths, bg.Image)
+	}
+	for _, path := range paths {
+		if _, ok := wm.images[path]; ok || path == "" {
+			continue
+		}
+		img, err := loadImage(path)
+		if err != nil {
+			log.Printf("background: %v", err)
+			continue
+		}
+		wm.images[path] = img
+	}
+}
+
+// initBackgrounds puts up the splash screen at startup, but not after
+// an in-place restart.
+func (wm *WM) initBackgrounds() {
+	wm.splash = map[int]bool{}
+	bc := &wm.config.Background
+	if bc.Splash == "" || wm.restored != nil {
+		return
+	}
+	for n := range wm.attachedScreens {
+		wm.splash[n] = true
+	}
+	if bc.SplashTimeout > 0 {
+		time.AfterFunc(time.Duration(bc.SplashTimeout), func() {
+			wm.mu.Lock()
+			defer wm.mu.Unlock()
+			wm.splash = map[int]bool{}
+			wm.updateBackgrounds()
+		})
+	}
+}
+
+// screenBackground returns the background of the screen: set through
+// the API, or from the config.
+func (wm *WM) screenBackground(n int) *Background {
+	if bg, ok := wm.backgrounds[n]; ok {
+		return bg
+	}
+	if bg, ok := wm.config.Background.Screens[n]; ok {
+		return bg
+	}
+	return &wm.config.Background.Background
+}
+
+// backgroundState tells what the screen should show.
+func (wm *WM) backgroundState(n int) string {
+	for _, c := range wm.clients {
+		if c.Visible && wm.clientScreen(c) == n {
+			return BackgroundStateNormal
+		}
+	}
+	if wm.splash[n] && wm.config.Background.Splash != "" {
+		return BackgroundStateSplash
+	}
+	if wm.config.Background.NoContent != "" {
+		return BackgroundStateNoContent
+	}
+	return BackgroundStateNormal
+}
+
+// SetBackground sets the background of a screen. A nil background
+// goes back to the config. The caller must hold wm.mu.
+func (wm *WM) SetBackground(n int, bg *Background) error {
+	if n >= len(wm.attachedScreens) {
+		return fmt.Errorf("no screen %d", n)
+	}
+	if bg == nil {
+		delete(wm.backgrounds, n)
+	} else {
+		if err := bg.Validate(); err != nil {
+			return err
+		}
+		wm.backgrounds[n] = bg
+	}
+	wm.paintedBackgrounds = nil
+	return wm.updateBackgrounds()
+}
+
+// updateBackgrounds repaints the root window if what any screen should
+// show has changed. Screens that got a client are done with the
+// splash. The caller must hold wm.mu.
+func (wm *WM) updateBackgrounds() error {
+	states := make([]string, len(wm.attachedScreens))
+	for n := range wm.attachedScreens {
+		states[n] = wm.backgroundState(n)
+		if states[n] == BackgroundStateNormal {
+			delete(wm.splash, n)
+		}
+	}
+	if len(states) == len(wm.paintedBackgrounds) {
+		changed := false
+		for n := range states {
+			changed = changed || states[n] != wm.paintedBackgrounds[n]
+		}
+		if !changed {
+			return nil
+		}
+	}
+	// Don't retry failed paints until something changes.
+	wm.paintedBackgrounds = states
+	if err := wm.paintBackgrounds(states); err != nil {
+		return fmt.Errorf("painting background: %v", err)
+	}
+	return nil
+}
+
+// paintBackgrounds renders the screens' backgrounds into a pixmap, and
+// sets it as the root window background.
+func (wm *WM) paintBackgrounds(states []string) error {
+	w, h := int(wm.xroot.WidthInPixels), int(wm.xroot.HeightInPixels)
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	for n, s := range wm.attachedScreens {
+		bg := wm.screenBackground(n)
+		img := bg.img
+		if img == nil {
+			img = wm.images[bg.Image]
+		}
+		switch states[n] {
+		case BackgroundStateSplash:
+			img = wm.images[wm.config.Background.Splash]
+		case BackgroundStateNoContent:
+			img = wm.images[wm.config.Background.NoContent]
+		}
+		r := image.Rect(
+			int(s.XOrg), int(s.YOrg),
+			int(s.XOrg)+int(s.Width), int(s.YOrg)+int(s.Height),
+		)
+		col := color.RGBA{A: 0xff}
+		if bg.Color != "" {
+			col, _ = parseColor(bg.Color)
+		}
+		drawBackground(canvas, r, col, img, bg.Mode)
+	}
+
+	pixmap, err := xproto.NewPixmapId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = xproto.CreatePixmapChecked(
+		wm.xc,
+		wm.xroot.RootDepth,
+		pixmap,
+		xproto.Drawable(wm.xroot.Root),
+		uint16(w), uint16(h),
+	).Check(); err != nil {
+		return err
+	}
+	if err = wm.putImage(xproto.Drawable(pixmap), canvas); err != nil {
+		xproto.FreePixmap(wm.xc, pixmap)
+		return err
+	}
+	root := wm.xroot.Root
+	xproto.ChangeWindowAttributes(wm.xc, root, xproto.CwBackPixmap, []uint32{uint32(pixmap)})
+	xproto.ClearArea(wm.xc, false, root, 0, 0, 0, 0)
+	// Let compositors and pseudo-transparent clients find the
+	// background.
+	for _, atom := range []xproto.Atom{atomXRootPmapID, atomESetRootPmapID} {
+		xproto.ChangeProperty(
+			wm.xc,
+			xproto.PropModeReplace,
+			root,
+			atom,
+			xproto.AtomPixmap,
+			32, // format
+			1,
+			encodeUint32s(uint32(pixmap)),
+		)
+	}
+	if wm.rootPixmap != 0 {
+		xproto.FreePixmap(wm.xc, wm.rootPixmap)
+	}
+	wm.rootPixmap = pixmap
+	wm.scheduleRepaint()
+	return nil
+}
+
+// drawBackground fills r with the colour, and draws the image in it.
+func drawBackground(dst *image.RGBA, r image.Rectangle, col color.RGBA, img *image.RGBA, mode string) {
+	draw.Draw(dst, r, &image.Uniform{col}, image.Point{}, draw.Src)
+	if img == nil {
+		return
+	}
+	iw, ih := img.Bounds().Dx(), img.Bounds().Dy()
+	if iw == 0 || ih == 0 {
+		return
+	}
+	switch mode {
+	case BackgroundCentered:
+		// Images larger than the screen are cropped.
+		at := image.Pt(r.Min.X+(r.Dx()-iw)/2, r.Min.Y+(r.Dy()-ih)/2)
+		draw.Draw(dst, r, img, r.Min.Sub(at), draw.Over)
+	case BackgroundTiled:
+		for y := r.Min.Y; y < r.Max.Y; y += ih {
+			for x := r.Min.X; x < r.Max.X; x += iw {
+				tile := image.Rect(x, y, x+iw, y+ih).Intersect(r)
+				draw.Draw(dst, tile, img, image.Point{}, draw.Over)
+			}
+		}
+	default:
+		// Fit the image, keeping the aspect ratio.
+		w, h := r.Dx(), r.Dx()*ih/iw
+		if h > r.Dy() {
+			w, h = r.Dy()*iw/ih, r.Dy()
+		}
+		at := image.Pt(r.Min.X+(r.Dx()-w)/2, r.Min.Y+(r.Dy()-h)/2)
+		scaleImage(dst, image.Rectangle{at, at.Add(image.Pt(w, h))}, img)
+	}
+}
+
+// shrinkImage returns the image scaled down to fit in w×h, keeping its
+// aspect ratio, or the image itself if it fits.
+func shrinkImage(img *image.RGBA, w, h int) *image.RGBA {
+	iw, ih := img.Bounds().Dx(), img.Bounds().Dy()
+	if iw <= w && ih <= h {
+		return img
+	}
+	sw, sh := w, w*ih/iw
+	if sh > h {
+		sw, sh = h*iw/ih, h
+	}
+	if sw < 1 {
+		sw = 1
+	}
+	if sh < 1 {
+		sh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	scaleImage(dst, dst.Bounds(), img)
+	return dst
+}
+
+// scaleImage draws src scaled into r, with bilinear filtering.
+func scaleImage(dst *image.RGBA, r image.Rectangle, src *image.RGBA) {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		fy := (float64(y-r.Min.Y)+0.5)*float64(sh)/float64(r.Dy()) - 0.5
+		y0 := int(fy)
+		if fy < 0 {
+			fy, y0 = 0, 0
+		}
+		y1 := y0 + 1
+		if y1 >= sh {
+			y1 = sh - 1
+		}
+		wy := fy - float64(y0)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			fx := (float64(x-r.Min.X)+0.5)*float64(sw)/float64(r.Dx()) - 0.5
+			x0 := int(fx)
+			if fx < 0 {
+				fx, x0 = 0, 0
+			}
+			x1 := x0 + 1
+			if x1 >= sw {
+				x1 = sw - 1
+			}
+			wx := fx - float64(x0)
+			p00 := src.PixOffset(x0, y0)
+			p01 := src.PixOffset(x1, y0)
+			p10 := src.PixOffset(x0, y1)
+			p11 := src.PixOffset(x1, y1)
+			d := dst.PixOffset(x, y)
+			// Colours are premultiplied, so blend the image
+			// over the background, alpha included.
+			a := (1-wy)*((1-wx)*float64(src.Pix[p00+3])+wx*float64(src.Pix[p01+3])) +
+				wy*((1-wx)*float64(src.Pix[p10+3])+wx*float64(src.Pix[p11+3]))
+			for i := 0; i < 4; i++ {
+				v := (1-wy)*((1-wx)*float64(src.Pix[p00+i])+wx*float64(src.Pix[p01+i])) +
+					wy*((1-wx)*float64(src.Pix[p10+i])+wx*float64(src.Pix[p11+i]))
+				dst.Pix[d+i] = uint8(v + float64(dst.Pix[d+i])*(1-a/0xff) + 0.5)
+			}
+		}
+	}
+}
+
+// pixelFormat is how pixels of a visual are laid out in a ZPixmap
+// image.
+type pixelFormat struct {
+	depth            byte
+	bytesPerPixel    int
+	scanlinePad      int
+	red, green, blue uint32
+	msbFirst         bool
+}
+
+func (wm *WM) rootPixelFormat() (*pixelFormat, error) {
+	return wm.visualPixelFormat(wm.xroot.RootDepth, wm.xroot.RootVisual)
+}
+
+func (wm *WM) visualPixelFormat(depth byte, visual xproto.Visualid) (*pixelFormat, error) {
+	setup := xproto.Setup(wm.xc)
+	pf := &pixelFormat{
+		depth:    depth,
+		msbFirst: setup.ImageByteOrder == xproto.ImageOrderMSBFirst,
+	}
+	for _, d := range wm.xroot.AllowedDepths {
+		for _, v := range d.Visuals {
+			if d.Depth == depth && v.VisualId == visual {
+				pf.red, pf.green, pf.blue = v.RedMask, v.GreenMask, v.BlueMask
+			}
+		}
+	}
+	for _, f := range setup.PixmapFormats {
+		if f.Depth == pf.depth {
+			pf.bytesPerPixel = int(f.BitsPerPixel) / 8
+			pf.scanlinePad = int(f.ScanlinePad) / 8
+		}
+	}
+	if pf.red == 0 || pf.bytesPerPixel < 2 || pf.scanlinePad == 0 {
+		return nil, fmt.Errorf("unsupported visual (depth %d)", pf.depth)
+	}
+	return pf, nil
+}
+
+// channel scales an 8-bit colour channel into the mask.
+func channel(v uint8, mask uint32) uint32 {
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	c := uint32(v)
+	if width < 8 {
+		c >>= 8 - width
+	} else {
+		c <<= width - 8
+	}
+	return c << shift & mask
+}
+
+// putImage uploads the image to the drawable, in as many requests as
+// the maximum request length needs.
+func (wm *WM) putImage(d xproto.Drawable, img *image.RGBA) error {
+	pf, err := wm.rootPixelFormat()
+	if err != nil {
+		return err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := (w*pf.bytesPerPixel + pf.scanlinePad - 1) / pf.scanlinePad * pf.scanlinePad
+	data := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.PixOffset(x, y)
+			v := channel(img.Pix[p], pf.red) |
+				channel(img.Pix[p+1], pf.green) |
+				channel(img.Pix[p+2], pf.blue)
+			o := y*stride + x*pf.bytesPerPixel
+			for i := 0; i < pf.bytesPerPixel; i++ {
+				b := byte(v >> (8 * i))
+				if pf.msbFirst {
+					data[o+pf.bytesPerPixel-1-i] = b
+				} else {
+					data[o+i] = b
+				}
+			}
+		}
+	}
+
+	gc, err := xproto.NewGcontextId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = xproto.CreateGCChecked(wm.xc, gc, d, 0, nil).Check(); err != nil {
+		return err
+	}
+	defer xproto.FreeGC(wm.xc, gc)
+	// The request header takes 24 bytes.
+	maxLen := int(xproto.Setup(wm.xc).MaximumRequestLength)*4 - 24
+	rows := maxLen / stride
+	if rows < 1 {
+		return errors.New("screen too wide to upload")
+	}
+	for y := 0; y < h; y += rows {
+		n := rows
+		if y+n > h {
+			n = h - y
+		}
+		if err = xproto.PutImageChecked(
+			wm.xc,
+			xproto.ImageFormatZPixmap,
+			d,
+			gc,
+			uint16(w), uint16(n),
+			0, int16(y),
+			0, // left pad
+			pf.depth,
+			data[y*stride:(y+n)*stride],
+		).Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadBackground sets the screen's background to an image uploaded
+// as the body, with the colour and mode in the query. The image is
+// read and decoded without the WM lock, with longer deadlines than the
+// API's 1s timeouts, and scaled down if it is larger than the root
+// window.
+func (as *APIServer) uploadBackground(w http.ResponseWriter, r *http.Request, n int) {
+	if conn := requestConn(r); conn != nil {
+		conn.SetReadDeadline(time.Now().Add(backgroundUploadTimeout))
+		conn.SetWriteDeadline(time.Now().Add(backgroundUploadTimeout))
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBackgroundUpload))
+	if err != nil {
+		errorResponse(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		errorResponse(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if cfg.Width*cfg.Height > maxBackgroundPixels {
+		errorResponse(w, r, http.StatusUnprocessableEntity,
+			fmt.Errorf("image is %dx%d, more than %d pixels",
+				cfg.Width, cfg.Height, maxBackgroundPixels))
+		return
+	}
+	img, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		errorResponse(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	as.wm.mu.Lock()
+	rootW, rootH := int(as.wm.xroot.WidthInPixels), int(as.wm.xroot.HeightInPixels)
+	as.wm.mu.Unlock()
+	img = shrinkImage(img, rootW, rootH)
+	bg := &Background{
+		Color:    r.URL.Query().Get("color"),
+		Mode:     r.URL.Query().Get("mode"),
+		Uploaded: true,
+		img:      img,
+	}
+	as.wm.mu.Lock()
+	defer as.wm.mu.Unlock()
+	if err := as.wm.SetBackground(n, bg); err != nil {
+		errorResponse(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	jsonResponse(w, r, 200, map[string]interface{}{
+		"item":  as.wm.screenBackground(n),
+		"state": as.wm.backgroundState(n),
+	})
+}
+
+func (as *APIServer) backgroundRoutes(router *mux.Router) {
+	// Images are uploaded as the body, with the colour and mode in
+	// the query. Otherwise, the body is a JSON Background without
+	// an image.
+	locked := as.locked(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		if n >= len(as.wm.attachedScreens) {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			bg := &Background{}
+			if err := json.NewDecoder(r.Body).Decode(bg); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if bg.Image != "" {
+				errorResponse(w, r, http.StatusUnprocessableEntity,
+					errors.New("upload images as image/png or image/jpeg"))
+				return
+			}
+			if err := as.wm.SetBackground(n, bg); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			if err := as.wm.SetBackground(n, nil); err != nil {
+				errorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"item":  as.wm.screenBackground(n),
+			"state": as.wm.backgroundState(n),
+		})
+	})
+	router.HandleFunc("/screens/{n:[0-9]+}/background", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasPrefix(r.Header.Get("Content-Type"), "image/") {
+			n, _ := strconv.Atoi(mux.Vars(r)["n"])
+			as.uploadBackground(w, r, n)
+			return
+		}
+		locked(w, r)
+	}).Methods("GET", "PUT", "DELETE")
+}
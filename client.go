@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/xgb"
@@ -17,13 +18,46 @@ type Client struct {
 	// one of: StackModeAbove (default), StackModeBelow,
 	// StackModeTopIf, StackModeBottomIf, StackModeOpposite.
 	StackMode uint32
+	// Layer is the stacking layer: below, normal, above or
+	// overlay. Clients stay stacked in the order of their layers.
+	Layer string
+	// Opacity is from 0 (transparent) to 1 (opaque), for a
+	// compositor to apply.
+	Opacity float64
+	// OpacitySet is set once Opacity was set through the API or
+	// restored from a layout. Until then, the client's own
+	// _NET_WM_WINDOW_OPACITY is left alone.
+	OpacitySet bool
 	// Name is the window name
 	Name string
+	// Class and Instance come from WM_CLASS, Role from
+	// WM_WINDOW_ROLE. They identify the client across restarts.
+	Class, Instance, Role string
+	// Visible is set while the window is mapped.
+	Visible bool
+	// Type is the EWMH window type, like "normal" or "dialog".
+	Type string
+	// TransientFor is the window this one is a dialog of, if any.
+	TransientFor xproto.Window
 
 	// xc is our private pointer to the X11 socket
 	xc *xgb.Conn
 	// window is the (private) ID of our X11 window
 	window xproto.Window
+	// ignoreUnmaps counts the UnmapNotify events caused by our own
+	// Hide calls, which are still to arrive. Any other unmap was
+	// caused by the client.
+	ignoreUnmaps int
+	// mapRequested is set between the client's MapRequest and the
+	// resulting MapNotify.
+	mapRequested bool
+	// layoutRestored is set if the client was placed by a persisted
+	// layout, which its ConfigureRequests don't override.
+	layoutRestored bool
+	// opacity is the _NET_WM_WINDOW_OPACITY set now, which differs
+	// from Opacity while fading.
+	opacity float64
+	fade    *fade
 }
 
 // NewClient allocates the Client struct, with the X socket and Window
@@ -37,6 +71,11 @@ func NewClient(xc *xgb.Conn, w xproto.Window) *Client {
 		W:         0,
 		H:         0,
 		StackMode: xproto.StackModeAbove,
+		Layer:     LayerNormal,
+		Opacity:   1,
+		Visible:   true,
+
+		opacity: 1,
 
 		xc:     xc,
 		window: w,
@@ -57,7 +96,8 @@ func (c *Client) Init() (err error) {
 		xproto.CwEventMask,
 		[]uint32{
 			xproto.EventMaskStructureNotify |
-				xproto.EventMaskEnterWindow,
+				xproto.EventMaskEnterWindow |
+				xproto.EventMaskFocusChange,
 		},
 	).Check(); err != nil {
 		return
@@ -115,8 +155,9 @@ func (c *Client) Configure() error {
 	).Check()
 }
 
-// WarpPointer puts the mouse pointer inside of this client's window.
-func (c *Client) WarpPointer() error {
+// WarpPointer puts the mouse pointer inside of this client's window,
+// at x and y relative to its top left corner.
+func (c *Client) WarpPointer(x, y int16) error {
 	return xproto.WarpPointerChecked(
 		c.xc,     // conn
 		0,        // src
@@ -125,8 +166,8 @@ func (c *Client) WarpPointer() error {
 		0,        // src x
 		0,        // src w
 		0,        // src h
-		10,       // dst x
-		10,       // dst y
+		x,        // dst x
+		y,        // dst y
 	).Check()
 }
 
@@ -186,9 +227,22 @@ func (c *Client) CloseForcefully() error {
 	return xproto.DestroyWindowChecked(c.xc, c.window).Check()
 }
 
-// Hide requests the client to unmap (hide).
+// Hide requests the client to unmap (hide). The resulting
+// UnmapNotify is expected, and won't be mistaken for the client
+// withdrawing the window. Windows that aren't mapped get none.
 func (c *Client) Hide() error {
-	return xproto.UnmapWindowChecked(c.xc, c.window).Check()
+	attrs, err := xproto.GetWindowAttributes(c.xc, c.window).Reply()
+	if err != nil {
+		return err
+	}
+	if attrs.MapState == xproto.MapStateUnmapped {
+		return nil
+	}
+	if err := xproto.UnmapWindowChecked(c.xc, c.window).Check(); err != nil {
+		return err
+	}
+	c.ignoreUnmaps++
+	return nil
 }
 
 // Show requests the client to show up again.
@@ -196,6 +250,84 @@ func (c *Client) Show() error {
 	return xproto.MapWindowChecked(c.xc, c.window).Check()
 }
 
+// SetWMState sets the ICCCM WM_STATE property, and keeps
+// _NET_WM_STATE_HIDDEN in sync with it.
+func (c *Client) SetWMState(state uint32) error {
+	err := xproto.ChangePropertyChecked(
+		c.xc,                    // conn
+		xproto.PropModeReplace,  // mode
+		c.window,                // window
+		atomWMState,             // property
+		atomWMState,             // type
+		32,                      // format
+		2,                       // data len
+		encodeUint32s(state, 0), // data: state, icon window
+	).Check()
+	if err != nil {
+		return err
+	}
+	if state == WithdrawnState {
+		return xproto.DeletePropertyChecked(c.xc, c.window, atomNETWMState).Check()
+	}
+	return c.setNETWMState(atomNETWMStateHidden, state == IconicState)
+}
+
+// GetWMState returns the ICCCM WM_STATE of the window, or
+// WithdrawnState if it has none.
+func (c *Client) GetWMState() (uint32, error) {
+	prop, err := xproto.GetProperty(
+		c.xc,        // conn
+		false,       // delete
+		c.window,    // window
+		atomWMState, // property
+		atomWMState, // type
+		0,           // offset
+		2,           // length
+	).Reply()
+	if err != nil {
+		return WithdrawnState, err
+	}
+	if len(prop.Value) < 4 {
+		return WithdrawnState, nil
+	}
+	return decodeUint32s(prop.Value)[0], nil
+}
+
+// setNETWMState adds or removes an atom from the _NET_WM_STATE list.
+func (c *Client) setNETWMState(atom xproto.Atom, on bool) error {
+	prop, err := xproto.GetProperty(
+		c.xc,            // conn
+		false,           // delete
+		c.window,        // window
+		atomNETWMState,  // property
+		xproto.AtomAtom, // type
+		0,               // offset
+		(1<<32)-1,       // length
+	).Reply()
+	if err != nil {
+		return err
+	}
+	atoms := []uint32{}
+	for _, a := range decodeUint32s(prop.Value) {
+		if xproto.Atom(a) != atom {
+			atoms = append(atoms, a)
+		}
+	}
+	if on {
+		atoms = append(atoms, uint32(atom))
+	}
+	return xproto.ChangePropertyChecked(
+		c.xc,                    // conn
+		xproto.PropModeReplace,  // mode
+		c.window,                // window
+		atomNETWMState,          // property
+		xproto.AtomAtom,         // type
+		32,                      // format
+		uint32(len(atoms)),      // data len
+		encodeUint32s(atoms...), // data
+	).Check()
+}
+
 // GetName queries for the current WM_NAME / _NET_WM_NAME property
 // (window name). _NET_WM_NAME is checked first, and if empty, WM_NAME
 // is checked.
@@ -232,6 +364,99 @@ func (c *Client) GetName() (name string, err error) {
 	return
 }
 
+// GetClass queries for the WM_CLASS property, which holds the
+// instance and class names.
+func (c *Client) GetClass() (instance, class string, err error) {
+	prop, err := xproto.GetProperty(
+		c.xc,                      // conn
+		false,                     // delete
+		c.window,                  // window
+		xproto.AtomWmClass,        // property
+		xproto.GetPropertyTypeAny, // atom
+		0,                         // offset
+		(1<<32)-1,                 // length
+	).Reply()
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(string(prop.Value), "\x00", 3)
+	instance = parts[0]
+	if len(parts) > 1 {
+		class = parts[1]
+	}
+	return
+}
+
+// GetRole queries for the WM_WINDOW_ROLE property.
+func (c *Client) GetRole() (role string, err error) {
+	prop, err := xproto.GetProperty(
+		c.xc,                      // conn
+		false,                     // delete
+		c.window,                  // window
+		atomWMWindowRole,          // property
+		xproto.GetPropertyTypeAny, // atom
+		0,                         // offset
+		(1<<32)-1,                 // length
+	).Reply()
+	if err != nil {
+		return
+	}
+	role = string(prop.Value)
+	return
+}
+
+// GetWindowType reads the first known type from _NET_WM_WINDOW_TYPE.
+// Windows without one are "normal", or "dialog" if they are transient
+// (EWMH 1.5).
+func (c *Client) GetWindowType() (string, error) {
+	prop, err := xproto.GetProperty(c.xc, false, c.window, atomNETWMWindowType,
+		xproto.AtomAtom, 0, 32).Reply()
+	if err != nil {
+		return "", err
+	}
+	for v := prop.Value; len(v) >= 4; v = v[4:] {
+		if name, ok := windowTypes[decodeAtom(v)]; ok {
+			return name, nil
+		}
+	}
+	if c.TransientFor != 0 {
+		return "dialog", nil
+	}
+	return "normal", nil
+}
+
+// GetTransientFor reads WM_TRANSIENT_FOR.
+func (c *Client) GetTransientFor() (xproto.Window, error) {
+	prop, err := xproto.GetProperty(c.xc, false, c.window,
+		xproto.AtomWmTransientFor, xproto.AtomWindow, 0, 1).Reply()
+	if err != nil || len(prop.Value) < 4 {
+		return 0, err
+	}
+	return xproto.Window(decodeUint32s(prop.Value)[0]), nil
+}
+
+// GetUserTime reads _NET_WM_USER_TIME, the time of the last user
+// activity in the window, from the window or its
+// _NET_WM_USER_TIME_WINDOW. ok is false if the client does not set
+// it.
+func (c *Client) GetUserTime() (t xproto.Timestamp, ok bool, err error) {
+	win := c.window
+	prop, err := xproto.GetProperty(c.xc, false, win, atomNETWMUserTimeWindow,
+		xproto.AtomWindow, 0, 1).Reply()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(prop.Value) >= 4 {
+		win = xproto.Window(decodeUint32s(prop.Value)[0])
+	}
+	prop, err = xproto.GetProperty(c.xc, false, win, atomNETWMUserTime,
+		xproto.AtomCardinal, 0, 1).Reply()
+	if err != nil || len(prop.Value) < 4 {
+		return 0, false, err
+	}
+	return xproto.Timestamp(decodeUint32s(prop.Value)[0]), true, nil
+}
+
 // MakeFullscreen will re-arrange this client to fit the given screen.
 func (c *Client) MakeFullscreen(screen *xinerama.ScreenInfo) {
 	c.X = screen.XOrg
@@ -240,6 +465,40 @@ func (c *Client) MakeFullscreen(screen *xinerama.ScreenInfo) {
 	c.H = screen.Height
 }
 
+// TakeFocus gives the focus to the client. Clients that support
+// WM_TAKE_FOCUS are asked to take it themselves. t is the time of the
+// event that caused the focus change.
+func (c *Client) TakeFocus(t xproto.Timestamp) error {
+	prop, err := xproto.GetProperty(c.xc, false, c.window, atomWMProtocols,
+		xproto.GetPropertyTypeAny, 0, 64).Reply()
+	if err != nil {
+		return err
+	}
+	for v := prop.Value; len(v) >= 4; v = v[4:] {
+		if decodeAtom(v) == atomWMTakeFocus {
+			return xproto.SendEventChecked(
+				c.xc,
+				false,
+				c.window,
+				xproto.EventMaskNoEvent,
+				string(xproto.ClientMessageEvent{
+					Format: 32,
+					Window: c.window,
+					Type:   atomWMProtocols,
+					Data: xproto.ClientMessageDataUnionData32New([]uint32{
+						uint32(atomWMTakeFocus),
+						uint32(t),
+						0,
+						0,
+						0,
+					}),
+				}.Bytes())).Check()
+		}
+	}
+	c.Focus()
+	return nil
+}
+
 // Focus will shift keyboard focus to this client
 func (c *Client) Focus() {
 	xproto.SetInputFocus(
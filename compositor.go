@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/composite"
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/render"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// repaintDelay is the time given for damage to pile up before the
+// screen is repainted, which caps the frame rate at about 60 fps.
+const repaintDelay = 16 * time.Millisecond
+
+// CompositorConfig configures the built-in compositing manager.
+//
+// When it runs, all top-level windows are redirected off screen with
+// the Composite extension, and painted with XRender onto the composite
+// overlay window, so that client opacity and fades are shown, and
+// screenshots of covered or hidden windows can be taken. The X server
+// renders in software, so no GPU is needed.
+type CompositorConfig struct {
+	// Enabled makes the WM the compositing manager. It fails if
+	// another compositor is running.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// compWindow is a top-level window painted by the compositor.
+type compWindow struct {
+	window xproto.Window
+	// x, y, w and h are the window's outer geometry, with the
+	// border.
+	x, y   int16
+	w, h   uint16
+	mapped bool
+	// inputOnly windows have no contents, and are not painted.
+	inputOnly bool
+	format    render.Pictformat
+	depth     byte
+	visual    xproto.Visualid
+	// opacity is the _NET_WM_WINDOW_OPACITY of windows that are
+	// not clients, as read when they were mapped.
+	opacity float64
+	damage  damage.Damage
+	// pixmap holds the window's contents, and picture is for
+	// painting it. They are kept after the window is unmapped,
+	// for screenshots, and named again when it is mapped or
+	// resized.
+	pixmap  xproto.Pixmap
+	picture render.Picture
+	pw, ph  uint16
+	stale   bool
+}
+
+// compositor is the state of the running compositing manager.
+type compositor struct {
+	// owner is the window holding the _NET_WM_CM_Sn selection.
+	owner          xproto.Window
+	overlay        xproto.Window
+	overlayPicture render.Picture
+	// back is the buffer a frame is painted in, before it is
+	// copied to the overlay window in one go.
+	back        xproto.Pixmap
+	backPicture render.Picture
+	backW       uint16
+	backH       uint16
+
+	windows map[xproto.Window]*compWindow
+	// order is the stacking order, bottom to top. It is read again
+	// after windows were created, destroyed, or restacked.
+	order      []*compWindow
+	orderStale bool
+	repaint    *time.Timer
+
+	redirected bool
+	started    bool
+}
+
+// initDamage checks for DAMAGE, which streams use to wait for changes
+// with or without the compositor.
+func (wm *WM) initDamage() {
+	if err := damage.Init(wm.xc); err != nil {
+		log.Printf("DAMAGE: %v", err)
+		return
+	}
+	// The version must be queried before any other request.
+	if _, err := damage.QueryVersion(wm.xc, 1, 1).Reply(); err != nil {
+		log.Printf("DAMAGE: %v", err)
+		return
+	}
+	wm.hasDamage = true
+}
+
+// initCompositing checks for the extensions the compositor needs, and
+// finds the XRender formats of the visuals. initXFixes and initDamage
+// must have run.
+func (wm *WM) initCompositing() {
+	if !wm.hasDamage {
+		return
+	}
+	// The overlay window would take all input without XFixes.
+	if !wm.hasXFixes {
+		log.Print("Compositing needs XFIXES")
+		return
+	}
+	if err := composite.Init(wm.xc); err != nil {
+		log.Printf("Composite: %v", err)
+		return
+	}
+	cv, err := composite.QueryVersion(wm.xc, 0, 4).Reply()
+	if err != nil {
+		log.Printf("Composite: %v", err)
+		return
+	}
+	if cv.MajorVersion == 0 && cv.MinorVersion < 3 {
+		log.Printf("Composite %d.%d has no overlay window", cv.MajorVersion, cv.MinorVersion)
+		return
+	}
+	if err := render.Init(wm.xc); err != nil {
+		log.Printf("RENDER: %v", err)
+		return
+	}
+	if _, err := render.QueryVersion(wm.xc, 0, 11).Reply(); err != nil {
+		log.Printf("RENDER: %v", err)
+		return
+	}
+	formats, err := render.QueryPictFormats(wm.xc).Reply()
+	if err != nil {
+		log.Printf("RENDER: %v", err)
+		return
+	}
+	wm.pictFormats = map[xproto.Visualid]render.Pictformat{}
+	for _, s := range formats.Screens {
+		for _, d := range s.Depths {
+			for _, v := range d.Visuals {
+				wm.pictFormats[v.Visual] = v.Format
+			}
+		}
+	}
+	if wm.pictFormats[wm.xroot.RootVisual] == 0 {
+		log.Print("RENDER: no format for the root visual")
+		return
+	}
+	wm.hasCompositing = true
+}
+
+// rootEventMask is the event mask of the root window. The compositor
+// also follows all top-level windows.
+func (wm *WM) rootEventMask() uint32 {
+	mask := uint32(xproto.EventMaskKeyPress |
+		xproto.EventMaskKeyRelease |
+		xproto.EventMaskButtonPress |
+		xproto.EventMaskButtonRelease |
+		xproto.EventMaskStructureNotify |
+		xproto.EventMaskSubstructureRedirect)
+	if wm.compositor != nil {
+		mask |= xproto.EventMaskSubstructureNotify
+	}
+	return mask
+}
+
+// StartCompositor makes the WM the compositing manager. The caller
+// must hold wm.mu.
+func (wm *WM) StartCompositor() (err error) {
+	if wm.compositor != nil {
+		return nil
+	}
+	if !wm.hasCompositing {
+		return errors.New("Compositing needs Composite 0.3, DAMAGE and RENDER")
+	}
+	root := wm.xroot.Root
+	owner, err := xproto.GetSelectionOwner(wm.xc, atomNETWMCMS).Reply()
+	if err != nil {
+		return err
+	}
+	if owner.Owner != 0 {
+		return fmt.Errorf("another compositor is running (window %d)", owner.Owner)
+	}
+	cm := &compositor{windows: map[xproto.Window]*compWindow{}, orderStale: true}
+	wm.compositor = cm
+	defer func() {
+		if err != nil {
+			wm.StopCompositor()
+		}
+	}()
+
+	if cm.owner, err = xproto.NewWindowId(wm.xc); err != nil {
+		return err
+	}
+	if err = xproto.CreateWindowChecked(
+		wm.xc,
+		0, // depth: copy from parent
+		cm.owner,
+		root,
+		-1, -1, 1, 1, 0, // x, y, w, h, border
+		xproto.WindowClassInputOnly,
+		0, // visual: copy from parent
+		0, nil,
+	).Check(); err != nil {
+		cm.owner = 0
+		return err
+	}
+	if err = xproto.SetSelectionOwnerChecked(
+		wm.xc, cm.owner, atomNETWMCMS, xproto.TimeCurrentTime,
+	).Check(); err != nil {
+		return err
+	}
+	if err = composite.RedirectSubwindowsChecked(
+		wm.xc, root, composite.RedirectManual,
+	).Check(); err != nil {
+		return fmt.Errorf("redirecting windows: %v", err)
+	}
+	cm.redirected = true
+	overlay, err := composite.GetOverlayWindow(wm.xc, root).Reply()
+	if err != nil {
+		return err
+	}
+	cm.overlay = overlay.OverlayWin
+	if err = wm.clickThrough(cm.overlay); err != nil {
+		return err
+	}
+	if cm.overlayPicture, err = render.NewPictureId(wm.xc); err != nil {
+		return err
+	}
+	if err = render.CreatePictureChecked(
+		wm.xc,
+		cm.overlayPicture,
+		xproto.Drawable(cm.overlay),
+		wm.pictFormats[wm.xroot.RootVisual],
+		render.CpSubwindowMode,
+		[]uint32{xproto.SubwindowModeIncludeInferiors},
+	).Check(); err != nil {
+		cm.overlayPicture = 0
+		return err
+	}
+	if err = xproto.ChangeWindowAttributesChecked(
+		wm.xc, root, xproto.CwEventMask, []uint32{wm.rootEventMask()},
+	).Check(); err != nil {
+		return err
+	}
+	if err = wm.paintCompositor(); err != nil {
+		return err
+	}
+	cm.started = true
+	log.Print("compositor started")
+	wm.emit("compositor.started", nil)
+	return nil
+}
+
+// StopCompositor gives the screen back to the X server. The caller
+// must hold wm.mu.
+func (wm *WM) StopCompositor() {
+	cm := wm.compositor
+	if cm == nil {
+		return
+	}
+	if cm.repaint != nil {
+		cm.repaint.Stop()
+	}
+	wm.compositor = nil
+	root := wm.xroot.Root
+	xproto.ChangeWindowAttributes(wm.xc, root, xproto.CwEventMask, []uint32{wm.rootEventMask()})
+	for _, cw := range cm.windows {
+		wm.freeCompWindow(cw)
+	}
+	if cm.backPicture != 0 {
+		render.FreePicture(wm.xc, cm.backPicture)
+	}
+	if cm.back != 0 {
+		xproto.FreePixmap(wm.xc, cm.back)
+	}
+	if cm.overlayPicture != 0 {
+		render.FreePicture(wm.xc, cm.overlayPicture)
+	}
+	if cm.overlay != 0 {
+		composite.ReleaseOverlayWindow(wm.xc, root)
+	}
+	if cm.redirected {
+		composite.UnredirectSubwindows(wm.xc, root, composite.RedirectManual)
+	}
+	if cm.owner != 0 {
+		// This gives up the selection, too.
+		xproto.DestroyWindow(wm.xc, cm.owner)
+	}
+	if cm.started {
+		log.Print("compositor stopped")
+		wm.emit("compositor.stopped", nil)
+	}
+}
+
+// handleCompositorEvent follows the top-level windows, through the
+// events the root window gets for them, and repaints when windows are
+// damaged. The WM handles the same events on the client windows, so
+// these are consumed: it returns true if the event was.
+func (wm *WM) handleCompositorEvent(xev xgb.Event) bool {
+	if e, ok := xev.(damage.NotifyEvent); ok {
+		damage.Subtract(wm.xc, e.Damage, 0, 0)
+		if dw := wm.damageWatches[e.Damage]; dw != nil {
+			// Don't repaint for these, as repainting damages
+			// the root window again.
+			dw.damaged(e.Area)
+		} else {
+			wm.scheduleRepaint()
+		}
+		return true
+	}
+	cm := wm.compositor
+	if cm == nil {
+		return false
+	}
+	root := wm.xroot.Root
+	switch e := xev.(type) {
+	case xproto.CreateNotifyEvent:
+		cm.orderStale = true
+	case xproto.DestroyNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		cm.orderStale = true
+	case xproto.MapNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		if cw := cm.windows[e.Window]; cw != nil {
+			cw.mapped = true
+			cw.stale = true
+			cw.opacity = wm.readOpacity(e.Window)
+		} else {
+			cm.orderStale = true
+		}
+	case xproto.UnmapNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		if cw := cm.windows[e.Window]; cw != nil {
+			cw.mapped = false
+		}
+	case xproto.ConfigureNotifyEvent:
+		if e.Event != root || e.Window == root {
+			return false
+		}
+		if cw := cm.windows[e.Window]; cw != nil {
+			w, h := e.Width+2*e.BorderWidth, e.Height+2*e.BorderWidth
+			if w != cw.w || h != cw.h {
+				cw.stale = true
+			}
+			cw.x, cw.y, cw.w, cw.h = e.X, e.Y, w, h
+		}
+		// The window may have been restacked.
+		cm.orderStale = true
+	case xproto.ReparentNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		cm.orderStale = true
+	case xproto.CirculateNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		cm.orderStale = true
+	case xproto.GravityNotifyEvent:
+		if e.Event != root {
+			return false
+		}
+		cm.orderStale = true
+	default:
+		return false
+	}
+	wm.scheduleRepaint()
+	return true
+}
+
+// readOpacity reads _NET_WM_WINDOW_OPACITY. Windows without it are
+// opaque.
+func (wm *WM) readOpacity(win xproto.Window) float64 {
+	prop, err := xproto.GetProperty(
+		wm.xc, false, win, atomNETWMWindowOpacity, xproto.AtomCardinal, 0, 1,
+	).Reply()
+	if err != nil || prop == nil || len(prop.Value) < 4 {
+		return 1
+	}
+	return float64(xgb.Get32(prop.Value)) / 0xffffffff
+}
+
+// scheduleRepaint repaints the screen soon, if the compositor runs.
+// The caller must hold wm.mu.
+func (wm *WM) scheduleRepaint() {
+	cm := wm.compositor
+	if cm == nil || cm.repaint != nil {
+		return
+	}
+	cm.repaint = time.AfterFunc(repaintDelay, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if wm.compositor != cm {
+			return
+		}
+		cm.repaint = nil
+		if err := wm.paintCompositor(); err != nil {
+			log.Printf("compositor: %v", err)
+		}
+	})
+}
+
+// syncCompWindows reads the stacking order of the top-level windows,
+// and starts or stops following them. The caller must hold wm.mu.
+func (wm *WM) syncCompWindows() error {
+	cm := wm.compositor
+	if !cm.orderStale {
+		return nil
+	}
+	tree, err := xproto.QueryTree(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		return err
+	}
+	present := map[xproto.Window]bool{}
+	cm.order = cm.order[:0]
+	for _, win := range tree.Children {
+		cw := cm.windows[win]
+		if cw == nil {
+			if cw, err = wm.addCompWindow(win); err != nil {
+				// It is probably gone already.
+				continue
+			}
+		}
+		present[win] = true
+		cm.order = append(cm.order, cw)
+	}
+	for win, cw := range cm.windows {
+		if !present[win] {
+			wm.freeCompWindow(cw)
+			delete(cm.windows, win)
+		}
+	}
+	cm.orderStale = false
+	return nil
+}
+
+// addCompWindow starts following a top-level window. The caller must
+// hold wm.mu.
+func (wm *WM) addCompWindow(win xproto.Window) (*compWindow, error) {
+	attrs, err := xproto.GetWindowAttributes(wm.xc, win).Reply()
+	if err != nil {
+		return nil, err
+	}
+	geom, err := xproto.GetGeometry(wm.xc, xproto.Drawable(win)).Reply()
+	if err != nil {
+		return nil, err
+	}
+	cw := &compWindow{
+		window:  win,
+		x:       geom.X,
+		y:       geom.Y,
+		w:       geom.Width + 2*geom.BorderWidth,
+		h:       geom.Height + 2*geom.BorderWidth,
+		mapped:  attrs.MapState == xproto.MapStateViewable,
+		format:  wm.pictFormats[attrs.Visual],
+		depth:   geom.Depth,
+		visual:  attrs.Visual,
+		opacity: 1,
+		stale:   true,
+	}
+	cw.inputOnly = attrs.Class == xproto.WindowClassInputOnly || cw.format == 0 ||
+		win == wm.compositor.overlay
+	if !cw.inputOnly {
+		if cw.damage, err = damage.NewDamageId(wm.xc); err != nil {
+			return nil, err
+		}
+		if err = damage.CreateChecked(
+			wm.xc, cw.damage, xproto.Drawable(win), damage.ReportLevelNonEmpty,
+		).Check(); err != nil {
+			cw.damage = 0
+			return nil, err
+		}
+		cw.opacity = wm.readOpacity(win)
+	}
+	wm.compositor.windows[win] = cw
+	return cw, nil
+}
+
+// freeCompWindow stops following the window. The caller must hold
+// wm.mu.
+func (wm *WM) freeCompWindow(cw *compWindow) {
+	if cw.damage != 0 {
+		damage.Destroy(wm.xc, cw.damage)
+	}
+	wm.releaseCompPixmap(cw)
+}
+
+func (wm *WM) releaseCompPixmap(cw *compWindow) {
+	if cw.picture != 0 {
+		render.FreePicture(wm.xc, cw.picture)
+		cw.picture = 0
+	}
+	if cw.pixmap != 0 {
+		xproto.FreePixmap(wm.xc, cw.pixmap)
+		cw.pixmap = 0
+	}
+}
+
+// nameCompPixmap gets the pixmap with the window's contents, after it
+// was mapped or resized. The caller must hold wm.mu.
+func (wm *WM) nameCompPixmap(cw *compWindow) error {
+	if !cw.stale && cw.picture != 0 {
+		return nil
+	}
+	wm.releaseCompPixmap(cw)
+	pixmap, err := xproto.NewPixmapId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = composite.NameWindowPixmapChecked(wm.xc, cw.window, pixmap).Check(); err != nil {
+		return err
+	}
+	cw.pixmap = pixmap
+	picture, err := render.NewPictureId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = render.CreatePictureChecked(
+		wm.xc, picture, xproto.Drawable(pixmap), cw.format, 0, nil,
+	).Check(); err != nil {
+		return err
+	}
+	cw.picture = picture
+	cw.pw, cw.ph = cw.w, cw.h
+	cw.stale = false
+	return nil
+}
+
+// paintCompositor paints the background and the mapped windows, bottom
+// to top, and shows the result. The caller must hold wm.mu.
+func (wm *WM) paintCompositor() error {
+	cm := wm.compositor
+	if err := wm.syncCompWindows(); err != nil {
+		return err
+	}
+	w, h := wm.xroot.WidthInPixels, wm.xroot.HeightInPixels
+	if cm.back == 0 || cm.backW != w || cm.backH != h {
+		if err := wm.allocBackBuffer(w, h); err != nil {
+			return err
+		}
+	}
+	if wm.rootPixmap != 0 {
+		bg, err := render.NewPictureId(wm.xc)
+		if err != nil {
+			return err
+		}
+		render.CreatePicture(wm.xc, bg, xproto.Drawable(wm.rootPixmap),
+			wm.pictFormats[wm.xroot.RootVisual], 0, nil)
+		render.Composite(wm.xc, render.PictOpSrc, bg, 0, cm.backPicture,
+			0, 0, 0, 0, 0, 0, w, h)
+		render.FreePicture(wm.xc, bg)
+	} else {
+		render.FillRectangles(wm.xc, render.PictOpSrc, cm.backPicture,
+			render.Color{Alpha: 0xffff},
+			[]xproto.Rectangle{{Width: w, Height: h}})
+	}
+	for _, cw := range cm.order {
+		if !cw.mapped || cw.inputOnly || cw.w == 0 || cw.h == 0 {
+			continue
+		}
+		if err := wm.nameCompPixmap(cw); err != nil {
+			log.Printf("compositor: window %d: %v", cw.window, err)
+			continue
+		}
+		opacity := cw.opacity
+		if c := wm.GetClient(cw.window); c != nil {
+			opacity = c.opacity
+		}
+		if opacity <= 0 {
+			continue
+		}
+		mask := render.Picture(0)
+		if opacity < 1 {
+			var err error
+			if mask, err = render.NewPictureId(wm.xc); err != nil {
+				return err
+			}
+			render.CreateSolidFill(wm.xc, mask, render.Color{Alpha: uint16(opacity * 0xffff)})
+		}
+		render.Composite(wm.xc, render.PictOpOver, cw.picture, mask, cm.backPicture,
+			0, 0, 0, 0, cw.x, cw.y, cw.w, cw.h)
+		if mask != 0 {
+			render.FreePicture(wm.xc, mask)
+		}
+	}
+	render.Composite(wm.xc, render.PictOpSrc, cm.backPicture, 0, cm.overlayPicture,
+		0, 0, 0, 0, 0, 0, w, h)
+	return nil
+}
+
+// allocBackBuffer (re)creates the back buffer for the size of the root
+// window. The caller must hold wm.mu.
+func (wm *WM) allocBackBuffer(w, h uint16) error {
+	cm := wm.compositor
+	if cm.backPicture != 0 {
+		render.FreePicture(wm.xc, cm.backPicture)
+		cm.backPicture = 0
+	}
+	if cm.back != 0 {
+		xproto.FreePixmap(wm.xc, cm.back)
+		cm.back = 0
+	}
+	pixmap, err := xproto.NewPixmapId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = xproto.CreatePixmapChecked(
+		wm.xc, wm.xroot.RootDepth, pixmap, xproto.Drawable(wm.xroot.Root), w, h,
+	).Check(); err != nil {
+		return err
+	}
+	cm.back = pixmap
+	picture, err := render.NewPictureId(wm.xc)
+	if err != nil {
+		return err
+	}
+	if err = render.CreatePictureChecked(
+		wm.xc, picture, xproto.Drawable(pixmap),
+		wm.pictFormats[wm.xroot.RootVisual], 0, nil,
+	).Check(); err != nil {
+		return err
+	}
+	cm.backPicture = picture
+	cm.backW, cm.backH = w, h
+	return nil
+}
+
+// applyCompositorConfig starts or stops the compositor. The caller must
+// hold wm.mu.
+func (wm *WM) applyCompositorConfig(cc *CompositorConfig) error {
+	if !cc.Enabled {
+		wm.StopCompositor()
+		return nil
+	}
+	return wm.StartCompositor()
+}
+
+func (as *APIServer) compositorRoutes(router *mux.Router) {
+	router.HandleFunc("/compositor", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			cc := &CompositorConfig{}
+			if err := json.NewDecoder(r.Body).Decode(cc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.applyCompositorConfig(cc); err != nil {
+				errorResponse(w, r, http.StatusConflict, err)
+				return
+			}
+		}
+		data := map[string]interface{}{
+			"enabled":   as.wm.compositor != nil,
+			"available": as.wm.hasCompositing,
+		}
+		if cm := as.wm.compositor; cm != nil {
+			data["windows"] = len(cm.windows)
+		}
+		jsonResponse(w, r, 200, data)
+	})).Methods("GET", "PUT")
+}
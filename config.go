@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Placement policies for newly managed windows.
+const (
+	PlacementFullscreen = "fullscreen"
+	PlacementRequested  = "requested"
+	PlacementCentered   = "centered"
+)
+
+// Focus policies.
+const (
+	FocusFollowMouse = "follow-mouse"
+	FocusClick       = "click"
+	FocusAPIOnly     = "api-only"
+	// FocusStrict only lets the designated client hold the focus.
+	FocusStrict = "strict"
+)
+
+// redacted replaces secrets in the output of GET /config.
+const redacted = "********"
+
+// Config is the WM configuration, as loaded from the file passed with
+// -c. Zero values are replaced with defaults by Config.setDefaults.
+type Config struct {
+	// Listen is the list of addresses the HTTP API listens on.
+	Listen []string `yaml:"listen" json:"listen"`
+	// Tokens is the list of accepted API bearer tokens. If empty,
+	// the API does not require authentication.
+	Tokens []string `yaml:"tokens" json:"tokens"`
+	// Placement is the position/size policy for new windows.
+	Placement string `yaml:"placement" json:"placement"`
+	// DefaultScreen is the Xinerama screen index new windows are
+	// placed on.
+	DefaultScreen int `yaml:"default_screen" json:"default_screen"`
+	// FocusPolicy decides what moves the keyboard focus.
+	FocusPolicy string `yaml:"focus_policy" json:"focus_policy"`
+	// Focus sets per-screen focus policies, and the designated
+	// client for the strict policy. Policies set through
+	// /focus/policy are reset to these on config reload.
+	Focus FocusConfig `yaml:"focus" json:"focus"`
+	// Events configures the /events/ websocket.
+	Events EventsConfig `yaml:"events" json:"events"`
+	// StateFile is where client layouts and the device mappings
+	// set through the API are persisted across restarts. Defaults
+	// to $XDG_STATE_HOME/headless-wm/layout.json.
+	StateFile string `yaml:"state_file" json:"state_file"`
+	// Apps are launched (and optionally kept running) by the WM.
+	Apps []AppConfig `yaml:"apps" json:"apps"`
+	// Layouts are named arrangements of clients on a screen.
+	Layouts map[string][]LayoutItem `yaml:"layouts" json:"layouts"`
+	// Playlists are named lists of clients to rotate on a screen.
+	Playlists map[string][]PlaylistItem `yaml:"playlists" json:"playlists"`
+	// Timezone is the default time zone for schedules.
+	Timezone string `yaml:"timezone" json:"timezone"`
+	// Schedules run actions at given times.
+	Schedules []Schedule `yaml:"schedules" json:"schedules"`
+	// Power controls display blanking and DPMS.
+	Power PowerConfig `yaml:"power" json:"power"`
+	// Idle runs actions when there was no user input for a while.
+	Idle []IdleThreshold `yaml:"idle" json:"idle"`
+	// Input configures the keyboard and pointer.
+	Input InputConfig `yaml:"input" json:"input"`
+	// Hotkeys run actions when keys are pressed.
+	Hotkeys []Hotkey `yaml:"hotkeys" json:"hotkeys"`
+	// Gestures run actions on touch gestures.
+	Gestures []Gesture `yaml:"gestures" json:"gestures"`
+	// Compositor configures the built-in compositing manager.
+	Compositor CompositorConfig `yaml:"compositor" json:"compositor"`
+	// Fade sets how long clients fade in and out.
+	Fade FadeConfig `yaml:"fade" json:"fade"`
+	// Streams configures the MJPEG live views of screens and
+	// clients.
+	Streams StreamConfig `yaml:"streams" json:"streams"`
+	// Remote configures remote access, like the VNC server.
+	Remote RemoteConfig `yaml:"remote" json:"remote"`
+	// Maintenance configures the staff maintenance mode.
+	Maintenance MaintenanceConfig `yaml:"maintenance" json:"maintenance"`
+	// Background is shown on screens where no client covers the
+	// root window.
+	Background BackgroundConfig `yaml:"background" json:"background"`
+}
+
+// InputConfig configures the keyboard and pointer.
+type InputConfig struct {
+	// BlockedKeys are key chords, like "Alt+F4", that are grabbed
+	// so that they never reach the clients. The list is reset to
+	// this on config reload.
+	BlockedKeys []string `yaml:"blocked_keys" json:"blocked_keys"`
+	// Cursor controls the mouse pointer. It is reset to this on
+	// config reload.
+	Cursor CursorConfig `yaml:"cursor" json:"cursor"`
+	// ConfinePointer keeps the pointer on a screen. It is reset to
+	// this on config reload.
+	ConfinePointer *PointerConfinement `yaml:"confine_pointer" json:"confine_pointer"`
+	// Devices map touchscreens and other absolute devices onto
+	// screens or RandR outputs. The first mapping that matches a
+	// device is used. They are reset to this on config reload.
+	Devices []*DeviceMapping `yaml:"devices" json:"devices"`
+}
+
+// EventsConfig holds the event buffer sizes.
+type EventsConfig struct {
+	// ClientQueue is the number of events buffered for each
+	// websocket subscriber before events are dropped.
+	ClientQueue int `yaml:"client_queue" json:"client_queue"`
+	// History is the number of events remembered for subscribers
+	// resuming with ?since=<seq>.
+	History int `yaml:"history" json:"history"`
+}
+
+// AppConfig describes a program to launch on startup.
+type AppConfig struct {
+	Name    string   `yaml:"name" json:"name"`
+	Command []string `yaml:"command" json:"command"`
+	Env     []string `yaml:"env" json:"env"`
+	Dir     string   `yaml:"dir" json:"dir"`
+	// Restart the app whenever it exits.
+	Restart bool `yaml:"restart" json:"restart"`
+	// Manual apps are not started with the WM, only by actions.
+	Manual bool `yaml:"manual" json:"manual"`
+}
+
+// Duration is a time.Duration written as a string, like "1m30s", in
+// the config file and the API.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// DefaultConfig returns the configuration used when no config file
+// was given.
+func DefaultConfig() *Config {
+	cfg := &Config{}
+	cfg.setDefaults()
+	return cfg
+}
+
+// LoadConfig reads, parses and validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err = yaml.UnmarshalStrict(bs, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cfg.setDefaults()
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) setDefaults() {
+	if len(cfg.Listen) == 0 {
+		cfg.Listen = []string{listenAddr}
+	}
+	if cfg.Placement == "" {
+		cfg.Placement = PlacementFullscreen
+	}
+	if cfg.FocusPolicy == "" {
+		cfg.FocusPolicy = FocusFollowMouse
+	}
+	if cfg.Events.ClientQueue == 0 {
+		cfg.Events.ClientQueue = 10
+	}
+	if cfg.Events.History == 0 {
+		cfg.Events.History = 256
+	}
+	if cfg.Timezone == "" {
+		cfg.Timezone = "Local"
+	}
+	cfg.Maintenance.setDefaults()
+	cfg.Streams.setDefaults()
+	cfg.Remote.VNC.setDefaults()
+	for i := range cfg.Gestures {
+		cfg.Gestures[i].setDefaults()
+	}
+}
+
+// app returns the named app's config, or nil.
+func (cfg *Config) app(name string) *AppConfig {
+	for i := range cfg.Apps {
+		if cfg.Apps[i].Name == name {
+			return &cfg.Apps[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks the config for errors. It does not check anything
+// that depends on the state of the X server.
+func (cfg *Config) Validate() error {
+	for _, addr := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+	}
+	for _, token := range cfg.Tokens {
+		if token == "" {
+			return errors.New("tokens: empty token")
+		}
+	}
+	switch cfg.Placement {
+	case PlacementFullscreen, PlacementRequested, PlacementCentered:
+	default:
+		return fmt.Errorf("placement: unknown policy %q", cfg.Placement)
+	}
+	if cfg.DefaultScreen < 0 {
+		return fmt.Errorf("default_screen: bad screen %d", cfg.DefaultScreen)
+	}
+	if err := cfg.focusPolicies().Validate(); err != nil {
+		return fmt.Errorf("focus: %v", err)
+	}
+	if cfg.Events.ClientQueue < 1 {
+		return fmt.Errorf("events.client_queue: must be positive")
+	}
+	if cfg.Events.History < 1 {
+		return fmt.Errorf("events.history: must be positive")
+	}
+	names := map[string]bool{}
+	for i, app := range cfg.Apps {
+		if app.Name == "" {
+			return fmt.Errorf("apps[%d]: missing name", i)
+		}
+		if names[app.Name] {
+			return fmt.Errorf("apps[%d]: duplicate name %q", i, app.Name)
+		}
+		names[app.Name] = true
+		if len(app.Command) == 0 {
+			return fmt.Errorf("apps[%d]: missing command", i)
+		}
+	}
+	for name, items := range cfg.Layouts {
+		if err := validateLayout(items); err != nil {
+			return fmt.Errorf("layouts.%s%v", name, err)
+		}
+	}
+	for name, items := range cfg.Playlists {
+		if err := validatePlaylistItems(items); err != nil {
+			return fmt.Errorf("playlists.%s: %v", name, err)
+		}
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("timezone: %v", err)
+	}
+	if t := cfg.Power.Timeouts; t != nil {
+		for _, d := range []Duration{t.Saver, t.Standby, t.Suspend, t.Off} {
+			if _, err := durationSeconds(d); err != nil {
+				return fmt.Errorf("power.timeouts: %v", err)
+			}
+		}
+	}
+	names = map[string]bool{}
+	for i := range cfg.Schedules {
+		s := &cfg.Schedules[i]
+		if err := s.Validate(cfg); err != nil {
+			return fmt.Errorf("schedules[%d]: %v", i, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("schedules[%d]: duplicate name %q", i, s.Name)
+		}
+		names[s.Name] = true
+	}
+	if err := validateKeyChords(cfg.Input.BlockedKeys); err != nil {
+		return fmt.Errorf("input.blocked_keys%v", err)
+	}
+	if err := cfg.Input.Cursor.Validate(); err != nil {
+		return fmt.Errorf("input.cursor.%v", err)
+	}
+	if pc := cfg.Input.ConfinePointer; pc != nil {
+		if err := pc.Validate(); err != nil {
+			return fmt.Errorf("input.confine_pointer: %v", err)
+		}
+	}
+	for i, dm := range cfg.Input.Devices {
+		if err := dm.Validate(); err != nil {
+			return fmt.Errorf("input.devices[%d]: %v", i, err)
+		}
+	}
+	if err := cfg.Fade.Validate(); err != nil {
+		return fmt.Errorf("fade.%v", err)
+	}
+	if err := cfg.Streams.Validate(); err != nil {
+		return fmt.Errorf("streams.%v", err)
+	}
+	if err := cfg.Remote.VNC.Validate(); err != nil {
+		return fmt.Errorf("remote.vnc.%v", err)
+	}
+	if err := cfg.Maintenance.Validate(); err != nil {
+		return fmt.Errorf("maintenance.%v", err)
+	}
+	if err := cfg.Background.Validate(); err != nil {
+		return fmt.Errorf("background: %v", err)
+	}
+	var maintenance *Hotkey
+	if cfg.Maintenance.Keys != "" {
+		// Checked by cfg.Maintenance.Validate.
+		chords, _ := parseKeySequence(cfg.Maintenance.Keys)
+		maintenance = &Hotkey{chords: chords}
+	}
+	names = map[string]bool{}
+	for i := range cfg.Hotkeys {
+		h := &cfg.Hotkeys[i]
+		if err := h.Validate(cfg); err != nil {
+			return fmt.Errorf("hotkeys[%d]: %v", i, err)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("hotkeys[%d]: duplicate name %q", i, h.Name)
+		}
+		for j := range cfg.Hotkeys[:i] {
+			if h.overlaps(&cfg.Hotkeys[j]) {
+				return fmt.Errorf("hotkeys[%d]: overlaps hotkey %q", i, cfg.Hotkeys[j].Name)
+			}
+		}
+		if maintenance != nil && h.overlaps(maintenance) {
+			return fmt.Errorf("hotkeys[%d]: overlaps the maintenance sequence", i)
+		}
+		names[h.Name] = true
+	}
+	names = map[string]bool{}
+	for i := range cfg.Gestures {
+		g := &cfg.Gestures[i]
+		if err := g.Validate(cfg); err != nil {
+			return fmt.Errorf("gestures[%d]: %v", i, err)
+		}
+		if names[g.Name] {
+			return fmt.Errorf("gestures[%d]: duplicate name %q", i, g.Name)
+		}
+		names[g.Name] = true
+	}
+	names = map[string]bool{}
+	for i := range cfg.Idle {
+		t := &cfg.Idle[i]
+		if err := t.Validate(cfg); err != nil {
+			return fmt.Errorf("idle[%d]: %v", i, err)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("idle[%d]: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to show over
+// the API.
+func (cfg *Config) Redacted() *Config {
+	r := *cfg
+	r.Tokens = make([]string, len(cfg.Tokens))
+	for i := range r.Tokens {
+		r.Tokens[i] = redacted
+	}
+	if r.Maintenance.Keys != "" {
+		r.Maintenance.Keys = redacted
+	}
+	if r.Remote.VNC.Password != "" {
+		r.Remote.VNC.Password = redacted
+	}
+	if r.Remote.VNC.ViewPassword != "" {
+		r.Remote.VNC.ViewPassword = redacted
+	}
+	return &r
+}
+
+// ReloadConfig re-reads the config file and applies it. If the new
+// config is invalid, or fails to apply, the running config is kept
+// and an error is returned. The caller must hold wm.mu.
+func (wm *WM) ReloadConfig() error {
+	if wm.configPath == "" {
+		return errors.New("No config file to reload")
+	}
+	cfg, err := LoadConfig(wm.configPath)
+	if err != nil {
+		return err
+	}
+	if err = wm.applyConfig(cfg); err != nil {
+		return err
+	}
+	log.Printf("reloaded config from %s", wm.configPath)
+	return nil
+}
+
+// configErrors are the sections of a config that failed to apply.
+type configErrors []string
+
+func (errs configErrors) Error() string {
+	return strings.Join(errs, "; ")
+}
+
+// applyConfig makes cfg the running config. If a section fails to
+// apply, the running config is applied again, and the errors are
+// returned as configErrors. The caller must hold wm.mu.
+func (wm *WM) applyConfig(cfg *Config) error {
+	if len(wm.attachedScreens) > 0 && cfg.DefaultScreen >= len(wm.attachedScreens) {
+		return fmt.Errorf("default_screen: no screen %d", cfg.DefaultScreen)
+	}
+	if wm.api != nil {
+		if err := wm.api.setListenAddrs(cfg.Listen); err != nil {
+			return err
+		}
+	}
+	old := wm.config
+	errs := wm.applyConfigSections(cfg)
+	if len(errs) == 0 {
+		return nil
+	}
+	if old != cfg {
+		if wm.api != nil {
+			if err := wm.api.setListenAddrs(old.Listen); err != nil {
+				log.Printf("restoring listeners: %v", err)
+			}
+		}
+		if rerrs := wm.applyConfigSections(old); len(rerrs) > 0 {
+			log.Printf("restoring the running config: %v", rerrs)
+		}
+	}
+	return errs
+}
+
+// applyConfigSections makes cfg the running config, and applies its
+// sections. The caller must hold wm.mu.
+func (wm *WM) applyConfigSections(cfg *Config) configErrors {
+	var errs configErrors
+	failed := func(section string, err error) {
+		errs = append(errs, fmt.Sprintf("%s: %v", section, err))
+	}
+	wm.config = cfg
+	wm.events.SetHistorySize(cfg.Events.History)
+	wm.updateApps()
+	wm.updateSchedules()
+	if err := wm.applyPowerConfig(); err != nil {
+		failed("power", err)
+	}
+	if err := wm.SetBlockedKeys(cfg.Input.BlockedKeys); err != nil {
+		failed("input.blocked_keys", err)
+	}
+	cursor := cfg.Input.Cursor
+	cursor.HiddenScreens = append([]int(nil), cursor.HiddenScreens...)
+	if err := wm.SetCursor(&cursor); err != nil {
+		failed("input.cursor", err)
+	}
+	if err := wm.ConfinePointer(cfg.Input.ConfinePointer); err != nil {
+		failed("input.confine_pointer", err)
+	}
+	if err := wm.SetDeviceMappings(append([]*DeviceMapping(nil), cfg.Input.Devices...)); err != nil {
+		failed("input.devices", err)
+	}
+	wm.focusPolicies = cfg.focusPolicies()
+	wm.updateMaintenanceHotkey()
+	wm.updateHotkeys()
+	wm.endGesturePress()
+	wm.gestureTaps = map[string][]time.Time{}
+	wm.updateButtonGrabs()
+	wm.loadBackgroundImages(&cfg.Background)
+	wm.paintedBackgrounds = nil
+	if err := wm.updateBackgrounds(); err != nil {
+		failed("background", err)
+	}
+	if err := wm.applyCompositorConfig(&cfg.Compositor); err != nil {
+		failed("compositor", err)
+	}
+	if err := wm.applyVNCConfig(&cfg.Remote.VNC); err != nil {
+		failed("remote.vnc", err)
+	}
+	return errs
+}
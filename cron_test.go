@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		ok      bool
+		minute  uint64
+		hour    uint64
+		dow     uint64
+		domStar bool
+		dowStar bool
+	}{
+		{expr: "* * * * *", ok: true, minute: 1<<60 - 1, hour: allCronHours, dow: 1<<8 - 1, domStar: true, dowStar: true},
+		{expr: "*/15 8-10 * * 1-5", ok: true, minute: 1 | 1<<15 | 1<<30 | 1<<45, hour: 1<<8 | 1<<9 | 1<<10, dow: 0x3e, domStar: true},
+		{expr: "5,10 0 1 * 7", ok: true, minute: 1<<5 | 1<<10, hour: 1, dow: 1 | 1<<7, dowStar: false},
+		{expr: "0 12/6 * * *", ok: true, minute: 1, hour: 1<<12 | 1<<18, dow: 1<<8 - 1, domStar: true, dowStar: true},
+		{expr: "@hourly", ok: true, minute: 1, hour: allCronHours, dow: 1<<8 - 1, domStar: true, dowStar: true},
+		{expr: "* * * *"},
+		{expr: "60 * * * *"},
+		{expr: "* 24 * * *"},
+		{expr: "* * 0 * *"},
+		{expr: "* * * 13 *"},
+		{expr: "* * * * 8"},
+		{expr: "5-1 * * * *"},
+		{expr: "*/0 * * * *"},
+		{expr: "a * * * *"},
+		{expr: "@never"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parseCron(%q) succeeded, want an error", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if spec.minute != tt.minute || spec.hour != tt.hour || spec.dow != tt.dow ||
+			spec.domStar != tt.domStar || spec.dowStar != tt.dowStar {
+			t.Errorf("parseCron(%q) = %+v", tt.expr, spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, warsaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"*/15 * * * *", "2021-06-01 10:00", "2021-06-01 10:15"},
+		{"*/15 * * * *", "2021-06-01 10:07", "2021-06-01 10:15"},
+		{"0 8 * * 1-5", "2021-06-04 09:00", "2021-06-07 08:00"},
+		{"@monthly", "2021-12-15 00:00", "2022-01-01 00:00"},
+		// Either day field matches when both are restricted.
+		{"0 0 13 * 5", "2021-06-01 00:00", "2021-06-04 00:00"},
+		{"0 0 29 2 *", "2021-01-01 00:00", "2024-02-29 00:00"},
+		// A day field starting with "*" doesn't count as
+		// restricted, so both must match: an odd day and a
+		// Monday.
+		{"0 0 */2 * 1", "2021-06-01 00:00", "2021-06-07 00:00"},
+		// 02:30 doesn't exist when DST starts; it isn't made up for.
+		{"30 2 * * *", "2021-03-28 00:00", "2021-03-29 02:30"},
+		{"0 * * * *", "2021-03-28 01:30", "2021-03-28 03:00"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := spec.Next(at(tt.from)), at(tt.want); !got.Equal(want) {
+			t.Errorf("%q after %s = %v, want %v", tt.expr, tt.from, got, want)
+		}
+	}
+
+	spec, _ := parseCron("0 0 30 2 *")
+	if got := spec.Next(at("2021-01-01 00:00")); !got.IsZero() {
+		t.Errorf("impossible spec: got %v, want the zero time", got)
+	}
+}
+
+func TestCronNextDSTEnd(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// On 2021-10-31 the clocks went from 03:00 CEST back to 02:00
+	// CET, so 02:30 came up twice.
+	first := time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC).In(warsaw)
+	second := first.Add(time.Hour)
+	if first.Hour() != 2 || second.Hour() != 2 {
+		t.Fatalf("bad test times %v and %v", first, second)
+	}
+
+	daily, _ := parseCron("30 2 * * *")
+	if got := daily.Next(first.Add(-time.Minute)); !got.Equal(first) {
+		t.Errorf("daily: got %v, want %v", got, first)
+	}
+	want := time.Date(2021, 11, 1, 2, 30, 0, 0, warsaw)
+	if got := daily.Next(first); !got.Equal(want) {
+		t.Errorf("daily after the first 02:30: got %v, want %v", got, want)
+	}
+
+	hourly, _ := parseCron("30 * * * *")
+	if got := hourly.Next(first); !got.Equal(second) {
+		t.Errorf("hourly after the first 02:30: got %v, want %v", got, second)
+	}
+}
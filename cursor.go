@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// cursorPollInterval is how often the pointer position is checked, for
+// auto-hiding and per-screen hiding.
+const cursorPollInterval = 200 * time.Millisecond
+
+// cursorGlyphs are the names in the X cursor font, in order. Each
+// cursor takes two glyphs, the shape and its mask.
+var cursorGlyphs = []string{
+	"X_cursor", "arrow", "based_arrow_down", "based_arrow_up", "boat",
+	"bogosity", "bottom_left_corner", "bottom_right_corner",
+	"bottom_side", "bottom_tee", "box_spiral", "center_ptr", "circle",
+	"clock", "coffee_mug", "cross", "cross_reverse", "crosshair",
+	"diamond_cross", "dot", "dotbox", "double_arrow", "draft_large",
+	"draft_small", "draped_box", "exchange", "fleur", "gobbler", "gumby",
+	"hand1", "hand2", "heart", "icon", "iron_cross", "left_ptr",
+	"left_side", "left_tee", "leftbutton", "ll_angle", "lr_angle", "man",
+	"middlebutton", "mouse", "pencil", "pirate", "plus",
+	"question_arrow", "right_ptr", "right_side", "right_tee",
+	"rightbutton", "rtl_logo", "sailboat", "sb_down_arrow",
+	"sb_h_double_arrow", "sb_left_arrow", "sb_right_arrow",
+	"sb_up_arrow", "sb_v_double_arrow", "shuttle", "sizing", "spider",
+	"spraycan", "star", "target", "tcross", "top_left_arrow",
+	"top_left_corner", "top_right_corner", "top_side", "top_tee", "trek",
+	"ul_angle", "umbrella", "ur_angle", "watch", "xterm",
+}
+
+// cursorGlyph returns the index of the named cursor in the cursor
+// font.
+func cursorGlyph(name string) (uint16, bool) {
+	for i, glyph := range cursorGlyphs {
+		if glyph == name {
+			return uint16(2 * i), true
+		}
+	}
+	return 0, false
+}
+
+// CursorConfig controls the mouse pointer. It starts out from the
+// config, and can be changed through the API.
+type CursorConfig struct {
+	// Hidden hides the cursor on all screens. Without XFixes, it
+	// is only hidden over the root window and clients that don't
+	// set a cursor of their own; see setCursorHidden.
+	Hidden bool `yaml:"hidden" json:"hidden"`
+	// HiddenScreens hides the cursor while it is on these screens.
+	HiddenScreens []int `yaml:"hidden_screens" json:"hidden_screens"`
+	// AutoHide hides the cursor after the pointer did not move for
+	// this long. Zero disables it.
+	AutoHide Duration `yaml:"auto_hide" json:"auto_hide"`
+	// Name is a cursor from the cursor font, like "left_ptr",
+	// shown on the root window and clients that don't set their
+	// own. Empty means the server default.
+	Name string `yaml:"name" json:"name"`
+	// Theme and Size are the Xcursor theme for clients, set in the
+	// RESOURCE_MANAGER property. Clients only read it on startup.
+	Theme string `yaml:"theme" json:"theme"`
+	Size  int    `yaml:"size" json:"size"`
+}
+
+// Validate checks the cursor config for errors.
+func (cc *CursorConfig) Validate() error {
+	for _, screen := range cc.HiddenScreens {
+		if screen < 0 {
+			return fmt.Errorf("hidden_screens: bad screen %d", screen)
+		}
+	}
+	if cc.AutoHide < 0 {
+		return errors.New("auto_hide: must not be negative")
+	}
+	if _, ok := cursorGlyph(cc.Name); cc.Name != "" && !ok {
+		return fmt.Errorf("name: unknown cursor %q", cc.Name)
+	}
+	if cc.Size < 0 {
+		return errors.New("size: must not be negative")
+	}
+	if strings.ContainsAny(cc.Theme, "\n") {
+		return errors.New("theme: bad name")
+	}
+	return nil
+}
+
+// CursorStatus is the cursor config in effect, and what it does now.
+type CursorStatus struct {
+	*CursorConfig
+	Visible bool `json:"visible"`
+	// Screen is the screen the pointer is on.
+	Screen     int       `json:"screen"`
+	LastMotion time.Time `json:"last_motion"`
+}
+
+// SetCursor applies the cursor config. The caller must hold wm.mu.
+func (wm *WM) SetCursor(cc *CursorConfig) error {
+	if err := cc.Validate(); err != nil {
+		return err
+	}
+	old := wm.cursorConfig
+	wm.cursorConfig = cc
+	if wm.lastMotion.IsZero() {
+		wm.lastMotion = time.Now()
+	}
+	if old.Name != cc.Name {
+		if err := wm.defineRootCursor(cc.Name); err != nil {
+			return err
+		}
+	}
+	if old.Theme != cc.Theme || old.Size != cc.Size {
+		if err := wm.setCursorResources(cc.Theme, cc.Size); err != nil {
+			log.Printf("cursor theme: %v", err)
+		}
+	}
+	wm.updateCursor(time.Now())
+	return nil
+}
+
+// defineRootCursor sets the named cursor from the cursor font on the
+// root window. Clients inherit it unless they set their own.
+func (wm *WM) defineRootCursor(name string) error {
+	cursor := xproto.Cursor(xproto.CursorNone)
+	if name != "" {
+		glyph, _ := cursorGlyph(name)
+		font, err := xproto.NewFontId(wm.xc)
+		if err != nil {
+			return err
+		}
+		if err = xproto.OpenFontChecked(wm.xc, font, 6, "cursor").Check(); err != nil {
+			return err
+		}
+		defer xproto.CloseFont(wm.xc, font)
+		if cursor, err = xproto.NewCursorId(wm.xc); err != nil {
+			return err
+		}
+		if err = xproto.CreateGlyphCursorChecked(
+			wm.xc,
+			cursor,
+			font, font,
+			glyph, glyph+1,
+			0, 0, 0, // foreground: black
+			0xffff, 0xffff, 0xffff, // background: white
+		).Check(); err != nil {
+			return err
+		}
+	}
+	if old := wm.rootCursor; old != xproto.CursorNone {
+		defer xproto.FreeCursor(wm.xc, old)
+	}
+	wm.rootCursor = cursor
+	if wm.cursorHidden && !wm.hasXFixes {
+		// The blank cursor stays until the cursor is shown.
+		return nil
+	}
+	return wm.setRootCursor(cursor)
+}
+
+func (wm *WM) setRootCursor(cursor xproto.Cursor) error {
+	return xproto.ChangeWindowAttributesChecked(
+		wm.xc,
+		wm.xroot.Root,
+		xproto.CwCursor,
+		[]uint32{uint32(cursor)},
+	).Check()
+}
+
+// setCursorResources sets the Xcursor theme and size in the
+// RESOURCE_MANAGER property, keeping the other resources.
+func (wm *WM) setCursorResources(theme string, size int) error {
+	prop, err := xproto.GetProperty(
+		wm.xc,
+		false, // delete
+		wm.xroot.Root,
+		xproto.AtomResourceManager,
+		xproto.AtomString,
+		0,       // offset
+		1<<20/4, // length
+	).Reply()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	found := false
+	for _, line := range strings.Split(string(prop.Value), "\n") {
+		if strings.HasPrefix(line, "Xcursor.theme:") ||
+			strings.HasPrefix(line, "Xcursor.size:") {
+			found = true
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if !found && theme == "" && size == 0 {
+		return nil
+	}
+	if theme != "" {
+		lines = append(lines, "Xcursor.theme:\t"+theme)
+	}
+	if size != 0 {
+		lines = append(lines, fmt.Sprintf("Xcursor.size:\t%d", size))
+	}
+	value := strings.Join(lines, "\n") + "\n"
+	return xproto.ChangePropertyChecked(
+		wm.xc,
+		xproto.PropModeReplace,
+		wm.xroot.Root,
+		xproto.AtomResourceManager,
+		xproto.AtomString,
+		8, // format
+		uint32(len(value)),
+		[]byte(value),
+	).Check()
+}
+
+// cursorShouldHide decides if the cursor is hidden now. The caller
+// must hold wm.mu.
+func (wm *WM) cursorShouldHide(now time.Time) bool {
+	cc := wm.cursorConfig
+	if cc.Hidden {
+		return true
+	}
+	for _, screen := range cc.HiddenScreens {
+		if screen == wm.pointerScreen {
+			return true
+		}
+	}
+	return cc.AutoHide > 0 && now.Sub(wm.lastMotion) >= time.Duration(cc.AutoHide)
+}
+
+// updateCursor hides or shows the cursor. The caller must hold wm.mu.
+func (wm *WM) updateCursor(now time.Time) {
+	hide := wm.cursorShouldHide(now)
+	if hide == wm.cursorHidden {
+		return
+	}
+	if err := wm.setCursorHidden(hide); err != nil {
+		log.Printf("cursor: %v", err)
+		return
+	}
+	wm.cursorHidden = hide
+	if hide {
+		wm.emit("cursor.hidden", map[string]interface{}{"screen": wm.pointerScreen})
+	} else {
+		wm.emit("cursor.shown", map[string]interface{}{"screen": wm.pointerScreen})
+	}
+}
+
+// setCursorHidden hides the cursor with XFixes or, without it, with a
+// blank cursor on the root window. The blank cursor is only seen by
+// clients that don't set their own. It isn't set on the clients'
+// windows, because their own cursors could not be put back: the core
+// protocol has no way to read a window's cursor, and toolkits set
+// theirs on inner windows anyway.
+func (wm *WM) setCursorHidden(hide bool) error {
+	root := wm.xroot.Root
+	if wm.hasXFixes {
+		if hide {
+			return xfixes.HideCursorChecked(wm.xc, root).Check()
+		}
+		return xfixes.ShowCursorChecked(wm.xc, root).Check()
+	}
+	if !hide {
+		return wm.setRootCursor(wm.rootCursor)
+	}
+	if wm.blankCursor == 0 {
+		pixmap, err := xproto.NewPixmapId(wm.xc)
+		if err != nil {
+			return err
+		}
+		if err = xproto.CreatePixmapChecked(
+			wm.xc, 1, pixmap, xproto.Drawable(root), 1, 1,
+		).Check(); err != nil {
+			return err
+		}
+		defer xproto.FreePixmap(wm.xc, pixmap)
+		cursor, err := xproto.NewCursorId(wm.xc)
+		if err != nil {
+			return err
+		}
+		// An all-zero mask makes every pixel transparent.
+		if err = xproto.CreateCursorChecked(
+			wm.xc, cursor, pixmap, pixmap, 0, 0, 0, 0, 0, 0, 0, 0,
+		).Check(); err != nil {
+			return err
+		}
+		wm.blankCursor = cursor
+	}
+	return wm.setRootCursor(wm.blankCursor)
+}
+
+// runCursorMonitor watches the pointer position until the WM exits,
+// for auto-hiding and per-screen hiding.
+func (wm *WM) runCursorMonitor() {
+	for now := range time.NewTicker(cursorPollInterval).C {
+		wm.mu.Lock()
+		if err := wm.checkPointer(now); err != nil {
+			log.Printf("cursor: %v", err)
+		}
+		wm.mu.Unlock()
+	}
+}
+
+// checkPointer tracks pointer motion, and updates the cursor. The
+// caller must hold wm.mu.
+func (wm *WM) checkPointer(now time.Time) error {
+	cc := wm.cursorConfig
+	if cc.AutoHide == 0 && len(cc.HiddenScreens) == 0 {
+		return nil
+	}
+	pointer, err := xproto.QueryPointer(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		return err
+	}
+	if pointer.RootX != wm.pointerX || pointer.RootY != wm.pointerY {
+		wm.pointerX, wm.pointerY = pointer.RootX, pointer.RootY
+		wm.pointerScreen = wm.screenAt(pointer.RootX, pointer.RootY)
+		wm.lastMotion = now
+	}
+	wm.updateCursor(now)
+	return nil
+}
+
+func (as *APIServer) cursorRoutes(router *mux.Router) {
+	router.HandleFunc("/input/cursor", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			// Fields left out keep their values.
+			cc := *as.wm.cursorConfig
+			cc.HiddenScreens = append([]int(nil), cc.HiddenScreens...)
+			if err := json.NewDecoder(r.Body).Decode(&cc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.SetCursor(&cc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"item": CursorStatus{
+				CursorConfig: as.wm.cursorConfig,
+				Visible:      !as.wm.cursorHidden,
+				Screen:       as.wm.pointerScreen,
+				LastMotion:   as.wm.lastMotion,
+			},
+		})
+	})).Methods("GET", "PUT")
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// devicePollInterval is how often the device list is checked for
+// hotplugged devices.
+const devicePollInterval = 2 * time.Second
+
+// identityMatrix is the coordinate transformation matrix of a device
+// that covers the whole root window.
+var identityMatrix = []float32{1, 0, 0, 0, 1, 0, 0, 0, 1}
+
+// DeviceMapping maps an absolute input device, like a touchscreen,
+// onto a Xinerama screen or a RandR output, instead of the whole root
+// window. Mappings set through the API may have neither, to keep a
+// device on the whole root window despite the config.
+type DeviceMapping struct {
+	// Name is the XInput device name.
+	Name string `yaml:"name" json:"name,omitempty"`
+	// Node is the device node, like /dev/input/event5, or a
+	// symlink to it. Use /dev/input/by-path/ to tell identical
+	// panels apart by the port they are plugged into.
+	Node   string `yaml:"node" json:"node,omitempty"`
+	Screen *int   `yaml:"screen" json:"screen,omitempty"`
+	Output string `yaml:"output" json:"output,omitempty"`
+}
+
+// Validate checks the mapping for errors.
+func (dm *DeviceMapping) Validate() error {
+	if dm.Name == "" && dm.Node == "" {
+		return errors.New("needs a name or a node")
+	}
+	if (dm.Screen == nil) == (dm.Output == "") {
+		return errors.New("needs either a screen or an output")
+	}
+	if dm.Screen != nil && *dm.Screen < 0 {
+		return fmt.Errorf("bad screen %d", *dm.Screen)
+	}
+	return nil
+}
+
+// matches checks if the mapping is for the device.
+func (dm *DeviceMapping) matches(d *InputDevice) bool {
+	if dm.Name != "" && dm.Name != d.Name {
+		return false
+	}
+	if dm.Node != "" {
+		node, err := filepath.EvalSymlinks(dm.Node)
+		if err != nil || node != d.Node {
+			return false
+		}
+	}
+	return true
+}
+
+// InputDevice is an XInput device.
+type InputDevice struct {
+	ID   uint16 `json:"id"`
+	Name string `json:"name"`
+	// Use is master-pointer, master-keyboard, pointer, keyboard, or
+	// floating.
+	Use string `json:"use"`
+	// Attachment is the master device of a slave device.
+	Attachment uint16 `json:"attachment"`
+	Enabled    bool   `json:"enabled"`
+	Touch      bool   `json:"touch"`
+	Node       string `json:"node,omitempty"`
+	// Matrix is the coordinate transformation matrix of pointer
+	// devices, row by row.
+	Matrix []float32 `json:"matrix,omitempty"`
+	// Mapping is the mapping that applies to the device, and
+	// Override is set if it was set through the API.
+	Mapping  *DeviceMapping `json:"mapping,omitempty"`
+	Override bool           `json:"override,omitempty"`
+}
+
+// initDevices sets up XInput2 and RandR, for mapping devices to
+// outputs.
+func (wm *WM) initDevices() {
+	if err := wm.initXInput(); err != nil {
+		log.Printf("XInput2: %v", err)
+	} else {
+		wm.hasXInput = true
+	}
+	if err := randr.Init(wm.xc); err != nil {
+		log.Printf("RandR: %v", err)
+		return
+	}
+	if _, err := randr.QueryVersion(wm.xc, 1, 3).Reply(); err != nil {
+		log.Printf("RandR: %v", err)
+		return
+	}
+	wm.hasRandR = true
+	// Outputs can be rearranged without the root window changing
+	// size, and so without a ConfigureNotify.
+	if err := randr.SelectInputChecked(wm.xc, wm.xroot.Root,
+		randr.NotifyMaskScreenChange).Check(); err != nil {
+		log.Printf("RandR: %v", err)
+	}
+}
+
+// handleScreenChangeNotifyEvent follows a RandR change of the screen
+// layout with the device mappings and the pointer confinement.
+func (wm *WM) handleScreenChangeNotifyEvent(e randr.ScreenChangeNotifyEvent) error {
+	if err := wm.updateScreens(); err != nil {
+		return err
+	}
+	wm.paintedBackgrounds = nil
+	if err := wm.applyDeviceMappings(); err != nil {
+		log.Printf("input devices: %v", err)
+	}
+	if wm.pointerConfinement != nil {
+		if err := wm.updateConfinement(); err != nil {
+			log.Printf("confining pointer: %v", err)
+		}
+	}
+	return wm.updateBackgrounds()
+}
+
+// InputDevices lists the input devices, with the mappings that apply
+// to them. The caller must hold wm.mu.
+func (wm *WM) InputDevices() ([]*InputDevice, error) {
+	if !wm.hasXInput {
+		return nil, errors.New("No XInput2")
+	}
+	xiDevices, err := wm.xiQueryDevices()
+	if err != nil {
+		return nil, err
+	}
+	devices := []*InputDevice{}
+	for _, xd := range xiDevices {
+		d := &InputDevice{
+			ID:         xd.id,
+			Name:       xd.name,
+			Use:        xiDeviceUses[xd.use],
+			Attachment: xd.attachment,
+			Enabled:    xd.enabled,
+			Touch:      xd.touch,
+		}
+		if xd.use == xiSlavePointer || xd.use == xiFloatingSlave {
+			if d.Node, err = wm.deviceNode(d.ID); err != nil {
+				return nil, err
+			}
+			if d.Matrix, err = wm.deviceMatrix(d.ID); err != nil {
+				return nil, err
+			}
+			d.Mapping, d.Override = wm.deviceMapping(d)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func (wm *WM) deviceNode(id uint16) (string, error) {
+	data, format, err := wm.xiGetProperty(id, atomDeviceNode)
+	if err != nil || format != 8 {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\x00"), nil
+}
+
+func (wm *WM) deviceMatrix(id uint16) ([]float32, error) {
+	data, format, err := wm.xiGetProperty(id, atomCoordTransMatrix)
+	if err != nil || format != 32 || len(data) != 9*4 {
+		return nil, err
+	}
+	matrix := make([]float32, 9)
+	for i := range matrix {
+		matrix[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return matrix, nil
+}
+
+func (wm *WM) setDeviceMatrix(id uint16, matrix []float32) error {
+	data := make([]byte, 4*len(matrix))
+	for i, v := range matrix {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return wm.xiChangeProperty(id, atomCoordTransMatrix, atomFloat, 32, len(matrix), data)
+}
+
+// deviceMapping returns the first mapping for the device, if any, and
+// whether it was set through the API.
+func (wm *WM) deviceMapping(d *InputDevice) (*DeviceMapping, bool) {
+	for _, dm := range wm.deviceOverrides {
+		if dm.matches(d) {
+			return dm, true
+		}
+	}
+	for _, dm := range wm.deviceMappings {
+		if dm.matches(d) {
+			return dm, false
+		}
+	}
+	return nil, false
+}
+
+// mappingRect returns the area of the screen or RandR output that the
+// mapping is for, or the whole root window if it has neither.
+func (wm *WM) mappingRect(dm *DeviceMapping) (xproto.Rectangle, error) {
+	if dm.Screen != nil {
+		return wm.pointerRect(dm.Screen, nil)
+	}
+	if dm.Output == "" {
+		return xproto.Rectangle{
+			Width:  wm.xroot.WidthInPixels,
+			Height: wm.xroot.HeightInPixels,
+		}, nil
+	}
+	if !wm.hasRandR {
+		return xproto.Rectangle{}, errors.New("No RandR")
+	}
+	res, err := randr.GetScreenResourcesCurrent(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		return xproto.Rectangle{}, err
+	}
+	for _, output := range res.Outputs {
+		info, err := randr.GetOutputInfo(wm.xc, output, res.ConfigTimestamp).Reply()
+		if err != nil {
+			return xproto.Rectangle{}, err
+		}
+		if string(info.Name) != dm.Output {
+			continue
+		}
+		if info.Crtc == 0 {
+			return xproto.Rectangle{}, fmt.Errorf("output %s is off", dm.Output)
+		}
+		crtc, err := randr.GetCrtcInfo(wm.xc, info.Crtc, res.ConfigTimestamp).Reply()
+		if err != nil {
+			return xproto.Rectangle{}, err
+		}
+		return xproto.Rectangle{X: crtc.X, Y: crtc.Y, Width: crtc.Width, Height: crtc.Height}, nil
+	}
+	return xproto.Rectangle{}, fmt.Errorf("no output %s", dm.Output)
+}
+
+// mappingMatrix returns the coordinate transformation matrix that
+// scales the whole root window down to the mapping's area.
+func (wm *WM) mappingMatrix(dm *DeviceMapping) ([]float32, error) {
+	r, err := wm.mappingRect(dm)
+	if err != nil {
+		return nil, err
+	}
+	w, h := float32(wm.xroot.WidthInPixels), float32(wm.xroot.HeightInPixels)
+	return []float32{
+		float32(r.Width) / w, 0, float32(r.X) / w,
+		0, float32(r.Height) / h, float32(r.Y) / h,
+		0, 0, 1,
+	}, nil
+}
+
+// applyDeviceMappings sets the matrices of all mapped devices. It runs
+// when mappings change, devices are plugged in, and screens change.
+// The caller must hold wm.mu.
+func (wm *WM) applyDeviceMappings() error {
+	if !wm.hasXInput {
+		return nil
+	}
+	devices, err := wm.InputDevices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.Mapping == nil || d.Matrix == nil {
+			continue
+		}
+		matrix, err := wm.mappingMatrix(d.Mapping)
+		if err != nil {
+			log.Printf("mapping device %q: %v", d.Name, err)
+			continue
+		}
+		if err = wm.setDeviceMatrix(d.ID, matrix); err != nil {
+			log.Printf("mapping device %q: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// SetDeviceMappings replaces the device mappings from the config, and
+// applies them. The mappings set through the API are kept, and take
+// precedence. The caller must hold wm.mu.
+func (wm *WM) SetDeviceMappings(mappings []*DeviceMapping) error {
+	for i, dm := range mappings {
+		if err := dm.Validate(); err != nil {
+			return fmt.Errorf("[%d]: %v", i, err)
+		}
+	}
+	wm.deviceMappings = mappings
+	return wm.applyDeviceMappings()
+}
+
+// MapDevice maps one device, by its name and node, or lets it cover
+// the whole root window again if screen is nil and output is empty.
+// The mapping is persisted in the state file, and overrides the
+// config. The caller must hold wm.mu.
+func (wm *WM) MapDevice(id uint16, screen *int, output string) (*InputDevice, error) {
+	d, err := wm.inputDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	if d.Matrix == nil {
+		return nil, fmt.Errorf("device %d can't be mapped", id)
+	}
+	dm := &DeviceMapping{Name: d.Name, Node: d.Node, Screen: screen, Output: output}
+	if screen != nil || output != "" {
+		if err := dm.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	matrix, err := wm.mappingMatrix(dm)
+	if err != nil {
+		return nil, err
+	}
+	if err = wm.setDeviceMatrix(id, matrix); err != nil {
+		return nil, err
+	}
+	// Letting a device go is only worth remembering if the config
+	// maps it.
+	remember := screen != nil || output != ""
+	for _, cm := range wm.deviceMappings {
+		remember = remember || cm.matches(d)
+	}
+	overrides := []*DeviceMapping{}
+	if remember {
+		overrides = append(overrides, dm)
+	}
+	for _, o := range wm.deviceOverrides {
+		if !o.matches(d) {
+			overrides = append(overrides, o)
+		}
+	}
+	wm.deviceOverrides = overrides
+	wm.saveState()
+	return wm.inputDevice(id)
+}
+
+func (wm *WM) inputDevice(id uint16) (*InputDevice, error) {
+	devices, err := wm.InputDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no device %d", id)
+}
+
+// runDeviceMonitor watches for hotplugged devices until the WM exits.
+// XI2 hierarchy events would tell us, but xgb can't read them.
+func (wm *WM) runDeviceMonitor() {
+	if !wm.hasXInput {
+		return
+	}
+	for range time.NewTicker(devicePollInterval).C {
+		wm.mu.Lock()
+		if err := wm.checkDevices(); err != nil {
+			log.Printf("input devices: %v", err)
+		}
+		wm.mu.Unlock()
+	}
+}
+
+// checkDevices applies the mappings if devices were added, and emits
+// input.devices if the device list changed. The caller must hold
+// wm.mu.
+func (wm *WM) checkDevices() error {
+	devices, err := wm.xiQueryDevices()
+	if err != nil {
+		return err
+	}
+	present := map[uint16]string{}
+	added, removed := []string{}, []string{}
+	for _, d := range devices {
+		present[d.id] = d.name
+		if name, ok := wm.knownDevices[d.id]; !ok || name != d.name {
+			added = append(added, d.name)
+		}
+	}
+	for id, name := range wm.knownDevices {
+		if present[id] != name {
+			removed = append(removed, name)
+		}
+	}
+	first := wm.knownDevices == nil
+	wm.knownDevices = present
+	if first || len(added)+len(removed) == 0 {
+		return nil
+	}
+	wm.emit("input.devices", map[string]interface{}{
+		"added":   added,
+		"removed": removed,
+	})
+	if len(added) > 0 {
+		return wm.applyDeviceMappings()
+	}
+	return nil
+}
+
+func (as *APIServer) deviceRoutes(router *mux.Router) {
+	router.HandleFunc("/input/devices", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		devices, err := as.wm.InputDevices()
+		if err != nil {
+			errorResponse(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"items": devices})
+	})).Methods("GET")
+
+	router.HandleFunc("/input/devices/{id:[0-9]+}/mapping", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 16)
+		if err != nil {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		var data struct {
+			Screen *int
+			Output string
+		}
+		// DELETE maps the device onto the whole root window again.
+		if r.Method == "PUT" {
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if data.Screen == nil && data.Output == "" {
+				errorResponse(w, r, http.StatusUnprocessableEntity,
+					errors.New("Screen or Output missing"))
+				return
+			}
+		}
+		d, err := as.wm.MapDevice(uint16(id), data.Screen, data.Output)
+		if err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": d})
+	})).Methods("PUT", "DELETE")
+}
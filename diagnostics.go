@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// diagnosticsExpiry is how long the diagnostics overlay stays up.
+const diagnosticsExpiry = 15 * time.Second
+
+// ShowDiagnostics shows an overlay with what staff on site need to
+// reach and check the WM: the host's addresses, what the API listens
+// on, and the state of the clients. Showing it again refreshes it. The
+// caller must hold wm.mu.
+func (wm *WM) ShowDiagnostics(screen int) error {
+	o := &Overlay{
+		Text:   wm.diagnosticsText(),
+		Screen: screen,
+		Expiry: Duration(diagnosticsExpiry),
+	}
+	if old, ok := wm.overlays[wm.diagnosticsOverlay]; ok && old.Screen == screen {
+		o.ID = old.ID
+	} else if ok {
+		wm.DeleteOverlay(old.ID)
+	}
+	if err := wm.ShowOverlay(o); err != nil {
+		return err
+	}
+	wm.diagnosticsOverlay = o.ID
+	return nil
+}
+
+// diagnosticsText returns the lines of the diagnostics overlay. The
+// caller must hold wm.mu.
+func (wm *WM) diagnosticsText() string {
+	lines := []string{"headless-wm"}
+	if version != "" {
+		lines[0] += " " + version
+	}
+	if host, err := os.Hostname(); err == nil {
+		lines = append(lines, "Host: "+host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		ips := []string{}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+		lines = append(lines, "Addresses: "+strings.Join(ips, " "))
+	}
+	lines = append(lines, "API: "+strings.Join(wm.config.Listen, " "))
+	visible := 0
+	for _, c := range wm.clients {
+		if c.Visible {
+			visible++
+		}
+	}
+	lines = append(lines,
+		fmt.Sprintf("Screens: %d", len(wm.attachedScreens)),
+		fmt.Sprintf("Clients: %d (%d visible)", len(wm.clients), visible))
+	if c := wm.activeClient; c != nil {
+		lines = append(lines, fmt.Sprintf("Focused: %s (%s)", c.Name, c.Class))
+	}
+	if !wm.lastInput.IsZero() {
+		lines = append(lines, fmt.Sprintf("Idle: %v",
+			time.Since(wm.lastInput).Truncate(time.Second)))
+	}
+	if wm.vnc != nil {
+		lines = append(lines, fmt.Sprintf("VNC sessions: %d", len(wm.vnc.sessions)))
+	}
+	return strings.Join(lines, "\n")
+}
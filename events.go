@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// EventBus fans out events to the /events/ websocket subscribers. It
+// numbers every event, and keeps a short history, so that subscribers
+// can resume from the last sequence number they saw after
+// reconnecting.
+type EventBus struct {
+	mu sync.Mutex
+	// seq is the sequence number of the last published event.
+	seq uint64
+	// history holds the most recent events, oldest first.
+	history     []json.RawMessage
+	historySize int
+	subscribers map[*WSClient]bool
+}
+
+// WSClient is a websocket subscriber of the EventBus.
+type WSClient struct {
+	ch chan []byte
+}
+
+// NewEventBus creates an EventBus that remembers up to historySize
+// events.
+func NewEventBus(historySize int) *EventBus {
+	return &EventBus{
+		historySize: historySize,
+		subscribers: map[*WSClient]bool{},
+	}
+}
+
+// Publish assigns the next sequence number to the event, and sends it
+// to all subscribers. Slow subscribers miss events; they can notice
+// the gap in sequence numbers, and resume.
+func (b *EventBus) Publish(data map[string]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	data["seq"] = b.seq
+	bs, err := json.Marshal(data)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	b.history = append(b.history, bs)
+	if over := len(b.history) - b.historySize; over > 0 {
+		b.history = b.history[over:]
+	}
+	for c := range b.subscribers {
+		select {
+		case c.ch <- bs:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscriber with a queue of the given
+// size. Any remembered events newer than since are queued first.
+func (b *EventBus) Subscribe(since uint64, queue int) *WSClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var backlog []json.RawMessage
+	if since > 0 && since < b.seq {
+		n := int(b.seq - since)
+		if n > len(b.history) {
+			n = len(b.history)
+		}
+		backlog = b.history[len(b.history)-n:]
+	}
+	if queue < len(backlog) {
+		queue = len(backlog)
+	}
+	c := &WSClient{ch: make(chan []byte, queue)}
+	for _, bs := range backlog {
+		c.ch <- bs
+	}
+	b.subscribers[c] = true
+	return c
+}
+
+// Unsubscribe removes the subscriber, and closes its channel.
+func (b *EventBus) Unsubscribe(c *WSClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, c)
+	close(c.ch)
+}
+
+// SetHistorySize changes the number of remembered events.
+func (b *EventBus) SetHistorySize(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.historySize = n
+	if over := len(b.history) - n; over > 0 {
+		b.history = b.history[over:]
+	}
+}
+
+// snapshot returns the last sequence number, and the remembered
+// events.
+func (b *EventBus) snapshot() (uint64, []json.RawMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq, append([]json.RawMessage{}, b.history...)
+}
+
+// restore sets the sequence number and history, e.g. after a restart.
+func (b *EventBus) restore(seq uint64, history []json.RawMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq = seq
+	b.history = history
+	if over := len(b.history) - b.historySize; over > 0 {
+		b.history = b.history[over:]
+	}
+}
+
+// emit publishes a WM event of the given type.
+func (wm *WM) emit(typ string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["type"] = typ
+	wm.events.Publish(data)
+}
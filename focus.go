@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// Focus rules for newly mapped windows.
+const (
+	FocusNever           = "never"
+	FocusAlways          = "always"
+	FocusIfParentFocused = "if-parent-focused"
+)
+
+// noFocusTypes are the window types that don't get the focus when
+// mapped, unless a rule says otherwise.
+var noFocusTypes = map[string]bool{
+	"desktop":       true,
+	"dock":          true,
+	"splash":        true,
+	"tooltip":       true,
+	"notification":  true,
+	"dropdown_menu": true,
+	"popup_menu":    true,
+	"combo":         true,
+	"dnd":           true,
+}
+
+// FocusConfig refines the focus policy.
+type FocusConfig struct {
+	// Screens overrides focus_policy for some screens, by index.
+	Screens map[int]string `yaml:"screens" json:"screens"`
+	// Designated is the only client that may hold the focus on
+	// screens with the strict policy.
+	Designated *Match `yaml:"designated" json:"designated"`
+	// Rules override focus-stealing prevention for new windows.
+	// The first matching rule applies.
+	Rules []FocusRule `yaml:"rules" json:"rules"`
+}
+
+// FocusRule decides if matching windows get the focus when mapped:
+// never, always, or if-parent-focused (only if the window they are
+// transient for has the focus).
+type FocusRule struct {
+	Match Match  `yaml:"match" json:"match"`
+	Focus string `yaml:"focus" json:"focus"`
+}
+
+// FocusPolicies are the focus policies in effect. They start out from
+// the config, and can be changed through the API.
+type FocusPolicies struct {
+	// Default is the policy for screens not in Screens.
+	Default    string
+	Screens    map[int]string
+	Designated *Match
+	Rules      []FocusRule
+}
+
+func validFocusPolicy(policy string) bool {
+	switch policy {
+	case FocusFollowMouse, FocusClick, FocusAPIOnly, FocusStrict:
+		return true
+	}
+	return false
+}
+
+// Validate checks the policies for errors.
+func (fp *FocusPolicies) Validate() error {
+	if !validFocusPolicy(fp.Default) {
+		return fmt.Errorf("unknown policy %q", fp.Default)
+	}
+	strict := fp.Default == FocusStrict
+	for screen, policy := range fp.Screens {
+		if screen < 0 {
+			return fmt.Errorf("bad screen %d", screen)
+		}
+		if !validFocusPolicy(policy) {
+			return fmt.Errorf("screen %d: unknown policy %q", screen, policy)
+		}
+		strict = strict || policy == FocusStrict
+	}
+	if fp.Designated != nil {
+		if err := fp.Designated.Validate(); err != nil {
+			return fmt.Errorf("designated: %v", err)
+		}
+	} else if strict {
+		return errors.New("strict policy needs a designated client")
+	}
+	for i := range fp.Rules {
+		rule := &fp.Rules[i]
+		if err := rule.Match.Validate(); err != nil {
+			return fmt.Errorf("rules[%d].match: %v", i, err)
+		}
+		switch rule.Focus {
+		case FocusNever, FocusAlways, FocusIfParentFocused:
+		default:
+			return fmt.Errorf("rules[%d]: unknown focus %q", i, rule.Focus)
+		}
+	}
+	return nil
+}
+
+// uses checks if the policy is in effect on any screen.
+func (fp *FocusPolicies) uses(policy string) bool {
+	if fp.Default == policy {
+		return true
+	}
+	for _, p := range fp.Screens {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// focusPolicies returns the focus policies set in the config.
+func (cfg *Config) focusPolicies() *FocusPolicies {
+	fp := &FocusPolicies{
+		Default:    cfg.FocusPolicy,
+		Screens:    map[int]string{},
+		Designated: cfg.Focus.Designated,
+		Rules:      cfg.Focus.Rules,
+	}
+	for screen, policy := range cfg.Focus.Screens {
+		fp.Screens[screen] = policy
+	}
+	return fp
+}
+
+// SetFocusPolicies replaces the focus policies. The caller must hold
+// wm.mu.
+func (wm *WM) SetFocusPolicies(fp *FocusPolicies) error {
+	if err := fp.Validate(); err != nil {
+		return err
+	}
+	wm.focusPolicies = fp
+	wm.updateButtonGrabs()
+	wm.emit("focus.policy", map[string]interface{}{"policies": fp})
+	return nil
+}
+
+// focusPolicyOn returns the focus policy for the screen.
+func (wm *WM) focusPolicyOn(screen int) string {
+	if policy, ok := wm.focusPolicies.Screens[screen]; ok {
+		return policy
+	}
+	return wm.focusPolicies.Default
+}
+
+// clientScreen returns the index of the screen the client's center is
+// on.
+func (wm *WM) clientScreen(c *Client) int {
+	return wm.screenAt(c.X+int16(c.W/2), c.Y+int16(c.H/2))
+}
+
+// mayFocus checks if the client is allowed to hold the focus. If not,
+// it returns the reason. The strict policy is not enforced in
+// maintenance mode.
+func (wm *WM) mayFocus(c *Client) (bool, string) {
+	policy := wm.focusPolicyOn(wm.clientScreen(c))
+	if policy == FocusStrict && wm.maintenance == nil &&
+		!wm.focusPolicies.Designated.Matches(c) {
+		return false, "strict"
+	}
+	return true, ""
+}
+
+// mayFocusNew decides if a window that the client just mapped may
+// take the focus. It prevents focus stealing by windows that are of a
+// type that shouldn't have the focus, dialogs of unfocused windows,
+// and windows whose _NET_WM_USER_TIME is older than the active
+// client's, i.e. the user did something else since they were opened.
+// Rules override the decision. If the focus is refused, mayFocusNew
+// returns the reason.
+func (wm *WM) mayFocusNew(c *Client) (bool, string) {
+	if wm.maintenance != nil {
+		return true, ""
+	}
+	active := wm.activeClient
+	parentFocused := active != nil && c.TransientFor == active.window
+	for i := range wm.focusPolicies.Rules {
+		rule := &wm.focusPolicies.Rules[i]
+		if !rule.Match.Matches(c) {
+			continue
+		}
+		switch rule.Focus {
+		case FocusAlways:
+			return true, ""
+		case FocusNever:
+			return false, "rule"
+		case FocusIfParentFocused:
+			if parentFocused {
+				return true, ""
+			}
+			return false, "parent not focused"
+		}
+	}
+	if noFocusTypes[c.Type] {
+		return false, "window type " + c.Type
+	}
+	if active == nil || parentFocused {
+		return true, ""
+	}
+	if wm.GetClient(c.TransientFor) != nil {
+		return false, "parent not focused"
+	}
+	t, ok, err := c.GetUserTime()
+	if err != nil || !ok {
+		return true, ""
+	}
+	if t == 0 {
+		// EWMH: the window should not get the focus when mapped.
+		return false, "user time"
+	}
+	activeTime, ok, err := active.GetUserTime()
+	// X timestamps wrap around.
+	if err == nil && ok && int32(t-activeTime) < 0 {
+		return false, "user time"
+	}
+	return true, ""
+}
+
+// denyFocus reports a refused focus change.
+func (wm *WM) denyFocus(c *Client, reason string) error {
+	wm.emit("focus.denied", map[string]interface{}{
+		"client":   c,
+		"clientID": c.window,
+		"reason":   reason,
+	})
+	return fmt.Errorf("focus denied: %s", reason)
+}
+
+// FocusClient gives the focus to the client, if the focus policies
+// allow it; otherwise it emits focus.denied and returns an error. t is
+// the time of the event that caused the focus change, or
+// xproto.TimeCurrentTime. The caller must hold wm.mu.
+func (wm *WM) FocusClient(c *Client, t xproto.Timestamp) error {
+	return wm.focusClient(c, t, true)
+}
+
+// focusClient is FocusClient, optionally without moving the client to
+// the front of the focus history.
+func (wm *WM) focusClient(c *Client, t xproto.Timestamp, remember bool) error {
+	if ok, reason := wm.mayFocus(c); !ok {
+		return wm.denyFocus(c, reason)
+	}
+	wm.activeClient = c
+	if remember {
+		wm.rememberFocus(c)
+	}
+	return c.TakeFocus(t)
+}
+
+// focusRoot gives the focus to the root window, so that no client has
+// it. The caller must hold wm.mu.
+func (wm *WM) focusRoot() {
+	wm.activeClient = nil
+	xproto.SetInputFocus(
+		wm.xc,                        // conn
+		xproto.InputFocusPointerRoot, // revert to
+		wm.xroot.Root,                // focus
+		xproto.TimeCurrentTime,       // time
+	)
+}
+
+// handleFocusInEvent enforces the strict policy on clients that take
+// the focus themselves.
+func (wm *WM) handleFocusInEvent(e xproto.FocusInEvent) error {
+	if e.Mode == xproto.NotifyModeGrab || e.Mode == xproto.NotifyModeUngrab ||
+		e.Detail == xproto.NotifyDetailInferior ||
+		e.Detail == xproto.NotifyDetailPointer {
+		return nil
+	}
+	c := wm.GetClient(e.Event)
+	if c == nil {
+		return nil
+	}
+	if ok, reason := wm.mayFocus(c); !ok {
+		wm.denyFocus(c, reason)
+		if d := wm.FindClient(wm.focusPolicies.Designated); d != nil && d.Visible {
+			return wm.FocusClient(d, xproto.TimeCurrentTime)
+		}
+		wm.focusRoot()
+		return nil
+	}
+	if c != wm.activeClient {
+		wm.activeClient = c
+		wm.rememberFocus(c)
+	}
+	return nil
+}
+
+// clickFocus focuses the clicked client, on screens with the click
+// policy.
+func (wm *WM) clickFocus(btn xproto.ButtonPressEvent) {
+	c := wm.GetClient(btn.Child)
+	if c == nil || c == wm.activeClient {
+		return
+	}
+	if wm.focusPolicyOn(wm.clientScreen(c)) != FocusClick {
+		return
+	}
+	if err := wm.FocusClient(c, btn.Time); err != nil {
+		log.Printf("click focus: %v", err)
+	}
+}
+
+func (as *APIServer) focusRoutes(router *mux.Router) {
+	router.HandleFunc("/focus/policy", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			// Fields left out keep their values. A screen set
+			// to "" goes back to the default.
+			fp := *as.wm.focusPolicies
+			fp.Screens = map[int]string{}
+			for screen, policy := range as.wm.focusPolicies.Screens {
+				fp.Screens[screen] = policy
+			}
+			if err := json.NewDecoder(r.Body).Decode(&fp); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			for screen, policy := range fp.Screens {
+				if policy == "" {
+					delete(fp.Screens, screen)
+				}
+			}
+			if err := as.wm.SetFocusPolicies(&fp); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": as.wm.focusPolicies})
+	})).Methods("GET", "PUT")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// rememberFocus moves the client to the front of the focus history.
+// The caller must hold wm.mu.
+func (wm *WM) rememberFocus(c *Client) {
+	history := []*Client{c}
+	for _, other := range wm.focusHistory {
+		if other != c {
+			history = append(history, other)
+		}
+	}
+	wm.focusHistory = history
+	wm.focusCursor = 0
+}
+
+// forgetFocus removes the client from the focus history. The caller
+// must hold wm.mu.
+func (wm *WM) forgetFocus(c *Client) {
+	history := []*Client{}
+	for i, other := range wm.focusHistory {
+		if other != c {
+			history = append(history, other)
+		} else if i < wm.focusCursor {
+			wm.focusCursor--
+		}
+	}
+	wm.focusHistory = history
+	if wm.focusCursor >= len(history) {
+		wm.focusCursor = 0
+	}
+}
+
+// focusFallback gives the focus to the most recently focused client
+// that is still visible, after the active client (gone) was hidden or
+// went away. It prefers the client that gone was transient for, then
+// clients on the same screen. If there is none, the root window gets
+// the focus. The caller must hold wm.mu.
+func (wm *WM) focusFallback(gone *Client) {
+	candidates := []*Client{}
+	if parent := wm.GetClient(gone.TransientFor); parent != nil {
+		candidates = append(candidates, parent)
+	}
+	screen := wm.clientScreen(gone)
+	for _, c := range wm.focusHistory {
+		if wm.clientScreen(c) == screen {
+			candidates = append(candidates, c)
+		}
+	}
+	candidates = append(candidates, wm.focusHistory...)
+	for _, c := range candidates {
+		if c == gone || !c.Visible {
+			continue
+		}
+		if ok, _ := wm.mayFocus(c); !ok {
+			continue
+		}
+		if err := wm.FocusClient(c, xproto.TimeCurrentTime); err != nil {
+			log.Printf("focus fallback: %v", err)
+			continue
+		}
+		return
+	}
+	wm.focusRoot()
+}
+
+// FocusPrevious steps back through the focus history, focusing the
+// next visible client that was focused before the current one.
+// Repeated calls go further back; any other focus change starts over
+// from the front. The caller must hold wm.mu.
+func (wm *WM) FocusPrevious() (*Client, error) {
+	for i := wm.focusCursor + 1; i < len(wm.focusHistory); i++ {
+		c := wm.focusHistory[i]
+		if !c.Visible {
+			continue
+		}
+		if ok, _ := wm.mayFocus(c); !ok {
+			continue
+		}
+		if err := wm.focusClient(c, xproto.TimeCurrentTime, false); err != nil {
+			return nil, err
+		}
+		wm.focusCursor = i
+		return c, nil
+	}
+	return nil, errors.New("No previous client")
+}
+
+func (as *APIServer) focusHistoryRoutes(router *mux.Router) {
+	router.HandleFunc("/focus/history", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		items := []map[string]interface{}{}
+		for _, c := range as.wm.focusHistory {
+			items = append(items, map[string]interface{}{
+				"id":     c.window,
+				"client": c,
+			})
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"items":  items,
+			"cursor": as.wm.focusCursor,
+		})
+	})).Methods("GET")
+
+	router.HandleFunc("/focus/previous", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		c, err := as.wm.FocusPrevious()
+		if err != nil {
+			errorResponse(w, r, http.StatusConflict, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"id":   c.window,
+			"item": c,
+		})
+	})).Methods("POST")
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// Gesture types.
+const (
+	// GestureLongPress is a press held still for a while.
+	GestureLongPress = "long-press"
+	// GestureEdgeSwipe is a press on the edge of a screen, dragged
+	// inwards.
+	GestureEdgeSwipe = "edge-swipe"
+	// GestureCornerTap is one or more taps in a corner of a
+	// screen.
+	GestureCornerTap = "corner-tap"
+	// GestureTap is a short tap with several fingers at once,
+	// anywhere on a screen.
+	GestureTap = "tap"
+)
+
+// Screen edges for the edge swipe gesture.
+const (
+	EdgeTop    = "top"
+	EdgeBottom = "bottom"
+	EdgeLeft   = "left"
+	EdgeRight  = "right"
+)
+
+// gesturePollInterval is how often the pointer is checked while a
+// press may turn into a gesture.
+const gesturePollInterval = 25 * time.Millisecond
+
+// Gesture runs actions when the touchscreen, or the mouse, is used in
+// a certain way anywhere on a screen. One-finger gestures are seen
+// through the pointer emulated for the first finger: the press is
+// passed on to the client under it as usual, and the rest is followed
+// by polling the pointer. Multi-finger taps are seen through XInput2
+// raw touch events, read on a connection of their own (see touch.go);
+// the touches still go to the clients.
+type Gesture struct {
+	Name string `yaml:"name" json:"name"`
+	// Type is long-press, edge-swipe, corner-tap, or tap.
+	Type string `yaml:"type" json:"type"`
+	// Screen limits the gesture to a screen.
+	Screen *int `yaml:"screen" json:"screen,omitempty"`
+	// Fingers is the number of fingers of a tap, at least 2. The
+	// other gestures are made with one finger, the default.
+	Fingers int `yaml:"fingers" json:"fingers"`
+	// Duration is how long a long press is held, and the longest a
+	// tap may take from the first finger down to the last one up.
+	// Defaults to 1s for long presses, and 500ms for taps.
+	Duration Duration `yaml:"duration" json:"duration,omitempty"`
+	// Edge is the edge an edge swipe starts on: top, bottom, left
+	// or right.
+	Edge string `yaml:"edge" json:"edge,omitempty"`
+	// Distance is how far an edge swipe goes inwards, in pixels.
+	// Defaults to 100.
+	Distance uint16 `yaml:"distance" json:"distance,omitempty"`
+	// Corner is the corner of a corner tap.
+	Corner string `yaml:"corner" json:"corner,omitempty"`
+	// Taps is the number of corner taps within TapWindow. Defaults
+	// to 1, and TapWindow to 3s.
+	Taps      int      `yaml:"taps" json:"taps,omitempty"`
+	TapWindow Duration `yaml:"tap_window" json:"tap_window,omitempty"`
+	// Size is the size of the edge or corner area, in pixels.
+	// Defaults to 24 for edges, and 48 for corners.
+	Size uint16 `yaml:"size" json:"size,omitempty"`
+	// Actions are run when the gesture is made. Without them, the
+	// gesture is only announced in a gesture.* event.
+	Actions []Action `yaml:"actions" json:"actions,omitempty"`
+}
+
+func (g *Gesture) setDefaults() {
+	if g.Fingers == 0 {
+		g.Fingers = 1
+	}
+	switch g.Type {
+	case GestureLongPress:
+		if g.Duration == 0 {
+			g.Duration = Duration(time.Second)
+		}
+	case GestureEdgeSwipe:
+		if g.Distance == 0 {
+			g.Distance = 100
+		}
+		if g.Size == 0 {
+			g.Size = 24
+		}
+	case GestureTap:
+		if g.Duration == 0 {
+			g.Duration = Duration(500 * time.Millisecond)
+		}
+	case GestureCornerTap:
+		if g.Taps == 0 {
+			g.Taps = 1
+		}
+		if g.TapWindow == 0 {
+			g.TapWindow = Duration(3 * time.Second)
+		}
+		if g.Size == 0 {
+			g.Size = 48
+		}
+	}
+}
+
+// Validate checks the gesture against the config it will run with.
+func (g *Gesture) Validate(cfg *Config) error {
+	if g.Name == "" {
+		return errors.New("missing name")
+	}
+	if g.Screen != nil && *g.Screen < 0 {
+		return fmt.Errorf("bad screen %d", *g.Screen)
+	}
+	if g.Type == GestureTap && g.Fingers < 2 {
+		return errors.New("fingers: taps need at least 2 fingers")
+	}
+	if g.Type != GestureTap && g.Fingers != 1 {
+		return errors.New("fingers: only taps are made with several fingers")
+	}
+	switch g.Type {
+	case GestureTap:
+		if g.Duration < 0 {
+			return errors.New("duration: must not be negative")
+		}
+	case GestureLongPress:
+		if g.Duration < 0 {
+			return errors.New("duration: must not be negative")
+		}
+	case GestureEdgeSwipe:
+		switch g.Edge {
+		case EdgeTop, EdgeBottom, EdgeLeft, EdgeRight:
+		default:
+			return fmt.Errorf("edge: unknown edge %q", g.Edge)
+		}
+	case GestureCornerTap:
+		switch g.Corner {
+		case CornerTopLeft, CornerTopRight, CornerBottomLeft, CornerBottomRight:
+		default:
+			return fmt.Errorf("corner: unknown corner %q", g.Corner)
+		}
+		if g.Taps < 0 {
+			return errors.New("taps: must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", g.Type)
+	}
+	for i := range g.Actions {
+		if err := g.Actions[i].Validate(cfg); err != nil {
+			return fmt.Errorf("actions[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// onScreen checks if the gesture applies to the screen.
+func (g *Gesture) onScreen(screen int) bool {
+	return g.Screen == nil || *g.Screen == screen
+}
+
+// gesturePress is a press being followed, that may turn into a long
+// press or an edge swipe.
+type gesturePress struct {
+	x, y   int16
+	screen int
+	start  time.Time
+	// moved is set once the pointer left the spot it was pressed
+	// on, which rules out a long press.
+	moved bool
+	timer *time.Timer
+}
+
+// gestureSlop is how far a long press may wander, in pixels.
+const gestureSlop = 16
+
+// gesturesPress looks for gestures starting with a press of the first
+// button. The caller must hold wm.mu.
+func (wm *WM) gesturesPress(btn xproto.ButtonPressEvent) {
+	wm.endGesturePress()
+	if len(wm.config.Gestures) == 0 || btn.Detail != xproto.ButtonIndex1 {
+		return
+	}
+	screen := wm.screenAt(btn.RootX, btn.RootY)
+	now := time.Now()
+	follow := false
+	for i := range wm.config.Gestures {
+		g := &wm.config.Gestures[i]
+		if !g.onScreen(screen) {
+			continue
+		}
+		switch g.Type {
+		case GestureCornerTap:
+			if wm.inCorner(btn.RootX, btn.RootY, g.Corner, g.Size) {
+				wm.gestureTap(g, now, btn.RootX, btn.RootY, screen)
+			} else {
+				delete(wm.gestureTaps, g.Name)
+			}
+		case GestureLongPress:
+			follow = true
+		case GestureEdgeSwipe:
+			if wm.onEdge(btn.RootX, btn.RootY, g.Edge, g.Size) {
+				follow = true
+			}
+		}
+	}
+	if !follow {
+		return
+	}
+	p := &gesturePress{x: btn.RootX, y: btn.RootY, screen: screen, start: now}
+	wm.gesturePress = p
+	p.timer = time.AfterFunc(gesturePollInterval, func() { wm.followGesturePress(p) })
+}
+
+// followGesturePress checks the pointer until the press is released,
+// or becomes a gesture.
+func (wm *WM) followGesturePress(p *gesturePress) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.gesturePress != p {
+		return
+	}
+	pointer, err := xproto.QueryPointer(wm.xc, wm.xroot.Root).Reply()
+	if err != nil || pointer.Mask&xproto.KeyButMaskButton1 == 0 {
+		wm.endGesturePress()
+		return
+	}
+	dx, dy := int(pointer.RootX)-int(p.x), int(pointer.RootY)-int(p.y)
+	if dx*dx+dy*dy > gestureSlop*gestureSlop {
+		p.moved = true
+	}
+	held := time.Since(p.start)
+	for i := range wm.config.Gestures {
+		g := &wm.config.Gestures[i]
+		if !g.onScreen(p.screen) {
+			continue
+		}
+		switch g.Type {
+		case GestureLongPress:
+			if !p.moved && held >= time.Duration(g.Duration) {
+				wm.endGesturePress()
+				wm.triggerGesture(g, p.x, p.y, p.screen)
+				return
+			}
+		case GestureEdgeSwipe:
+			if wm.onEdge(p.x, p.y, g.Edge, g.Size) && swiped(g.Edge, dx, dy, int(g.Distance)) {
+				wm.endGesturePress()
+				wm.triggerGesture(g, p.x, p.y, p.screen)
+				return
+			}
+		}
+	}
+	p.timer = time.AfterFunc(gesturePollInterval, func() { wm.followGesturePress(p) })
+}
+
+// endGesturePress stops following a press. The caller must hold wm.mu.
+func (wm *WM) endGesturePress() {
+	if wm.gesturePress == nil {
+		return
+	}
+	if wm.gesturePress.timer != nil {
+		wm.gesturePress.timer.Stop()
+	}
+	wm.gesturePress = nil
+}
+
+// swiped checks if a move by dx, dy went far enough away from the edge,
+// and more inwards than sideways.
+func swiped(edge string, dx, dy, distance int) bool {
+	in, side := 0, 0
+	switch edge {
+	case EdgeTop:
+		in, side = dy, dx
+	case EdgeBottom:
+		in, side = -dy, dx
+	case EdgeLeft:
+		in, side = dx, dy
+	case EdgeRight:
+		in, side = -dx, dy
+	}
+	if side < 0 {
+		side = -side
+	}
+	return in >= distance && in > side
+}
+
+// onEdge checks if the point is within size pixels of the edge of the
+// screen it is on.
+func (wm *WM) onEdge(x, y int16, edge string, size uint16) bool {
+	s := wm.attachedScreens[wm.screenAt(x, y)]
+	switch edge {
+	case EdgeTop:
+		return int(y)-int(s.YOrg) < int(size)
+	case EdgeBottom:
+		return int(s.YOrg)+int(s.Height)-int(y) <= int(size)
+	case EdgeLeft:
+		return int(x)-int(s.XOrg) < int(size)
+	case EdgeRight:
+		return int(s.XOrg)+int(s.Width)-int(x) <= int(size)
+	}
+	return false
+}
+
+// inCorner checks if the point is in the corner of the screen it is
+// on.
+func (wm *WM) inCorner(x, y int16, corner string, size uint16) bool {
+	switch corner {
+	case CornerTopLeft:
+		return wm.onEdge(x, y, EdgeTop, size) && wm.onEdge(x, y, EdgeLeft, size)
+	case CornerTopRight:
+		return wm.onEdge(x, y, EdgeTop, size) && wm.onEdge(x, y, EdgeRight, size)
+	case CornerBottomLeft:
+		return wm.onEdge(x, y, EdgeBottom, size) && wm.onEdge(x, y, EdgeLeft, size)
+	case CornerBottomRight:
+		return wm.onEdge(x, y, EdgeBottom, size) && wm.onEdge(x, y, EdgeRight, size)
+	}
+	return false
+}
+
+// gestureTap counts a corner tap, and triggers the gesture once there
+// were enough taps within its tap window. The caller must hold wm.mu.
+func (wm *WM) gestureTap(g *Gesture, now time.Time, x, y int16, screen int) {
+	taps := []time.Time{now}
+	for _, t := range wm.gestureTaps[g.Name] {
+		if now.Sub(t) < time.Duration(g.TapWindow) {
+			taps = append(taps, t)
+		}
+	}
+	wm.gestureTaps[g.Name] = taps
+	if len(taps) < g.Taps {
+		return
+	}
+	delete(wm.gestureTaps, g.Name)
+	wm.triggerGesture(g, x, y, screen)
+}
+
+// triggerGesture runs the gesture's actions, and announces it. The
+// caller must hold wm.mu.
+func (wm *WM) triggerGesture(g *Gesture, x, y int16, screen int) {
+	data := map[string]interface{}{
+		"gesture": g.Name,
+		"x":       x,
+		"y":       y,
+		"screen":  screen,
+	}
+	switch g.Type {
+	case GestureEdgeSwipe:
+		data["edge"] = g.Edge
+	case GestureCornerTap:
+		data["corner"] = g.Corner
+		data["taps"] = g.Taps
+	case GestureTap:
+		data["fingers"] = g.Fingers
+	}
+	if err := wm.runActions(g.Actions); err != nil {
+		log.Printf("gesture %q: %v", g.Name, err)
+		data["error"] = err.Error()
+	}
+	wm.emit("gesture."+g.Type, data)
+}
@@ -3,8 +3,9 @@ module github.com/intio/headless-wm
 go 1.16
 
 require (
-	git.sr.ht/~sircmpwn/getopt v0.0.0-20201218204720-9961a9c6298f // indirect
+	git.sr.ht/~sircmpwn/getopt v0.0.0-20201218204720-9961a9c6298f
 	github.com/BurntSushi/xgb v0.0.0-20210121224620-deaf085860bc
 	github.com/gorilla/mux v1.8.0
+	gopkg.in/yaml.v2 v2.2.8
 	nhooyr.io/websocket v1.8.6
 )
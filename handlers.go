@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/screensaver"
 	"github.com/BurntSushi/xgb/xproto"
 )
 
@@ -12,8 +14,12 @@ func (wm *WM) handleEvent() (err error) {
 	if err != nil {
 		return err
 	}
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.handleCompositorEvent(xev) {
+		return nil
+	}
 	data := (map[string]interface{}{
-		"type":  fmt.Sprintf("%T", xev),
 		"event": xev,
 	})
 	switch e := xev.(type) {
@@ -26,9 +32,10 @@ func (wm *WM) handleEvent() (err error) {
 	case xproto.ButtonReleaseEvent:
 		err = wm.handleButtonReleaseEvent(e)
 	case xproto.DestroyNotifyEvent:
-		err = wm.handleDestroyNotifyEvent(e)
+		// The client is forgotten while handling the event.
 		data["client"] = wm.GetClient(e.Window)
 		data["clientID"] = e.Window
+		err = wm.handleDestroyNotifyEvent(e)
 	case xproto.ConfigureRequestEvent:
 		err = wm.handleConfigureRequestEvent(e)
 		data["client"] = wm.GetClient(e.Window)
@@ -46,6 +53,11 @@ func (wm *WM) handleEvent() (err error) {
 		data["client"] = wm.GetClient(e.Window)
 		data["clientID"] = e.Window
 	case xproto.UnmapNotifyEvent:
+		if c := wm.GetClient(e.Window); c != nil && c.ignoreUnmaps > 0 {
+			data["causedBy"] = "wm"
+		} else {
+			data["causedBy"] = "client"
+		}
 		err = wm.handleUnmapNotifyEvent(e)
 		data["client"] = wm.GetClient(e.Window)
 		data["clientID"] = e.Window
@@ -53,65 +65,99 @@ func (wm *WM) handleEvent() (err error) {
 		err = wm.handleConfigureNotifyEvent(e)
 		data["client"] = wm.GetClient(e.Window)
 		data["clientID"] = e.Window
+	case xproto.FocusInEvent:
+		err = wm.handleFocusInEvent(e)
+		data["client"] = wm.GetClient(e.Event)
+		data["clientID"] = e.Event
+	case xproto.ExposeEvent:
+		err = wm.handleExposeEvent(e)
+	case xproto.MappingNotifyEvent:
+		err = wm.handleMappingNotifyEvent(e)
+	case screensaver.NotifyEvent:
+		err = wm.handleScreenSaverNotifyEvent(e)
+	case randr.ScreenChangeNotifyEvent:
+		err = wm.handleScreenChangeNotifyEvent(e)
+	case xproto.ClientMessageEvent:
+		err = wm.handleClientMessageEvent(e)
+		data["client"] = wm.GetClient(e.Window)
+		data["clientID"] = e.Window
 	}
-	if wm.api != nil {
-		go func() {
-			for c := range wm.api.clients {
-				c.ch <- data
-			}
-		}()
+	switch xev.(type) {
+	case xproto.MapNotifyEvent, xproto.UnmapNotifyEvent,
+		xproto.DestroyNotifyEvent, xproto.ConfigureNotifyEvent:
+		// Screens may have gained or lost their last client.
+		if err := wm.updateBackgrounds(); err != nil {
+			log.Print(err)
+		}
 	}
+	wm.emit(fmt.Sprintf("%T", xev), data)
 	return err
 }
 
-func (wm *WM) handleKeyPressEvent(key xproto.KeyPressEvent) error {
-	return nil
-}
-
-func (wm *WM) handleKeyReleaseEvent(key xproto.KeyReleaseEvent) error {
-	return nil
-}
-
-func (wm *WM) handleButtonPressEvent(btn xproto.ButtonPressEvent) error {
-	return nil
-}
-
-func (wm *WM) handleButtonReleaseEvent(btn xproto.ButtonReleaseEvent) error {
-	return nil
-}
-
 func (wm *WM) handleDestroyNotifyEvent(e xproto.DestroyNotifyEvent) error {
 	c := wm.GetClient(e.Window)
+	if c != nil {
+		// Hidden clients are destroyed without being unmapped
+		// first, so they are still on the list.
+		wm.ForgetClient(c)
+	}
 	if wm.activeClient != nil && wm.activeClient == c {
-		wm.activeClient = nil
-		// Cannot call 'replyChecked' on a cookie that is not expecting a *reply* or an error.
-		xproto.SetInputFocus(
-			wm.xc,                        // conn
-			xproto.InputFocusPointerRoot, // revert to
-			wm.xroot.Root,                // focus
-			xproto.TimeCurrentTime,       // time
-		)
+		wm.focusFallback(c)
 	}
 	return nil
 }
 
+// handleConfigureRequestEvent applies the placement policy to the
+// geometry the client asked for, on the screen it is on. Clients
+// placed by a persisted layout stay where they are, and are told so.
 func (wm *WM) handleConfigureRequestEvent(e xproto.ConfigureRequestEvent) error {
-	wm.handleNewWindow(e.Window)
+	if err := wm.handleNewWindow(e.Window); err != nil {
+		return err
+	}
 	c := wm.GetClient(e.Window)
+	if c.layoutRestored {
+		return c.Configure()
+	}
+	screen := &wm.attachedScreens[wm.clientScreen(c)]
 	c.X = e.X
 	c.Y = e.Y
 	c.W = e.Width
 	c.H = e.Height
-	// TODO: apply position/size policy
-	// c.MakeFullscreen(wm.attachedScreens[0])
+	wm.applyPlacement(c, screen)
 	return c.Configure()
 }
 
 func (wm *WM) handleMapRequestEvent(e xproto.MapRequestEvent) (err error) {
 	winattrib, err := xproto.GetWindowAttributes(wm.xc, e.Window).Reply()
 	if err != nil || !winattrib.OverrideRedirect {
-		xproto.MapWindowChecked(wm.xc, e.Window)
-		if err = wm.handleNewWindow(e.Window); err == nil {
+		err = wm.handleNewWindow(e.Window)
+		if c := wm.GetClient(e.Window); c != nil && wm.playlistHides(c) {
+			c.Visible = false
+		}
+		if c := wm.GetClient(e.Window); c != nil && wm.maintenance != nil {
+			// Make sure the maintenance shell comes up on top.
+			c.StackMode = xproto.StackModeAbove
+			if err := c.Configure(); err != nil {
+				log.Printf("raising window %d: %v", c.window, err)
+			}
+		}
+		// Hidden clients stay unmapped until shown.
+		if c := wm.GetClient(e.Window); c == nil || c.Visible {
+			if c != nil {
+				wm.prepareFadeIn(c)
+			}
+			xproto.MapWindowChecked(wm.xc, e.Window)
+			if c != nil {
+				c.mapRequested = true
+				c.SetWMState(NormalState)
+				if err := wm.fadeIn(c); err != nil {
+					log.Printf("fading in window %d: %v", c.window, err)
+				}
+			}
+		} else {
+			c.SetWMState(IconicState)
+		}
+		if err == nil {
 			return
 		}
 		c := wm.GetClient(e.Window)
@@ -124,54 +170,38 @@ func (wm *WM) handleMapRequestEvent(e xproto.MapRequestEvent) (err error) {
 
 func (wm *WM) handleEnterNotifyEvent(e xproto.EnterNotifyEvent) error {
 	c := wm.GetClient(e.Event)
-	wm.activeClient = c
-	if wm.activeClient == nil {
-		panic("no client is managing this window - what happened?")
-	}
-	prop, err := xproto.GetProperty(wm.xc, false, e.Event, atomWMProtocols,
-		xproto.GetPropertyTypeAny, 0, 64).Reply()
-	if err != nil {
-		return err
+	if c == nil || c == wm.activeClient {
+		return nil
 	}
-	focused := false
-TakeFocusPropLoop:
-	for v := prop.Value; len(v) >= 4; v = v[4:] {
-		if decodeAtom(v) == atomWMTakeFocus {
-			xproto.SendEventChecked(
-				wm.xc,
-				false,
-				e.Event,
-				xproto.EventMaskNoEvent,
-				string(xproto.ClientMessageEvent{
-					Format: 32,
-					Window: wm.activeClient.window, // private!
-					Type:   atomWMProtocols,
-					Data: xproto.ClientMessageDataUnionData32New([]uint32{
-						uint32(atomWMTakeFocus),
-						uint32(e.Time),
-						0,
-						0,
-						0,
-					}),
-				}.Bytes())).Check()
-			focused = true
-			break TakeFocusPropLoop
-		}
+	if wm.focusPolicyOn(wm.clientScreen(c)) != FocusFollowMouse {
+		return nil
 	}
-	if !focused {
-		c.Focus()
+	if err := wm.FocusClient(c, e.Time); err != nil {
+		log.Printf("focus follows mouse: %v", err)
 	}
 	return nil
 }
 
 func (wm *WM) handleMapNotifyEvent(e xproto.MapNotifyEvent) error {
-	// TODO: focus stealing prevention?
 	c := wm.GetClient(e.Window)
 	if c == nil {
 		log.Printf("mapped a window that was not being managed: %v", e)
+		return nil
+	}
+	c.Visible = true
+	if err := wm.enforceLayers(); err != nil {
+		log.Printf("restacking: %v", err)
+	}
+	if c.mapRequested {
+		c.mapRequested = false
+		if ok, reason := wm.mayFocusNew(c); !ok {
+			wm.denyFocus(c, reason)
+			return nil
+		}
+	}
+	if err := wm.FocusClient(c, xproto.TimeCurrentTime); err != nil {
+		log.Printf("focusing new window: %v", err)
 	}
-	wm.activeClient = c
-	wm.activeClient.Focus()
 	return nil
 }
 
@@ -180,11 +210,33 @@ func (wm *WM) handleUnmapNotifyEvent(e xproto.UnmapNotifyEvent) error {
 	if c == nil {
 		log.Printf("unmapped a window that was not being managed: %v", e)
 	}
-	if wm.activeClient == c {
-		// TODO: look for the active window?
-		wm.activeClient = nil
+	if c != nil && c.ignoreUnmaps > 0 {
+		// We hid the client ourselves; keep managing it.
+		c.ignoreUnmaps--
+		return nil
+	}
+	if c != nil {
+		// The client withdrew the window (ICCCM 4.1.4). The
+		// window may already be gone, so ignore errors.
+		c.SetWMState(WithdrawnState)
 	}
 	wm.ForgetClient(c)
+	if c != nil && wm.activeClient == c {
+		wm.focusFallback(c)
+	}
+	return nil
+}
+
+func (wm *WM) handleClientMessageEvent(e xproto.ClientMessageEvent) error {
+	c := wm.GetClient(e.Window)
+	if c == nil {
+		return nil
+	}
+	// ICCCM 4.1.4: the client asks to be iconified.
+	if e.Type == atomWMChangeState && e.Format == 32 &&
+		e.Data.Data32[0] == IconicState {
+		return wm.HideClient(c)
+	}
 	return nil
 }
 
@@ -192,5 +244,26 @@ func (wm *WM) handleConfigureNotifyEvent(e xproto.ConfigureNotifyEvent) error {
 	if err := wm.updateScreens(); err != nil {
 		return err
 	}
+	if e.Window == wm.xroot.Root {
+		// The screen layout may have changed; repaint the
+		// background to fit.
+		wm.xroot.WidthInPixels = e.Width
+		wm.xroot.HeightInPixels = e.Height
+		wm.paintedBackgrounds = nil
+		// Mapped devices have to follow their screens.
+		if err := wm.applyDeviceMappings(); err != nil {
+			log.Printf("input devices: %v", err)
+		}
+	}
+	if wm.pointerConfinement != nil {
+		// The screen or client may have moved.
+		if err := wm.updateConfinement(); err != nil {
+			log.Printf("confining pointer: %v", err)
+		}
+	}
+	if wm.GetClient(e.Window) != nil {
+		// The client may have been restacked out of its layer.
+		return wm.enforceLayers()
+	}
 	return nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// HideClient unmaps the client, and marks it as iconic (ICCCM
+// IconicState, _NET_WM_STATE_HIDDEN). Unlike a client withdrawing its
+// window, the client stays managed, and can be shown again. It stays
+// hidden over an in-place restart, but new windows of the same app are
+// not hidden by it. Playlists hide and show clients on every advance,
+// so this doesn't save the layout; the API does.
+func (wm *WM) HideClient(c *Client) error {
+	if !c.Visible {
+		return nil
+	}
+	// The window is unmapped once it has faded out.
+	if err := wm.fadeOut(c, c.Hide); err != nil {
+		return err
+	}
+	c.Visible = false
+	if err := c.SetWMState(IconicState); err != nil {
+		return err
+	}
+	if wm.activeClient == c {
+		wm.focusFallback(c)
+	}
+	wm.emit("client.hidden", map[string]interface{}{
+		"client":   c,
+		"clientID": c.window,
+	})
+	return nil
+}
+
+// ShowClient maps a hidden client again, and marks it as normal.
+func (wm *WM) ShowClient(c *Client) error {
+	if c.Visible {
+		return nil
+	}
+	if err := wm.prepareFadeIn(c); err != nil {
+		return err
+	}
+	if err := c.Show(); err != nil {
+		return err
+	}
+	c.Visible = true
+	if err := c.SetWMState(NormalState); err != nil {
+		return err
+	}
+	if err := wm.fadeIn(c); err != nil {
+		return err
+	}
+	wm.emit("client.shown", map[string]interface{}{
+		"client":   c,
+		"clientID": c.window,
+	})
+	return nil
+}
+
+// adoptWindow starts managing a window that existed before the WM
+// started. Windows that are neither mapped nor iconic (withdrawn) are
+// left alone until they ask to be mapped.
+func (wm *WM) adoptWindow(win xproto.Window) error {
+	attrs, err := xproto.GetWindowAttributes(wm.xc, win).Reply()
+	if err != nil {
+		return err
+	}
+	if attrs.OverrideRedirect {
+		return nil
+	}
+	viewable := attrs.MapState == xproto.MapStateViewable
+	if !viewable {
+		state, err := NewClient(wm.xc, win).GetWMState()
+		if err != nil {
+			return err
+		}
+		if state != IconicState {
+			return nil
+		}
+	}
+	if err = wm.handleNewWindow(win); err != nil {
+		return err
+	}
+	c := wm.GetClient(win)
+	// Saved layouts don't hide or show windows; an in-place
+	// restart matches them by ID instead.
+	c.Visible = viewable
+	if viewable {
+		return c.SetWMState(NormalState)
+	}
+	return c.SetWMState(IconicState)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+	"github.com/gorilla/mux"
+)
+
+// defaultHotkeyTimeout is how long we wait for the next key of a
+// sequence.
+const defaultHotkeyTimeout = 2 * time.Second
+
+// Hotkey sources.
+const (
+	HotkeyFromConfig = "config"
+	HotkeyFromAPI    = "api"
+)
+
+// Hotkey runs a list of actions when a key chord, or a sequence of
+// chords, is pressed.
+//
+// Only the first chord of a sequence is grabbed; once it is pressed,
+// the WM grabs the whole keyboard until the sequence is completed,
+// broken by another key, or timed out. The key that breaks a sequence
+// is typed again with XTEST, if available, so that it reaches the
+// focused client; the keys of the sequence before it never do. A
+// single-chord hotkey can't have the same chord as the start of a
+// sequence, which it would shadow.
+type Hotkey struct {
+	Name string `yaml:"name" json:"name"`
+	// Keys is a space-separated list of chords, like "Ctrl+Alt+r"
+	// or "Super+x Super+r".
+	Keys string `yaml:"keys" json:"keys"`
+	// Timeout is the time allowed between the keys of a sequence.
+	// Defaults to 2s.
+	Timeout Duration `yaml:"timeout" json:"timeout,omitempty"`
+	Actions []Action `yaml:"actions" json:"actions"`
+
+	Source string `yaml:"-" json:"source"`
+
+	chords []KeyChord
+	// secret is set for the maintenance mode sequence, which
+	// is not announced in events.
+	secret bool
+}
+
+// Validate checks the hotkey against the config it will run with.
+func (h *Hotkey) Validate(cfg *Config) error {
+	if h.Name == "" {
+		return errors.New("missing name")
+	}
+	chords, err := parseKeySequence(h.Keys)
+	if err != nil {
+		return err
+	}
+	if h.Timeout < 0 {
+		return errors.New("timeout: must not be negative")
+	}
+	if len(h.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for i := range h.Actions {
+		if err := h.Actions[i].Validate(cfg); err != nil {
+			return fmt.Errorf("actions[%d]: %v", i, err)
+		}
+	}
+	h.chords = chords
+	return nil
+}
+
+// overlaps checks if one of the hotkeys is a single chord that starts
+// the other's sequence. Both must be validated.
+func (h *Hotkey) overlaps(o *Hotkey) bool {
+	if (len(h.chords) == 1) == (len(o.chords) == 1) {
+		return false
+	}
+	return h.chords[0].equal(o.chords[0])
+}
+
+func (h *Hotkey) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultHotkeyTimeout
+	}
+	return time.Duration(h.Timeout)
+}
+
+// keySequence is a hotkey sequence in progress.
+type keySequence struct {
+	// candidates are the hotkeys whose chords so far were pressed.
+	candidates []*Hotkey
+	// pos is the index of the next chord.
+	pos   int
+	timer *time.Timer
+}
+
+// SetHotkey adds or replaces a hotkey. The caller must hold wm.mu.
+func (wm *WM) SetHotkey(h *Hotkey) error {
+	if err := h.Validate(wm.config); err != nil {
+		return fmt.Errorf("hotkey %q: %v", h.Name, err)
+	}
+	if err := wm.hotkeyOverlap(h); err != nil {
+		return fmt.Errorf("hotkey %q: %v", h.Name, err)
+	}
+	wm.hotkeys[h.Name] = h
+	wm.updateKeyGrabs()
+	return nil
+}
+
+// DeleteHotkey removes a hotkey. The caller must hold wm.mu.
+func (wm *WM) DeleteHotkey(name string) {
+	delete(wm.hotkeys, name)
+	wm.updateKeyGrabs()
+}
+
+// updateHotkeys replaces the hotkeys from the config with the ones in
+// the running config. Hotkeys created through the API are kept, unless
+// the config has one with the same name. The caller must hold wm.mu.
+func (wm *WM) updateHotkeys() {
+	for name, h := range wm.hotkeys {
+		if h.Source == HotkeyFromConfig {
+			delete(wm.hotkeys, name)
+		}
+	}
+	for i := range wm.config.Hotkeys {
+		h := wm.config.Hotkeys[i]
+		h.Source = HotkeyFromConfig
+		if err := h.Validate(wm.config); err != nil {
+			log.Printf("hotkey %q: %v", h.Name, err)
+			continue
+		}
+		if wm.maintenanceHotkey != nil && h.overlaps(wm.maintenanceHotkey) {
+			log.Printf("hotkey %q: overlaps the maintenance sequence", h.Name)
+			continue
+		}
+		wm.hotkeys[h.Name] = &h
+	}
+	// The config hotkeys win over the ones from the API.
+	for _, h := range wm.sortedHotkeys() {
+		if h.Source == HotkeyFromConfig {
+			continue
+		}
+		if err := wm.hotkeyOverlap(h); err != nil {
+			log.Printf("hotkey %q: %v, removing it", h.Name, err)
+			delete(wm.hotkeys, h.Name)
+		}
+	}
+	wm.updateKeyGrabs()
+}
+
+// hotkeyOverlap checks that the hotkey doesn't overlap the other
+// hotkeys or the maintenance sequence. A hotkey with the same name
+// isn't checked, since it would be replaced. The caller must hold
+// wm.mu.
+func (wm *WM) hotkeyOverlap(h *Hotkey) error {
+	if wm.maintenanceHotkey != nil && h.overlaps(wm.maintenanceHotkey) {
+		return errors.New("overlaps the maintenance sequence")
+	}
+	for _, o := range wm.sortedHotkeys() {
+		if o.Name != h.Name && h.overlaps(o) {
+			return fmt.Errorf("overlaps hotkey %q", o.Name)
+		}
+	}
+	return nil
+}
+
+// grabbedHotkeys returns the hotkeys to grab: the ones in order of
+// their names, and the maintenance sequence.
+func (wm *WM) grabbedHotkeys() []*Hotkey {
+	hotkeys := wm.sortedHotkeys()
+	if wm.maintenanceHotkey != nil {
+		hotkeys = append(hotkeys, wm.maintenanceHotkey)
+	}
+	return hotkeys
+}
+
+// sortedHotkeys returns the hotkeys in order of their names.
+func (wm *WM) sortedHotkeys() []*Hotkey {
+	hotkeys := make([]*Hotkey, 0, len(wm.hotkeys))
+	for _, h := range wm.hotkeys {
+		hotkeys = append(hotkeys, h)
+	}
+	sort.Slice(hotkeys, func(i, j int) bool {
+		return hotkeys[i].Name < hotkeys[j].Name
+	})
+	return hotkeys
+}
+
+// chordMatches checks if a key event is the chord.
+func (wm *WM) chordMatches(chord KeyChord, code xproto.Keycode, state uint16) bool {
+	combos, err := wm.keyMap.resolve(chord)
+	if err != nil {
+		return false
+	}
+	mods := wm.keyMap.modState(state)
+	for _, combo := range combos {
+		if combo.code == code && combo.mods == mods {
+			return true
+		}
+	}
+	return false
+}
+
+// isModifierKey checks if the keycode is mapped to a modifier.
+func (km *keyMap) isModifierKey(code xproto.Keycode) bool {
+	for _, keys := range km.modifiers {
+		for _, c := range keys {
+			if c == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startHotkeys handles the first chord of the grab's hotkeys: it
+// triggers a single-chord hotkey, or starts waiting for the rest of a
+// sequence. Overlapping hotkeys are rejected, but the maintenance
+// sequence is never shadowed anyway. The caller must hold wm.mu.
+func (wm *WM) startHotkeys(grab *keyGrab, t xproto.Timestamp) {
+	secret := false
+	for _, h := range grab.hotkeys {
+		secret = secret || h.secret
+	}
+	for _, h := range grab.hotkeys {
+		if len(h.chords) == 1 && !secret {
+			wm.triggerHotkey(h)
+			return
+		}
+	}
+	reply, err := xproto.GrabKeyboard(
+		wm.xc,
+		false, // owner events
+		wm.xroot.Root,
+		t,
+		xproto.GrabModeAsync, // pointer mode
+		xproto.GrabModeAsync, // keyboard mode
+	).Reply()
+	if err != nil || reply.Status != xproto.GrabStatusSuccess {
+		log.Printf("hotkey: could not grab the keyboard: %v", err)
+		return
+	}
+	wm.keySeq = &keySequence{candidates: grab.hotkeys, pos: 1}
+	wm.keySeqTimer(wm.keySeq)
+}
+
+// keySeqTimer (re)starts the timeout for the next key of the
+// sequence. The caller must hold wm.mu.
+func (wm *WM) keySeqTimer(seq *keySequence) {
+	timeout := time.Duration(0)
+	for _, h := range seq.candidates {
+		if h.timeout() > timeout {
+			timeout = h.timeout()
+		}
+	}
+	if seq.timer != nil {
+		seq.timer.Stop()
+	}
+	seq.timer = time.AfterFunc(timeout, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if wm.keySeq == seq {
+			log.Print("hotkey: sequence timed out")
+			wm.endKeySequence()
+		}
+	})
+}
+
+// continueKeySequence handles a key pressed during a sequence. The
+// caller must hold wm.mu.
+func (wm *WM) continueKeySequence(key xproto.KeyPressEvent) {
+	seq := wm.keySeq
+	if wm.keyMap.isModifierKey(key.Detail) {
+		return
+	}
+	candidates := []*Hotkey{}
+	for _, h := range seq.candidates {
+		if wm.chordMatches(h.chords[seq.pos], key.Detail, key.State) {
+			candidates = append(candidates, h)
+		}
+	}
+	seq.candidates = candidates
+	seq.pos++
+	for _, h := range candidates {
+		if len(h.chords) == seq.pos {
+			wm.endKeySequence()
+			wm.triggerHotkey(h)
+			return
+		}
+	}
+	if len(candidates) == 0 {
+		wm.endKeySequence()
+		wm.replayKey(key.Detail)
+		return
+	}
+	wm.keySeqTimer(seq)
+}
+
+// endKeySequence stops waiting for a sequence, and releases the
+// keyboard. The caller must hold wm.mu.
+func (wm *WM) endKeySequence() {
+	if wm.keySeq.timer != nil {
+		wm.keySeq.timer.Stop()
+	}
+	wm.keySeq = nil
+	xproto.UngrabKeyboard(wm.xc, xproto.TimeCurrentTime)
+}
+
+// replayKey types a key that broke a sequence, so that it reaches the
+// focused client after all. The modifiers pressed with it are still
+// held down. The caller must hold wm.mu.
+func (wm *WM) replayKey(code xproto.Keycode) {
+	if !wm.hasXTest {
+		return
+	}
+	for _, typ := range []byte{xproto.KeyPress, xproto.KeyRelease} {
+		if err := xtest.FakeInputChecked(
+			wm.xc, typ, byte(code), 0, wm.xroot.Root, 0, 0, 0,
+		).Check(); err != nil {
+			log.Printf("hotkey: replaying key %d: %v", code, err)
+			return
+		}
+	}
+}
+
+// triggerHotkey runs the hotkey's actions. The caller must hold wm.mu.
+func (wm *WM) triggerHotkey(h *Hotkey) {
+	if h.secret {
+		if err := wm.EnterMaintenance("keys", 0); err != nil {
+			log.Printf("maintenance: %v", err)
+		}
+		return
+	}
+	log.Printf("hotkey %q", h.Name)
+	err := wm.runActions(h.Actions)
+	data := map[string]interface{}{
+		"hotkey": h.Name,
+		"keys":   h.Keys,
+	}
+	if err != nil {
+		log.Printf("hotkey %q: %v", h.Name, err)
+		data["error"] = err.Error()
+	}
+	wm.emit("hotkey.triggered", data)
+}
+
+func (as *APIServer) hotkeyRoutes(router *mux.Router) {
+	router.HandleFunc("/hotkeys/", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			jsonResponse(w, r, 200,
+				map[string]interface{}{
+					"items": as.wm.hotkeys,
+				},
+			)
+		case "POST":
+			h := &Hotkey{}
+			if err := json.NewDecoder(r.Body).Decode(h); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if _, ok := as.wm.hotkeys[h.Name]; ok {
+				errorResponse(w, r, http.StatusConflict,
+					fmt.Errorf("hotkey %q exists", h.Name))
+				return
+			}
+			h.Source = HotkeyFromAPI
+			if err := as.wm.SetHotkey(h); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			jsonResponse(w, r, http.StatusCreated, map[string]interface{}{"item": h})
+		}
+	})).Methods("GET", "POST")
+
+	router.HandleFunc("/hotkeys/{name}", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		h, ok := as.wm.hotkeys[name]
+		if !ok && r.Method != "PUT" {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			h = &Hotkey{}
+			if err := json.NewDecoder(r.Body).Decode(h); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			h.Name = name
+			h.Source = HotkeyFromAPI
+			if err := as.wm.SetHotkey(h); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			as.wm.DeleteHotkey(name)
+			jsonResponse(w, r, 200, nil)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": h})
+	})).Methods("GET", "PUT", "DELETE")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BurntSushi/xgb/screensaver"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// idlePollInterval is how often the server's idle counter is read.
+const idlePollInterval = 500 * time.Millisecond
+
+// IdleThreshold runs actions when there was no user input for a while.
+type IdleThreshold struct {
+	Name    string   `yaml:"name" json:"name"`
+	After   Duration `yaml:"after" json:"after"`
+	Actions []Action `yaml:"actions" json:"actions"`
+}
+
+// Validate checks the threshold against the config it will run with.
+func (t *IdleThreshold) Validate(cfg *Config) error {
+	if t.Name == "" {
+		return errors.New("missing name")
+	}
+	if t.After <= 0 {
+		return errors.New("after: must be positive")
+	}
+	for i := range t.Actions {
+		if err := t.Actions[i].Validate(cfg); err != nil {
+			return fmt.Errorf("actions[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// IdleStatus is the user idle state, as reported by the API.
+type IdleStatus struct {
+	// Idle is the time since the last user input.
+	Idle      Duration
+	LastInput time.Time
+	// Active lists the names of the thresholds that were reached.
+	Active []string
+}
+
+// runIdleMonitor watches the idle time until the WM exits.
+func (wm *WM) runIdleMonitor() {
+	if !wm.hasScreenSaver {
+		log.Print("idle detection disabled: no MIT-SCREEN-SAVER")
+		return
+	}
+	for now := range time.NewTicker(idlePollInterval).C {
+		wm.mu.Lock()
+		if err := wm.checkIdle(now); err != nil {
+			log.Printf("idle: %v", err)
+		}
+		wm.mu.Unlock()
+	}
+}
+
+// checkIdle reads the idle counter, and starts or ends the idle
+// thresholds. The caller must hold wm.mu.
+func (wm *WM) checkIdle(now time.Time) error {
+	info, err := screensaver.QueryInfo(wm.xc, xproto.Drawable(wm.xroot.Root)).Reply()
+	if err != nil {
+		return err
+	}
+	lastInput := now.Add(-time.Duration(info.MsSinceUserInput) * time.Millisecond)
+	// The server can't tell our own XTEST input from the user's, so
+	// input shortly after we sent keys does not end idleness.
+	synthetic := !wm.fakeInputAt.IsZero() &&
+		lastInput.Sub(wm.fakeInputAt) < idlePollInterval
+	if lastInput.Sub(wm.lastInput) > idlePollInterval && !synthetic {
+		for _, t := range wm.config.Idle {
+			if !wm.idleActive[t.Name] {
+				continue
+			}
+			wm.emit("idle.end", map[string]interface{}{
+				"threshold": t.Name,
+				"idle":      Duration(lastInput.Sub(wm.lastInput)),
+			})
+		}
+		wm.idleActive = map[string]bool{}
+		wm.lastInput = lastInput
+	}
+	if wm.lastInput.IsZero() {
+		wm.lastInput = lastInput
+	}
+	idle := now.Sub(wm.lastInput)
+	for i := range wm.config.Idle {
+		t := &wm.config.Idle[i]
+		if wm.idleActive[t.Name] || idle < time.Duration(t.After) {
+			continue
+		}
+		wm.idleActive[t.Name] = true
+		wm.emit("idle.start", map[string]interface{}{
+			"threshold": t.Name,
+			"idle":      Duration(idle),
+		})
+		if wm.maintenance != nil {
+			continue
+		}
+		if err := wm.runActions(t.Actions); err != nil {
+			log.Printf("idle %q: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetIdleStatus returns the time since the last user input. The
+// caller must hold wm.mu.
+func (wm *WM) GetIdleStatus() (*IdleStatus, error) {
+	if !wm.hasScreenSaver {
+		return nil, errors.New("MIT-SCREEN-SAVER is not available")
+	}
+	if wm.lastInput.IsZero() {
+		if err := wm.checkIdle(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	status := &IdleStatus{
+		Idle:      Duration(time.Since(wm.lastInput)),
+		LastInput: wm.lastInput,
+		Active:    []string{},
+	}
+	for _, t := range wm.config.Idle {
+		if wm.idleActive[t.Name] {
+			status.Active = append(status.Active, t.Name)
+		}
+	}
+	return status, nil
+}
+
+func (as *APIServer) idleRoutes(router *mux.Router) {
+	router.HandleFunc("/idle", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		status, err := as.wm.GetIdleStatus()
+		if err != nil {
+			errorResponse(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": status})
+	})).Methods("GET")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// keyGrab is what a grabbed key combination is used for.
+type keyGrab struct {
+	chord   KeyChord
+	blocked bool
+	// hotkeys are the hotkeys starting with the chord.
+	hotkeys []*Hotkey
+}
+
+// validateKeyChords checks that all the chords parse.
+func validateKeyChords(keys []string) error {
+	for i, key := range keys {
+		if _, err := parseKeyChord(key); err != nil {
+			return fmt.Errorf("[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// SetBlockedKeys replaces the list of blocked key chords, and updates
+// the key grabs. The caller must hold wm.mu.
+func (wm *WM) SetBlockedKeys(keys []string) error {
+	chords := []KeyChord{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		chord, err := parseKeyChord(key)
+		if err != nil {
+			return err
+		}
+		if seen[chord.String()] {
+			continue
+		}
+		seen[chord.String()] = true
+		chords = append(chords, chord)
+	}
+	wm.blockedKeys = chords
+	wm.updateKeyGrabs()
+	return nil
+}
+
+// BlockedKeys returns the blocked key chords, in their canonical
+// form. The caller must hold wm.mu.
+func (wm *WM) BlockedKeys() []string {
+	keys := make([]string, len(wm.blockedKeys))
+	for i, chord := range wm.blockedKeys {
+		keys[i] = chord.String()
+	}
+	return keys
+}
+
+// lockMasks returns the combinations of the lock modifiers (Caps
+// Lock, Num Lock), which have to be grabbed separately.
+func (km *keyMap) lockMasks() []uint16 {
+	numLock := km.symMask("Num_Lock")
+	masks := []uint16{0, xproto.ModMaskLock}
+	if numLock != 0 {
+		masks = append(masks, numLock, numLock|xproto.ModMaskLock)
+	}
+	return masks
+}
+
+// updateKeyGrabs releases all our key grabs on the root window, and
+// grabs the keys we need again. Chords without a key in the current
+// mapping are skipped. Blocked keys are not grabbed in maintenance
+// mode. The caller must hold wm.mu.
+func (wm *WM) updateKeyGrabs() {
+	root := wm.xroot.Root
+	xproto.UngrabKey(wm.xc, xproto.GrabAny, root, xproto.ModMaskAny)
+	wm.keyGrabs = map[keyCombo]*keyGrab{}
+	blocked := wm.blockedKeys
+	if wm.maintenance != nil {
+		blocked = nil
+	}
+	for _, chord := range blocked {
+		combos, err := wm.keyMap.resolve(chord)
+		if err != nil {
+			log.Printf("blocked key: %v", err)
+			continue
+		}
+		for _, combo := range combos {
+			wm.keyGrabs[combo] = &keyGrab{chord: chord, blocked: true}
+		}
+	}
+	for _, h := range wm.grabbedHotkeys() {
+		combos, err := wm.keyMap.resolve(h.chords[0])
+		if err != nil {
+			log.Printf("hotkey %q: %v", h.Name, err)
+			continue
+		}
+		for _, combo := range combos {
+			grab, ok := wm.keyGrabs[combo]
+			if !ok {
+				grab = &keyGrab{chord: h.chords[0]}
+				wm.keyGrabs[combo] = grab
+			}
+			grab.hotkeys = append(grab.hotkeys, h)
+		}
+	}
+	for combo := range wm.keyGrabs {
+		for _, mask := range wm.keyMap.lockMasks() {
+			if err := xproto.GrabKeyChecked(
+				wm.xc,
+				false, // owner events
+				root,
+				combo.mods|mask,
+				combo.code,
+				xproto.GrabModeAsync, // pointer mode
+				xproto.GrabModeAsync, // keyboard mode
+			).Check(); err != nil {
+				log.Printf("grabbing %v: %v", wm.keyGrabs[combo].chord, err)
+				break
+			}
+		}
+	}
+}
+
+// modState returns the modifiers of a key event's state, without the
+// lock modifiers and the pointer buttons.
+func (km *keyMap) modState(state uint16) uint16 {
+	ignored := uint16(xproto.ModMaskLock) | km.symMask("Num_Lock")
+	return state & 0xff &^ ignored
+}
+
+// lookupKeyGrab finds the grab for a key event.
+func (wm *WM) lookupKeyGrab(code xproto.Keycode, state uint16) *keyGrab {
+	return wm.keyGrabs[keyCombo{code: code, mods: wm.keyMap.modState(state)}]
+}
+
+func (wm *WM) handleKeyPressEvent(key xproto.KeyPressEvent) error {
+	if wm.keySeq != nil {
+		// The keyboard is grabbed until the sequence ends.
+		wm.continueKeySequence(key)
+		return nil
+	}
+	grab := wm.lookupKeyGrab(key.Detail, key.State)
+	if grab == nil {
+		return nil
+	}
+	if len(grab.hotkeys) > 0 {
+		wm.startHotkeys(grab, key.Time)
+	} else if grab.blocked {
+		data := map[string]interface{}{"key": grab.chord.String()}
+		if wm.activeClient != nil {
+			data["clientID"] = wm.activeClient.window
+		}
+		log.Printf("blocked key %v", grab.chord)
+		wm.emit("key.blocked", data)
+	}
+	return nil
+}
+
+func (wm *WM) handleKeyReleaseEvent(key xproto.KeyReleaseEvent) error {
+	return nil
+}
+
+func (as *APIServer) keyFilterRoutes(router *mux.Router) {
+	listResponse := func(w http.ResponseWriter, r *http.Request, status int) {
+		jsonResponse(w, r, status, map[string]interface{}{
+			"items": as.wm.BlockedKeys(),
+		})
+	}
+
+	router.HandleFunc("/input/blocked-keys", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			var data struct{ Items []string }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.SetBlockedKeys(data.Items); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "POST":
+			var data struct{ Key string }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			keys := append(as.wm.BlockedKeys(), data.Key)
+			if err := as.wm.SetBlockedKeys(keys); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		listResponse(w, r, 200)
+	})).Methods("GET", "PUT", "POST")
+
+	router.HandleFunc("/input/blocked-keys/{key}", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		chord, err := parseKeyChord(mux.Vars(r)["key"])
+		if err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		keys := []string{}
+		found := false
+		for _, key := range as.wm.BlockedKeys() {
+			if key == chord.String() {
+				found = true
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if !found {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		if err := as.wm.SetBlockedKeys(keys); err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		listResponse(w, r, 200)
+	})).Methods("DELETE")
+}
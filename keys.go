@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+)
+
+// keysymNames maps X keysym names (as in X11/keysymdef.h, without the
+// XK_ prefix) to their values. Printable ASCII characters can also be
+// given as themselves, and any keysym as a hex number like "0xff08".
+var keysymNames = map[string]xproto.Keysym{
+	"space":        0x0020,
+	"exclam":       0x0021,
+	"quotedbl":     0x0022,
+	"numbersign":   0x0023,
+	"dollar":       0x0024,
+	"percent":      0x0025,
+	"ampersand":    0x0026,
+	"apostrophe":   0x0027,
+	"parenleft":    0x0028,
+	"parenright":   0x0029,
+	"asterisk":     0x002a,
+	"plus":         0x002b,
+	"comma":        0x002c,
+	"minus":        0x002d,
+	"period":       0x002e,
+	"slash":        0x002f,
+	"colon":        0x003a,
+	"semicolon":    0x003b,
+	"less":         0x003c,
+	"equal":        0x003d,
+	"greater":      0x003e,
+	"question":     0x003f,
+	"at":           0x0040,
+	"bracketleft":  0x005b,
+	"backslash":    0x005c,
+	"bracketright": 0x005d,
+	"asciicircum":  0x005e,
+	"underscore":   0x005f,
+	"grave":        0x0060,
+	"braceleft":    0x007b,
+	"bar":          0x007c,
+	"braceright":   0x007d,
+	"asciitilde":   0x007e,
+
+	"BackSpace":   0xff08,
+	"Tab":         0xff09,
+	"Return":      0xff0d,
+	"Pause":       0xff13,
+	"Scroll_Lock": 0xff14,
+	"Sys_Req":     0xff15,
+	"Escape":      0xff1b,
+	"Delete":      0xffff,
+	"Home":        0xff50,
+	"Left":        0xff51,
+	"Up":          0xff52,
+	"Right":       0xff53,
+	"Down":        0xff54,
+	"Prior":       0xff55,
+	"Page_Up":     0xff55,
+	"Next":        0xff56,
+	"Page_Down":   0xff56,
+	"End":         0xff57,
+	"Print":       0xff61,
+	"Insert":      0xff63,
+	"Menu":        0xff67,
+	"Break":       0xff6b,
+	"Num_Lock":    0xff7f,
+	"KP_Enter":    0xff8d,
+	"KP_Multiply": 0xffaa,
+	"KP_Add":      0xffab,
+	"KP_Subtract": 0xffad,
+	"KP_Decimal":  0xffae,
+	"KP_Divide":   0xffaf,
+	"KP_0":        0xffb0,
+	"KP_1":        0xffb1,
+	"KP_2":        0xffb2,
+	"KP_3":        0xffb3,
+	"KP_4":        0xffb4,
+	"KP_5":        0xffb5,
+	"KP_6":        0xffb6,
+	"KP_7":        0xffb7,
+	"KP_8":        0xffb8,
+	"KP_9":        0xffb9,
+
+	"Shift_L":          0xffe1,
+	"Shift_R":          0xffe2,
+	"Control_L":        0xffe3,
+	"Control_R":        0xffe4,
+	"Caps_Lock":        0xffe5,
+	"Meta_L":           0xffe7,
+	"Meta_R":           0xffe8,
+	"Alt_L":            0xffe9,
+	"Alt_R":            0xffea,
+	"Super_L":          0xffeb,
+	"Super_R":          0xffec,
+	"Hyper_L":          0xffed,
+	"Hyper_R":          0xffee,
+	"ISO_Level3_Shift": 0xfe03,
+	"Terminate_Server": 0xfed5,
+
+	"XF86AudioLowerVolume": 0x1008ff11,
+	"XF86AudioMute":        0x1008ff12,
+	"XF86AudioRaiseVolume": 0x1008ff13,
+	"XF86AudioPlay":        0x1008ff14,
+	"XF86AudioStop":        0x1008ff15,
+	"XF86AudioPrev":        0x1008ff16,
+	"XF86AudioNext":        0x1008ff17,
+	"XF86HomePage":         0x1008ff18,
+	"XF86Mail":             0x1008ff19,
+	"XF86Search":           0x1008ff1b,
+	"XF86Back":             0x1008ff26,
+	"XF86Forward":          0x1008ff27,
+	"XF86PowerOff":         0x1008ff2a,
+	"XF86Sleep":            0x1008ff2f,
+	"XF86Close":            0x1008ff56,
+	"XF86Reload":           0x1008ff73,
+}
+
+func init() {
+	// F1 to F35 are contiguous.
+	for i := 1; i <= 35; i++ {
+		keysymNames["F"+strconv.Itoa(i)] = xproto.Keysym(0xffbe + i - 1)
+	}
+}
+
+// parseKeysym looks up a keysym by name.
+func parseKeysym(name string) (xproto.Keysym, error) {
+	if sym, ok := keysymNames[name]; ok {
+		return sym, nil
+	}
+	if len(name) == 1 && name[0] > 0x20 && name[0] < 0x7f {
+		// Latin-1 keysyms are the same as the code points.
+		return xproto.Keysym(name[0]), nil
+	}
+	if strings.HasPrefix(name, "0x") {
+		v, err := strconv.ParseUint(name[2:], 16, 32)
+		if err == nil {
+			return xproto.Keysym(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown keysym %q", name)
+}
+
+// keysymName returns the name of a keysym, for logs and events.
+func keysymName(sym xproto.Keysym) string {
+	if sym > 0x20 && sym < 0x7f {
+		return string(rune(sym))
+	}
+	best := ""
+	for name, s := range keysymNames {
+		// Prefer the shortest alias, then the alphabetically first.
+		if s == sym && (best == "" || len(name) < len(best) ||
+			len(name) == len(best) && name < best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return fmt.Sprintf("0x%x", uint32(sym))
+	}
+	return best
+}
+
+// modifierNames maps the modifier names accepted in key chords to the
+// keysyms used to find their modifier bit, or to the fixed bit for the
+// core modifiers.
+var modifierNames = map[string]struct {
+	syms []string
+	mask uint16
+}{
+	"shift": {nil, xproto.ModMaskShift},
+	"ctrl":  {nil, xproto.ModMaskControl},
+	"alt":   {[]string{"Alt_L", "Alt_R", "Meta_L"}, xproto.ModMask1},
+	"super": {[]string{"Super_L", "Super_R"}, xproto.ModMask4},
+	"hyper": {[]string{"Hyper_L", "Hyper_R"}, xproto.ModMask4},
+	"altgr": {[]string{"ISO_Level3_Shift"}, xproto.ModMask5},
+	"lock":  {nil, xproto.ModMaskLock},
+	"mod1":  {nil, xproto.ModMask1},
+	"mod2":  {nil, xproto.ModMask2},
+	"mod3":  {nil, xproto.ModMask3},
+	"mod4":  {nil, xproto.ModMask4},
+	"mod5":  {nil, xproto.ModMask5},
+}
+
+// modifierOrder is the order of modifiers in canonical chord names.
+var modifierOrder = []string{
+	"shift", "ctrl", "alt", "super", "hyper", "altgr", "lock",
+	"mod1", "mod2", "mod3", "mod4", "mod5",
+}
+
+var modifierAliases = map[string]string{
+	"control": "ctrl",
+	"win":     "super",
+}
+
+// KeyChord is a key pressed together with modifiers, written like
+// "Ctrl+Alt+BackSpace". Modifier names are case insensitive, keysym
+// names are not ("w" and "W" are different keysyms).
+type KeyChord struct {
+	Mods []string
+	Sym  xproto.Keysym
+}
+
+// parseKeyChord parses a chord like "Ctrl+Shift+w".
+func parseKeyChord(s string) (KeyChord, error) {
+	parts := strings.Split(s, "+")
+	// "Ctrl++" is Ctrl and the plus key.
+	if strings.HasSuffix(s, "++") {
+		parts = append(parts[:len(parts)-2], "+")
+	}
+	chord := KeyChord{}
+	mods := map[string]bool{}
+	for _, mod := range parts[:len(parts)-1] {
+		mod = strings.ToLower(mod)
+		if alias, ok := modifierAliases[mod]; ok {
+			mod = alias
+		}
+		if _, ok := modifierNames[mod]; !ok {
+			return chord, fmt.Errorf("%q: unknown modifier %q", s, mod)
+		}
+		mods[mod] = true
+	}
+	for _, mod := range modifierOrder {
+		if mods[mod] {
+			chord.Mods = append(chord.Mods, mod)
+		}
+	}
+	var err error
+	if chord.Sym, err = parseKeysym(parts[len(parts)-1]); err != nil {
+		return chord, fmt.Errorf("%q: %v", s, err)
+	}
+	return chord, nil
+}
+
+// parseKeySequence parses space-separated key chords, like
+// "Ctrl+l Escape".
+func parseKeySequence(s string) ([]KeyChord, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty key sequence")
+	}
+	chords := make([]KeyChord, len(fields))
+	for i, field := range fields {
+		var err error
+		if chords[i], err = parseKeyChord(field); err != nil {
+			return nil, err
+		}
+	}
+	return chords, nil
+}
+
+// equal checks if two chords are the same keys. Modifiers are kept in
+// canonical order by parseKeyChord.
+func (chord KeyChord) equal(o KeyChord) bool {
+	if chord.Sym != o.Sym || len(chord.Mods) != len(o.Mods) {
+		return false
+	}
+	for i := range chord.Mods {
+		if chord.Mods[i] != o.Mods[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (chord KeyChord) String() string {
+	parts := []string{}
+	for _, mod := range chord.Mods {
+		parts = append(parts, strings.ToUpper(mod[:1])+mod[1:])
+	}
+	return strings.Join(append(parts, keysymName(chord.Sym)), "+")
+}
+
+// keyMap is a copy of the server's keyboard and modifier mappings.
+type keyMap struct {
+	minKeycode xproto.Keycode
+	perKeycode int
+	keysyms    []xproto.Keysym
+	// modifiers lists the keycodes of each of the 8 modifiers.
+	modifiers [8][]xproto.Keycode
+}
+
+// loadKeyMap fetches the keyboard and modifier mappings. It is called
+// on startup, and whenever the mapping changes.
+func (wm *WM) loadKeyMap() error {
+	setup := xproto.Setup(wm.xc)
+	km := &keyMap{minKeycode: setup.MinKeycode}
+	kbd, err := xproto.GetKeyboardMapping(
+		wm.xc,
+		setup.MinKeycode,
+		byte(setup.MaxKeycode-setup.MinKeycode+1),
+	).Reply()
+	if err != nil {
+		return err
+	}
+	km.perKeycode = int(kbd.KeysymsPerKeycode)
+	km.keysyms = kbd.Keysyms
+	mods, err := xproto.GetModifierMapping(wm.xc).Reply()
+	if err != nil {
+		return err
+	}
+	n := int(mods.KeycodesPerModifier)
+	for i := range km.modifiers {
+		for _, code := range mods.Keycodes[i*n : (i+1)*n] {
+			if code != 0 {
+				km.modifiers[i] = append(km.modifiers[i], code)
+			}
+		}
+	}
+	wm.keyMap = km
+	return nil
+}
+
+func (wm *WM) handleMappingNotifyEvent(e xproto.MappingNotifyEvent) error {
+	if e.Request == xproto.MappingPointer {
+		return nil
+	}
+	if err := wm.loadKeyMap(); err != nil {
+		return err
+	}
+	wm.updateKeyGrabs()
+	return nil
+}
+
+// keysym returns the keysym in the given column (0 for unshifted, 1
+// for shifted) of the keycode.
+func (km *keyMap) keysym(code xproto.Keycode, col int) xproto.Keysym {
+	i := (int(code)-int(km.minKeycode))*km.perKeycode + col
+	if code < km.minKeycode || col >= km.perKeycode || i >= len(km.keysyms) {
+		return 0
+	}
+	return km.keysyms[i]
+}
+
+// keycodes returns the keycodes that produce sym, and whether each
+// one needs Shift to do so.
+func (km *keyMap) keycodes(sym xproto.Keysym) (codes []xproto.Keycode, shifted []bool) {
+	for i, s := range km.keysyms {
+		col := i % km.perKeycode
+		// Only the first group is considered.
+		if s != sym || col > 1 {
+			continue
+		}
+		code := km.minKeycode + xproto.Keycode(i/km.perKeycode)
+		if len(codes) > 0 && codes[len(codes)-1] == code {
+			continue
+		}
+		codes = append(codes, code)
+		shifted = append(shifted, col == 1)
+	}
+	return
+}
+
+// modMask returns the modifier bit the named modifier is mapped to.
+func (km *keyMap) modMask(name string) uint16 {
+	mod := modifierNames[name]
+	for _, symName := range mod.syms {
+		if mask := km.symMask(symName); mask != 0 {
+			return mask
+		}
+	}
+	return mod.mask
+}
+
+// symMask returns the modifier bit that a key producing the named
+// keysym is mapped to, or zero if there is none.
+func (km *keyMap) symMask(symName string) uint16 {
+	codes, _ := km.keycodes(keysymNames[symName])
+	for i, keys := range km.modifiers {
+		for _, code := range keys {
+			for _, c := range codes {
+				if c == code {
+					return 1 << uint(i)
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// keyCombo is a chord resolved to a keycode and a modifier mask.
+type keyCombo struct {
+	code xproto.Keycode
+	mods uint16
+}
+
+// resolve finds the keycodes and modifier masks for the chord. There
+// may be more than one, if several keys produce the same keysym. A
+// keysym that needs Shift (like "W") adds Shift to the mask.
+func (km *keyMap) resolve(chord KeyChord) ([]keyCombo, error) {
+	var mods uint16
+	for _, name := range chord.Mods {
+		mods |= km.modMask(name)
+	}
+	codes, shifted := km.keycodes(chord.Sym)
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("%v: no key for keysym", chord)
+	}
+	combos := make([]keyCombo, len(codes))
+	for i, code := range codes {
+		combos[i] = keyCombo{code: code, mods: mods}
+		if shifted[i] {
+			combos[i].mods |= xproto.ModMaskShift
+		}
+	}
+	return combos, nil
+}
+
+// modifierKeycode returns a keycode that sets the modifier bit, for
+// pressing it with XTEST.
+func (km *keyMap) modifierKeycode(bit int) (xproto.Keycode, bool) {
+	if len(km.modifiers[bit]) == 0 {
+		return 0, false
+	}
+	return km.modifiers[bit][0], true
+}
+
+// initKeys loads the keyboard mapping and initializes the XTEST
+// extension. Without XTEST, key sequences can't be sent.
+func (wm *WM) initKeys() error {
+	if err := wm.loadKeyMap(); err != nil {
+		return err
+	}
+	if err := xtest.Init(wm.xc); err != nil {
+		log.Printf("XTEST: %v", err)
+		return nil
+	}
+	wm.hasXTest = true
+	return nil
+}
+
+// SendKeys types the space-separated key chords, as if they were
+// pressed on the keyboard. The caller must hold wm.mu.
+func (wm *WM) SendKeys(seq string) error {
+	if !wm.hasXTest {
+		return errors.New("XTEST is not available")
+	}
+	chords, err := parseKeySequence(seq)
+	if err != nil {
+		return err
+	}
+	km := wm.keyMap
+	fake := func(typ byte, code xproto.Keycode) error {
+		return xtest.FakeInputChecked(
+			wm.xc, typ, byte(code), 0, wm.xroot.Root, 0, 0, 0,
+		).Check()
+	}
+	for _, chord := range chords {
+		combos, err := km.resolve(chord)
+		if err != nil {
+			return err
+		}
+		combo := combos[0]
+		held := []xproto.Keycode{}
+		for bit := 0; bit < 8; bit++ {
+			if combo.mods&(1<<uint(bit)) == 0 {
+				continue
+			}
+			code, ok := km.modifierKeycode(bit)
+			if !ok {
+				return fmt.Errorf("%v: modifier %d has no key", chord, bit)
+			}
+			if err := fake(xproto.KeyPress, code); err != nil {
+				return err
+			}
+			held = append(held, code)
+		}
+		if err := fake(xproto.KeyPress, combo.code); err != nil {
+			return err
+		}
+		if err := fake(xproto.KeyRelease, combo.code); err != nil {
+			return err
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			if err := fake(xproto.KeyRelease, held[i]); err != nil {
+				return err
+			}
+		}
+	}
+	wm.fakeInputAt = time.Now()
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// LayoutItem places the matching clients on a screen. A named layout
+// from the config is a list of these.
+type LayoutItem struct {
+	Match Match `yaml:"match" json:"match"`
+	// Fullscreen makes the clients cover the screen; otherwise X,
+	// Y, W and H give their geometry relative to the screen.
+	Fullscreen bool   `yaml:"fullscreen" json:"fullscreen"`
+	X          int16  `yaml:"x" json:"x"`
+	Y          int16  `yaml:"y" json:"y"`
+	W          uint16 `yaml:"w" json:"w"`
+	H          uint16 `yaml:"h" json:"h"`
+	Hidden     bool   `yaml:"hidden" json:"hidden"`
+}
+
+func validateLayout(items []LayoutItem) error {
+	for i := range items {
+		if err := items[i].Match.Validate(); err != nil {
+			return fmt.Errorf("[%d].match: %v", i, err)
+		}
+		if !items[i].Fullscreen && (items[i].W == 0 || items[i].H == 0) {
+			return fmt.Errorf("[%d]: needs fullscreen, or w and h", i)
+		}
+	}
+	return nil
+}
+
+// ApplyLayout arranges the clients on the screen according to the
+// named layout from the config. The caller must hold wm.mu.
+func (wm *WM) ApplyLayout(screen int, name string) error {
+	if screen < 0 || screen >= len(wm.attachedScreens) {
+		return fmt.Errorf("no screen %d", screen)
+	}
+	items, ok := wm.config.Layouts[name]
+	if !ok {
+		return fmt.Errorf("no layout %q", name)
+	}
+	s := &wm.attachedScreens[screen]
+	for i := range items {
+		item := &items[i]
+		for _, c := range wm.FindClients(&item.Match) {
+			if item.Fullscreen {
+				c.MakeFullscreen(s)
+			} else {
+				c.X, c.Y = s.XOrg+item.X, s.YOrg+item.Y
+				c.W, c.H = item.W, item.H
+			}
+			if err := c.Configure(); err != nil {
+				return err
+			}
+			var err error
+			if item.Hidden {
+				err = wm.HideClient(c)
+			} else {
+				err = wm.ShowClient(c)
+			}
+			if err != nil {
+				return err
+			}
+			wm.rememberLayout(c)
+		}
+	}
+	wm.emit("layout.applied", map[string]interface{}{
+		"screen": screen,
+		"layout": name,
+	})
+	return nil
+}
+
+func (as *APIServer) layoutRoutes(router *mux.Router) {
+	router.HandleFunc("/screens/{n:[0-9]+}/layout", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		var data struct{ Name string }
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := as.wm.ApplyLayout(n, data.Name); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		jsonResponse(w, r, 200, nil)
+	})).Methods("POST")
+}
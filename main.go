@@ -5,11 +5,14 @@ import (
 	"git.sr.ht/~sircmpwn/getopt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
 	version    string
 	listenAddr string = "127.0.0.1:8080"
+	configPath string
 )
 
 var (
@@ -34,7 +37,7 @@ func (wm *WM) closeClientForcefully() error {
 }
 
 func main() {
-	opts, _, err := getopt.Getopts(os.Args, "l:")
+	opts, _, err := getopt.Getopts(os.Args, "l:c:")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -42,19 +45,63 @@ func main() {
 		switch opt.Option {
 		case 'l':
 			listenAddr = opt.Value
+		case 'c':
+			configPath = opt.Value
 		}
 	}
 	if version != "" {
 		log.Printf("version: %s", version)
 	}
 	var wm = NewWM()
+	if configPath != "" {
+		if wm.config, err = LoadConfig(configPath); err != nil {
+			log.Fatal(err)
+		}
+		wm.configPath = configPath
+		wm.events.SetHistorySize(wm.config.Events.History)
+	}
+	restored, listenFDs, err := loadRestartState()
+	if err != nil {
+		log.Printf("restoring state after restart: %v", err)
+	}
+	wm.restored = restored
 	err = wm.Init()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer wm.Deinit()
-	var api = NewAPIServer(wm, listenAddr)
-	go api.Start()
+	var api = NewAPIServer(wm)
+	api.inheritListeners(listenFDs)
+	if err = api.Start(); err != nil {
+		log.Fatal(err)
+	}
+	wm.mu.Lock()
+	err = wm.applyConfig(wm.config)
+	wm.mu.Unlock()
+	if _, ok := err.(configErrors); ok {
+		// There is nothing to go back to; run with what could
+		// be applied.
+		log.Printf("applying config: %v", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	go wm.runScheduler()
+	go wm.runIdleMonitor()
+	go wm.runCursorMonitor()
+	go wm.runDeviceMonitor()
+	go wm.runTouchMonitor()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			wm.mu.Lock()
+			if err := wm.ReloadConfig(); err != nil {
+				log.Printf("config reload failed: %v", err)
+			}
+			wm.mu.Unlock()
+		}
+	}()
 
 	for {
 		err := wm.handleEvent()
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// Screen corners for the maintenance and corner tap gestures.
+const (
+	CornerTopLeft     = "top-left"
+	CornerTopRight    = "top-right"
+	CornerBottomLeft  = "bottom-left"
+	CornerBottomRight = "bottom-right"
+)
+
+// MaintenanceConfig configures the maintenance mode, which gives staff
+// on site full control of the kiosk.
+type MaintenanceConfig struct {
+	// Keys is a secret key sequence that enters maintenance mode.
+	// It is not shown by GET /config or /hotkeys/.
+	Keys string `yaml:"keys" json:"keys"`
+	// Taps is the number of taps in a corner of a screen, within
+	// TapWindow, that enters maintenance mode. Zero disables the
+	// gesture.
+	Taps       int      `yaml:"taps" json:"taps"`
+	TapWindow  Duration `yaml:"tap_window" json:"tap_window"`
+	Corner     string   `yaml:"corner" json:"corner"`
+	CornerSize uint16   `yaml:"corner_size" json:"corner_size"`
+	// Command is the shell launched on top. Defaults to xterm.
+	Command []string `yaml:"command" json:"command"`
+	// Timeout is how long maintenance mode lasts, unless ended
+	// earlier through the API.
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// AuditLog is a file that entering and leaving maintenance
+	// mode is appended to, as JSON lines.
+	AuditLog string `yaml:"audit_log" json:"audit_log"`
+}
+
+func (mc *MaintenanceConfig) setDefaults() {
+	if mc.TapWindow == 0 {
+		mc.TapWindow = Duration(3 * time.Second)
+	}
+	if mc.Corner == "" {
+		mc.Corner = CornerTopLeft
+	}
+	if mc.CornerSize == 0 {
+		mc.CornerSize = 48
+	}
+	if len(mc.Command) == 0 {
+		mc.Command = []string{"xterm"}
+	}
+	if mc.Timeout == 0 {
+		mc.Timeout = Duration(15 * time.Minute)
+	}
+}
+
+// Validate checks the maintenance config for errors.
+func (mc *MaintenanceConfig) Validate() error {
+	if mc.Keys != "" {
+		if _, err := parseKeySequence(mc.Keys); err != nil {
+			return fmt.Errorf("keys: %v", err)
+		}
+	}
+	if mc.Taps < 0 {
+		return errors.New("taps: must not be negative")
+	}
+	switch mc.Corner {
+	case CornerTopLeft, CornerTopRight, CornerBottomLeft, CornerBottomRight:
+	default:
+		return fmt.Errorf("corner: unknown corner %q", mc.Corner)
+	}
+	if mc.Timeout < 0 {
+		return errors.New("timeout: must not be negative")
+	}
+	return nil
+}
+
+// Maintenance is the state of an active maintenance mode. While it is
+// active, blocked keys are let through, playlists are paused, and
+// schedules and idle actions don't run.
+type Maintenance struct {
+	Since time.Time
+	Until time.Time
+	// By tells how maintenance mode was entered: "keys",
+	// "corner", or "api" followed by the remote address.
+	By string
+
+	timer *time.Timer
+	shell *App
+	// playlists are the playlists we paused.
+	playlists []*Playlist
+}
+
+// EnterMaintenance starts maintenance mode for the timeout, or the
+// configured timeout if zero, and launches the shell. If maintenance
+// mode is already active, it is extended instead. The caller must hold
+// wm.mu.
+func (wm *WM) EnterMaintenance(by string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = time.Duration(wm.config.Maintenance.Timeout)
+	}
+	if m := wm.maintenance; m != nil {
+		m.Until = time.Now().Add(timeout)
+		wm.maintenanceTimer(m, timeout)
+		wm.audit("maintenance.extended", map[string]interface{}{
+			"by":    by,
+			"until": m.Until,
+		})
+		return nil
+	}
+	m := &Maintenance{
+		Since: time.Now(),
+		Until: time.Now().Add(timeout),
+		By:    by,
+		shell: &App{AppConfig: AppConfig{
+			Name:    "maintenance-shell",
+			Command: wm.config.Maintenance.Command,
+		}},
+	}
+	// Start the shell first, so that nothing needs to be undone if
+	// it fails. We hold wm.mu, so its windows can't map before
+	// maintenance mode is on.
+	if err := wm.startApp(m.shell); err != nil {
+		wm.audit("maintenance.failed", map[string]interface{}{
+			"by":    by,
+			"error": err.Error(),
+		})
+		return err
+	}
+	wm.maintenance = m
+	for _, p := range wm.playlists {
+		if !p.Paused {
+			wm.pausePlaylist(p)
+			m.playlists = append(m.playlists, p)
+		}
+	}
+	wm.updateKeyGrabs()
+	wm.maintenanceTimer(m, timeout)
+	wm.audit("maintenance.enter", map[string]interface{}{
+		"by":    by,
+		"until": m.Until,
+	})
+	return nil
+}
+
+func (wm *WM) maintenanceTimer(m *Maintenance, timeout time.Duration) {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.timer = time.AfterFunc(timeout, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if wm.maintenance == m && !time.Now().Before(m.Until) {
+			wm.ExitMaintenance("timeout")
+		}
+	})
+}
+
+// ExitMaintenance ends maintenance mode, closes the shell, and resumes
+// automation. The caller must hold wm.mu.
+func (wm *WM) ExitMaintenance(by string) error {
+	m := wm.maintenance
+	if m == nil {
+		return errors.New("Not in maintenance mode")
+	}
+	m.timer.Stop()
+	m.shell.Stop()
+	wm.maintenance = nil
+	for _, p := range m.playlists {
+		if wm.playlists[p.screen] == p {
+			wm.resumePlaylist(p)
+		}
+	}
+	wm.updateKeyGrabs()
+	wm.audit("maintenance.exit", map[string]interface{}{
+		"by":       by,
+		"duration": Duration(time.Since(m.Since)),
+	})
+	return nil
+}
+
+// audit logs an event that staff actions should be accountable for,
+// emits it, and appends it to the audit log. The caller must hold
+// wm.mu.
+func (wm *WM) audit(typ string, data map[string]interface{}) {
+	entry := map[string]interface{}{"time": time.Now(), "type": typ}
+	for k, v := range data {
+		entry[k] = v
+	}
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	log.Printf("audit: %s", bs)
+	wm.emit(typ, data)
+	path := wm.config.Maintenance.AuditLog
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(bs, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// updateMaintenanceHotkey sets up the secret key sequence from the
+// running config. The caller must hold wm.mu.
+func (wm *WM) updateMaintenanceHotkey() {
+	wm.maintenanceHotkey = nil
+	keys := wm.config.Maintenance.Keys
+	if keys == "" {
+		return
+	}
+	h := &Hotkey{
+		Name:    "maintenance",
+		Keys:    keys,
+		Actions: []Action{{Type: ActionMaintenance}},
+		secret:  true,
+	}
+	if err := h.Validate(wm.config); err != nil {
+		log.Printf("maintenance: %v", err)
+		return
+	}
+	wm.maintenanceHotkey = h
+}
+
+// updateButtonGrabs grabs the pointer buttons on the root window, if
+// we need to see all clicks, not just the ones on the root window
+// itself: for the corner taps, gestures, or click to focus. The grab is
+// synchronous, and every click is replayed to the clients in
+// handleButtonPressEvent. The caller must hold wm.mu.
+func (wm *WM) updateButtonGrabs() {
+	root := wm.xroot.Root
+	xproto.UngrabButton(wm.xc, xproto.ButtonIndexAny, root, xproto.ModMaskAny)
+	wm.buttonsGrabbed = wm.config.Maintenance.Taps > 0 ||
+		len(wm.config.Gestures) > 0 ||
+		wm.focusPolicies.uses(FocusClick)
+	if !wm.buttonsGrabbed {
+		return
+	}
+	if err := xproto.GrabButtonChecked(
+		wm.xc,
+		false, // owner events
+		root,
+		xproto.EventMaskButtonPress,
+		xproto.GrabModeSync,  // pointer mode
+		xproto.GrabModeAsync, // keyboard mode
+		xproto.WindowNone,    // confine to
+		xproto.CursorNone,
+		xproto.ButtonIndexAny,
+		xproto.ModMaskAny,
+	).Check(); err != nil {
+		log.Printf("grabbing buttons: %v", err)
+		wm.buttonsGrabbed = false
+	}
+}
+
+func (wm *WM) handleButtonPressEvent(btn xproto.ButtonPressEvent) error {
+	if wm.buttonsGrabbed {
+		// Let the click through to the client.
+		defer xproto.AllowEvents(wm.xc, xproto.AllowReplayPointer, btn.Time)
+	}
+	wm.clickFocus(btn)
+	wm.gesturesPress(btn)
+	if wm.config.Maintenance.Taps > 0 && wm.inTapCorner(btn.RootX, btn.RootY) {
+		wm.cornerTap(time.Now())
+	} else {
+		wm.cornerTaps = nil
+	}
+	return nil
+}
+
+func (wm *WM) handleButtonReleaseEvent(btn xproto.ButtonReleaseEvent) error {
+	return nil
+}
+
+// inTapCorner checks if the point is in the configured corner of the
+// screen it is on.
+func (wm *WM) inTapCorner(x, y int16) bool {
+	mc := &wm.config.Maintenance
+	return wm.inCorner(x, y, mc.Corner, mc.CornerSize)
+}
+
+// cornerTap counts a tap in the corner, and enters maintenance mode
+// once there were enough taps within the tap window. The caller must
+// hold wm.mu.
+func (wm *WM) cornerTap(now time.Time) {
+	mc := &wm.config.Maintenance
+	taps := []time.Time{now}
+	for _, t := range wm.cornerTaps {
+		if now.Sub(t) < time.Duration(mc.TapWindow) {
+			taps = append(taps, t)
+		}
+	}
+	wm.cornerTaps = taps
+	if len(taps) < mc.Taps {
+		return
+	}
+	wm.cornerTaps = nil
+	if err := wm.EnterMaintenance("corner", 0); err != nil {
+		log.Printf("maintenance: %v", err)
+	}
+}
+
+func (as *APIServer) maintenanceRoutes(router *mux.Router) {
+	router.HandleFunc("/admin/maintenance", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var data struct{ Timeout Duration }
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+					errorResponse(w, r, http.StatusUnprocessableEntity, err)
+					return
+				}
+			}
+			if data.Timeout < 0 {
+				errorResponse(w, r, http.StatusUnprocessableEntity,
+					errors.New("Timeout must not be negative"))
+				return
+			}
+			by := fmt.Sprintf("api %s", r.RemoteAddr)
+			if err := as.wm.EnterMaintenance(by, time.Duration(data.Timeout)); err != nil {
+				errorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		case "DELETE":
+			if err := as.wm.ExitMaintenance(fmt.Sprintf("api %s", r.RemoteAddr)); err != nil {
+				errorResponse(w, r, http.StatusConflict, err)
+				return
+			}
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": as.wm.maintenance})
+	})).Methods("GET", "POST", "DELETE")
+}
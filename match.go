@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// Match selects clients by their properties. Unset fields match
+// anything, and all set fields have to match.
+type Match struct {
+	ID       xproto.Window `yaml:"id" json:"id,omitempty"`
+	Class    string        `yaml:"class" json:"class,omitempty"`
+	Instance string        `yaml:"instance" json:"instance,omitempty"`
+	Role     string        `yaml:"role" json:"role,omitempty"`
+	// Type is the EWMH window type, like "dialog".
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Name is a regular expression matched against the window
+	// name.
+	Name string `yaml:"name" json:"name,omitempty"`
+
+	name *regexp.Regexp
+}
+
+// Validate checks the match, and compiles the name pattern.
+func (m *Match) Validate() error {
+	if *m == (Match{}) {
+		return fmt.Errorf("empty match")
+	}
+	if m.Name != "" {
+		re, err := regexp.Compile(m.Name)
+		if err != nil {
+			return fmt.Errorf("name: %v", err)
+		}
+		m.name = re
+	}
+	return nil
+}
+
+// Matches reports whether the client matches.
+func (m *Match) Matches(c *Client) bool {
+	if m.ID != 0 && m.ID != c.window {
+		return false
+	}
+	if m.Class != "" && m.Class != c.Class {
+		return false
+	}
+	if m.Instance != "" && m.Instance != c.Instance {
+		return false
+	}
+	if m.Role != "" && m.Role != c.Role {
+		return false
+	}
+	if m.Type != "" && m.Type != c.Type {
+		return false
+	}
+	if m.Name != "" {
+		// The pattern is compiled by Validate; without it,
+		// nothing matches.
+		if m.name == nil || !m.name.MatchString(c.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// FindClients returns the matching clients, oldest (lowest window
+// ID) first.
+func (wm *WM) FindClients(m *Match) []*Client {
+	found := []*Client{}
+	for _, c := range wm.clients {
+		if m.Matches(c) {
+			found = append(found, c)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].window < found[j].window
+	})
+	return found
+}
+
+// FindClient returns the oldest matching client, or nil.
+func (wm *WM) FindClient(m *Match) *Client {
+	if found := wm.FindClients(m); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
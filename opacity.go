@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// fadeStep is the time between the opacity changes of a fade.
+const fadeStep = 25 * time.Millisecond
+
+// FadeConfig sets how long clients fade in and out. The WM steps
+// _NET_WM_WINDOW_OPACITY, which the built-in compositor, or another
+// one, draws. Without one, fading out just delays hiding and closing.
+type FadeConfig struct {
+	// In is the fade in when a client is mapped or shown. Zero
+	// disables it.
+	In Duration `yaml:"in" json:"in"`
+	// Out is the fade out before a client is hidden or closed.
+	// Zero disables it.
+	Out Duration `yaml:"out" json:"out"`
+}
+
+// Validate checks the fade config for errors.
+func (fc *FadeConfig) Validate() error {
+	if fc.In < 0 {
+		return errors.New("in: must not be negative")
+	}
+	if fc.Out < 0 {
+		return errors.New("out: must not be negative")
+	}
+	return nil
+}
+
+// fade is a client's opacity changing over time.
+type fade struct {
+	from, to float64
+	start    time.Time
+	duration time.Duration
+	timer    *time.Timer
+	// done is run once the fade is complete, unless it was
+	// stopped.
+	done func() error
+}
+
+// validOpacity checks that the opacity is between 0 (transparent) and
+// 1 (opaque).
+func validOpacity(o float64) error {
+	if o < 0 || o > 1 {
+		return fmt.Errorf("opacity %v out of range", o)
+	}
+	return nil
+}
+
+// writeOpacity sets _NET_WM_WINDOW_OPACITY, or removes it when the
+// client is opaque.
+func (c *Client) writeOpacity(o float64) error {
+	c.opacity = o
+	if o >= 1 {
+		return xproto.DeletePropertyChecked(c.xc, c.window, atomNETWMWindowOpacity).Check()
+	}
+	return xproto.ChangePropertyChecked(
+		c.xc,
+		xproto.PropModeReplace,
+		c.window,
+		atomNETWMWindowOpacity,
+		xproto.AtomCardinal,
+		32, // format
+		1,
+		encodeUint32s(uint32(o*0xffffffff)),
+	).Check()
+}
+
+// SetOpacity changes the client's opacity. A fade in in progress is
+// redirected to it, and a fade out runs its course. The caller must
+// hold wm.mu.
+func (wm *WM) SetOpacity(c *Client, o float64) error {
+	if err := validOpacity(o); err != nil {
+		return err
+	}
+	c.Opacity, c.OpacitySet = o, true
+	if c.fade != nil {
+		if c.fade.done == nil {
+			c.fade.to = o
+		}
+		return nil
+	}
+	wm.scheduleRepaint()
+	return c.writeOpacity(o)
+}
+
+// fadeClient changes the client's opacity to the target over d, and
+// then runs done, if given. The caller must hold wm.mu.
+func (wm *WM) fadeClient(c *Client, to float64, d time.Duration, done func() error) error {
+	wm.stopFade(c)
+	if d <= 0 {
+		if c.opacity != to {
+			wm.scheduleRepaint()
+			if err := c.writeOpacity(to); err != nil {
+				return err
+			}
+		}
+		if done != nil {
+			return done()
+		}
+		return nil
+	}
+	f := &fade{from: c.opacity, to: to, start: time.Now(), duration: d, done: done}
+	c.fade = f
+	wm.stepFade(c, f)
+	return nil
+}
+
+// stepFade sets the opacity for the time elapsed, and schedules the
+// next step. The caller must hold wm.mu.
+func (wm *WM) stepFade(c *Client, f *fade) {
+	wm.scheduleRepaint()
+	t := float64(time.Since(f.start)) / float64(f.duration)
+	if t >= 1 {
+		c.fade = nil
+		if err := c.writeOpacity(f.to); err != nil {
+			log.Printf("fading client %d: %v", c.window, err)
+		}
+		if f.done != nil {
+			if err := f.done(); err != nil {
+				log.Printf("fading client %d: %v", c.window, err)
+			}
+		}
+		return
+	}
+	if err := c.writeOpacity(f.from + (f.to-f.from)*t); err != nil {
+		log.Printf("fading client %d: %v", c.window, err)
+	}
+	f.timer = time.AfterFunc(fadeStep, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if c.fade == f {
+			wm.stepFade(c, f)
+		}
+	})
+}
+
+// stopFade stops a fade in progress, without running what was to be
+// done after it. It returns false if there was none. The caller must
+// hold wm.mu.
+func (wm *WM) stopFade(c *Client) bool {
+	if c.fade == nil {
+		return false
+	}
+	if c.fade.timer != nil {
+		c.fade.timer.Stop()
+	}
+	c.fade = nil
+	return true
+}
+
+// prepareFadeIn makes the client transparent before it is mapped, so
+// that it can fade in. A client still fading out is mapped, and fades
+// in from where it is. The caller must hold wm.mu.
+func (wm *WM) prepareFadeIn(c *Client) error {
+	if wm.stopFade(c) || wm.config.Fade.In <= 0 {
+		return nil
+	}
+	wm.scheduleRepaint()
+	return c.writeOpacity(0)
+}
+
+// fadeIn brings the client to its opacity, after it was mapped. The
+// caller must hold wm.mu.
+func (wm *WM) fadeIn(c *Client) error {
+	return wm.fadeClient(c, c.Opacity, time.Duration(wm.config.Fade.In), nil)
+}
+
+// fadeOut fades the client out, and then runs done, like unmapping or
+// closing it. Without a fade, done runs right away. The caller must
+// hold wm.mu.
+func (wm *WM) fadeOut(c *Client, done func() error) error {
+	if wm.config.Fade.Out <= 0 {
+		wm.stopFade(c)
+		return done()
+	}
+	return wm.fadeClient(c, 0, time.Duration(wm.config.Fade.Out), done)
+}
+
+// CloseClient fades the client out, and asks it to close. The caller
+// must hold wm.mu.
+func (wm *WM) CloseClient(c *Client) error {
+	return wm.fadeOut(c, c.CloseGracefully)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb/shape"
+	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// Overlay positions on the screen, besides the corners.
+const (
+	PositionCenter = "center"
+	PositionTop    = "top"
+	PositionBottom = "bottom"
+)
+
+// defaultOverlayFont is a core X font that comes with most servers.
+// If it is missing, "fixed" is used instead.
+const defaultOverlayFont = "9x15bold"
+
+// Overlay is a message window created and drawn by the WM itself. It
+// is override-redirect, stays above all clients, lets clicks through
+// and never takes the focus.
+type Overlay struct {
+	ID   int    `yaml:"-" json:"id"`
+	Text string `yaml:"text" json:"text"`
+	// Font is a core X font name, like "9x15bold" or an XLFD.
+	Font       string `yaml:"font" json:"font"`
+	Foreground string `yaml:"foreground" json:"foreground"`
+	Background string `yaml:"background" json:"background"`
+	Screen     int    `yaml:"screen" json:"screen"`
+	// Position is center, top, bottom, or a corner like top-left.
+	// It is ignored if Region is set.
+	Position string `yaml:"position" json:"position"`
+	// Region is the area to cover, relative to the screen. The
+	// text is centered in it.
+	Region *Region `yaml:"region" json:"region,omitempty"`
+	// Opacity goes from 0 (exclusive) to 1, the default. It needs
+	// a compositor.
+	Opacity float64 `yaml:"opacity" json:"opacity"`
+	// Expiry is how long the overlay stays up. Zero means until
+	// it is deleted.
+	Expiry  Duration   `yaml:"expiry" json:"expiry,omitempty"`
+	Expires *time.Time `yaml:"-" json:"expires,omitempty"`
+
+	window xproto.Window
+	gc     xproto.Gcontext
+	font   xproto.Font
+	pixels []uint32
+	lines  []overlayLine
+	timer  *time.Timer
+}
+
+// Region is a rectangle relative to a screen's origin.
+type Region struct {
+	X int16  `yaml:"x" json:"x"`
+	Y int16  `yaml:"y" json:"y"`
+	W uint16 `yaml:"w" json:"w"`
+	H uint16 `yaml:"h" json:"h"`
+}
+
+// overlayLine is a line of text, encoded for the core font, and where
+// it is drawn.
+type overlayLine struct {
+	text string
+	x, y int16
+}
+
+func (o *Overlay) setDefaults() {
+	if o.Font == "" {
+		o.Font = defaultOverlayFont
+	}
+	if o.Foreground == "" {
+		o.Foreground = "#ffffff"
+	}
+	if o.Background == "" {
+		o.Background = "#000000"
+	}
+	if o.Position == "" {
+		o.Position = PositionCenter
+	}
+	if o.Opacity == 0 {
+		o.Opacity = 1
+	}
+}
+
+// Validate checks the overlay for errors. Fonts and colour names can
+// only be checked by the X server, when the overlay is shown.
+func (o *Overlay) Validate() error {
+	if o.Text == "" {
+		return errors.New("empty text")
+	}
+	if o.Screen < 0 {
+		return fmt.Errorf("bad screen %d", o.Screen)
+	}
+	switch o.Position {
+	case "", PositionCenter, PositionTop, PositionBottom,
+		CornerTopLeft, CornerTopRight, CornerBottomLeft, CornerBottomRight:
+	default:
+		return fmt.Errorf("unknown position %q", o.Position)
+	}
+	if o.Region != nil && (o.Region.W == 0 || o.Region.H == 0) {
+		return errors.New("region: empty")
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("opacity %v out of range", o.Opacity)
+	}
+	if o.Expiry < 0 {
+		return errors.New("expiry: must not be negative")
+	}
+	return nil
+}
+
+// ShowOverlay creates and maps an overlay. If an overlay with the same
+// ID exists, it is replaced. The caller must hold wm.mu.
+func (wm *WM) ShowOverlay(o *Overlay) error {
+	o.setDefaults()
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := wm.realizeOverlay(o); err != nil {
+		wm.unrealizeOverlay(o)
+		return err
+	}
+	typ := "overlay.updated"
+	if old, ok := wm.overlays[o.ID]; ok && o.ID != 0 {
+		wm.unrealizeOverlay(old)
+	} else {
+		wm.lastOverlayID++
+		o.ID = wm.lastOverlayID
+		typ = "overlay.created"
+	}
+	wm.overlays[o.ID] = o
+	o.Expires = nil
+	if o.Expiry > 0 {
+		expires := time.Now().Add(time.Duration(o.Expiry))
+		o.Expires = &expires
+		o.timer = time.AfterFunc(time.Duration(o.Expiry), func() {
+			wm.mu.Lock()
+			defer wm.mu.Unlock()
+			if wm.overlays[o.ID] == o {
+				wm.DeleteOverlay(o.ID)
+			}
+		})
+	}
+	wm.emit(typ, map[string]interface{}{"overlay": o})
+	return nil
+}
+
+// DeleteOverlay destroys the overlay. The caller must hold wm.mu.
+func (wm *WM) DeleteOverlay(id int) error {
+	o, ok := wm.overlays[id]
+	if !ok {
+		return fmt.Errorf("no overlay %d", id)
+	}
+	delete(wm.overlays, id)
+	wm.unrealizeOverlay(o)
+	wm.emit("overlay.deleted", map[string]interface{}{"overlay": o})
+	return nil
+}
+
+// latin1 encodes the text for core fonts, replacing the characters
+// they can't show.
+func latin1(text string) string {
+	bs := []byte{}
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		bs = append(bs, byte(r))
+	}
+	return string(bs)
+}
+
+// textWidth measures a line of text in the font.
+func (wm *WM) textWidth(font xproto.Font, text string) (int, error) {
+	chars := make([]xproto.Char2b, len(text))
+	for i := 0; i < len(text); i++ {
+		chars[i] = xproto.Char2b{Byte2: text[i]}
+	}
+	extents, err := xproto.QueryTextExtents(
+		wm.xc,
+		xproto.Fontable(font),
+		chars,
+		uint16(len(chars)),
+	).Reply()
+	if err != nil {
+		return 0, err
+	}
+	return int(extents.OverallWidth), nil
+}
+
+// allocColor allocates a colour given as #rgb, #rrggbb, or an X colour
+// name, in the default colormap.
+func (wm *WM) allocColor(spec string) (uint32, error) {
+	cmap := wm.xroot.DefaultColormap
+	if strings.HasPrefix(spec, "#") && (len(spec) == 4 || len(spec) == 7) {
+		v, err := strconv.ParseUint(spec[1:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad colour %q", spec)
+		}
+		var r, g, b uint16
+		if len(spec) == 4 {
+			r, g, b = uint16(v>>8)*0x1111, uint16(v>>4&0xf)*0x1111, uint16(v&0xf)*0x1111
+		} else {
+			r, g, b = uint16(v>>16)*0x101, uint16(v>>8&0xff)*0x101, uint16(v&0xff)*0x101
+		}
+		color, err := xproto.AllocColor(wm.xc, cmap, r, g, b).Reply()
+		if err != nil {
+			return 0, err
+		}
+		return color.Pixel, nil
+	}
+	color, err := xproto.AllocNamedColor(wm.xc, cmap, uint16(len(spec)), spec).Reply()
+	if err != nil {
+		return 0, fmt.Errorf("colour %q: %v", spec, err)
+	}
+	return color.Pixel, nil
+}
+
+// realizeOverlay creates the X resources of the overlay, lays out the
+// text, and maps the window above everything else.
+func (wm *WM) realizeOverlay(o *Overlay) error {
+	if o.Screen >= len(wm.attachedScreens) {
+		return fmt.Errorf("no screen %d", o.Screen)
+	}
+	screen := &wm.attachedScreens[o.Screen]
+	for _, spec := range []string{o.Foreground, o.Background} {
+		pixel, err := wm.allocColor(spec)
+		if err != nil {
+			return err
+		}
+		o.pixels = append(o.pixels, pixel)
+	}
+	fg, bg := o.pixels[0], o.pixels[1]
+
+	var err error
+	if o.font, err = xproto.NewFontId(wm.xc); err != nil {
+		return err
+	}
+	err = xproto.OpenFontChecked(wm.xc, o.font, uint16(len(o.Font)), o.Font).Check()
+	if err != nil && o.Font == defaultOverlayFont {
+		err = xproto.OpenFontChecked(wm.xc, o.font, 5, "fixed").Check()
+	}
+	if err != nil {
+		o.font = 0
+		return fmt.Errorf("font %q: %v", o.Font, err)
+	}
+	info, err := xproto.QueryFont(wm.xc, xproto.Fontable(o.font)).Reply()
+	if err != nil {
+		return err
+	}
+	lineHeight := int(info.FontAscent) + int(info.FontDescent)
+	pad := lineHeight / 2
+
+	// Lay out the lines, centered.
+	texts := strings.Split(latin1(o.Text), "\n")
+	widths := make([]int, len(texts))
+	textW, textH := 0, lineHeight*len(texts)
+	for i, text := range texts {
+		// ImageText8 draws at most 255 characters.
+		if len(text) > 255 {
+			text = text[:255]
+			texts[i] = text
+		}
+		if widths[i], err = wm.textWidth(o.font, text); err != nil {
+			return err
+		}
+		if widths[i] > textW {
+			textW = widths[i]
+		}
+	}
+	var x, y, w, h int
+	if r := o.Region; r != nil {
+		x, y = int(screen.XOrg)+int(r.X), int(screen.YOrg)+int(r.Y)
+		w, h = int(r.W), int(r.H)
+	} else {
+		w, h = textW+2*pad, textH+2*pad
+		sx, sy := int(screen.XOrg), int(screen.YOrg)
+		sw, sh := int(screen.Width), int(screen.Height)
+		x, y = sx+(sw-w)/2, sy+(sh-h)/2
+		switch o.Position {
+		case PositionTop, CornerTopLeft, CornerTopRight:
+			y = sy + pad
+		case PositionBottom, CornerBottomLeft, CornerBottomRight:
+			y = sy + sh - h - pad
+		}
+		switch o.Position {
+		case CornerTopLeft, CornerBottomLeft:
+			x = sx + pad
+		case CornerTopRight, CornerBottomRight:
+			x = sx + sw - w - pad
+		}
+	}
+	o.lines = nil
+	for i, text := range texts {
+		o.lines = append(o.lines, overlayLine{
+			text: text,
+			x:    int16((w - widths[i]) / 2),
+			y:    int16((h-textH)/2 + i*lineHeight + int(info.FontAscent)),
+		})
+	}
+
+	if o.window, err = xproto.NewWindowId(wm.xc); err != nil {
+		return err
+	}
+	if err = xproto.CreateWindowChecked(
+		wm.xc,
+		xproto.WindowClassCopyFromParent, // depth
+		o.window,
+		wm.xroot.Root,
+		int16(x), int16(y), uint16(w), uint16(h),
+		0, // border width
+		xproto.WindowClassInputOutput,
+		xproto.WindowClassCopyFromParent, // visual
+		xproto.CwBackPixel|xproto.CwOverrideRedirect|xproto.CwEventMask,
+		[]uint32{bg, 1, xproto.EventMaskExposure},
+	).Check(); err != nil {
+		o.window = 0
+		return err
+	}
+	if o.gc, err = xproto.NewGcontextId(wm.xc); err != nil {
+		return err
+	}
+	if err = xproto.CreateGCChecked(
+		wm.xc,
+		o.gc,
+		xproto.Drawable(o.window),
+		xproto.GcForeground|xproto.GcBackground|xproto.GcFont,
+		[]uint32{fg, bg, uint32(o.font)},
+	).Check(); err != nil {
+		o.gc = 0
+		return err
+	}
+	if wm.hasXFixes {
+		if err = wm.clickThrough(o.window); err != nil {
+			return err
+		}
+	}
+	if o.Opacity < 1 {
+		xproto.ChangeProperty(
+			wm.xc,
+			xproto.PropModeReplace,
+			o.window,
+			atomNETWMWindowOpacity,
+			xproto.AtomCardinal,
+			32, // format
+			1,
+			encodeUint32s(uint32(o.Opacity*0xffffffff)),
+		)
+	}
+	if err = xproto.MapWindowChecked(wm.xc, o.window).Check(); err != nil {
+		return err
+	}
+	wm.raiseOverlay(o)
+	return nil
+}
+
+// unrealizeOverlay frees the X resources of the overlay.
+func (wm *WM) unrealizeOverlay(o *Overlay) {
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	if o.window != 0 {
+		xproto.DestroyWindow(wm.xc, o.window)
+	}
+	if o.gc != 0 {
+		xproto.FreeGC(wm.xc, o.gc)
+	}
+	if o.font != 0 {
+		xproto.CloseFont(wm.xc, o.font)
+	}
+	if len(o.pixels) > 0 {
+		xproto.FreeColors(wm.xc, wm.xroot.DefaultColormap, 0, o.pixels)
+	}
+	o.window, o.gc, o.font, o.pixels = 0, 0, 0, nil
+}
+
+func (wm *WM) raiseOverlay(o *Overlay) {
+	xproto.ConfigureWindow(
+		wm.xc,
+		o.window,
+		xproto.ConfigWindowStackMode,
+		[]uint32{xproto.StackModeAbove},
+	)
+}
+
+// raiseOverlays puts the overlays back on top, after clients were
+// restacked. The caller must hold wm.mu.
+func (wm *WM) raiseOverlays() {
+	for _, o := range wm.sortedOverlays() {
+		wm.raiseOverlay(o)
+	}
+}
+
+func (wm *WM) sortedOverlays() []*Overlay {
+	overlays := []*Overlay{}
+	for _, o := range wm.overlays {
+		overlays = append(overlays, o)
+	}
+	sort.Slice(overlays, func(i, j int) bool {
+		return overlays[i].ID < overlays[j].ID
+	})
+	return overlays
+}
+
+// handleExposeEvent redraws overlays.
+func (wm *WM) handleExposeEvent(e xproto.ExposeEvent) error {
+	if e.Count > 0 {
+		return nil
+	}
+	for _, o := range wm.overlays {
+		if o.window == e.Window {
+			wm.drawOverlay(o)
+		}
+	}
+	return nil
+}
+
+func (wm *WM) drawOverlay(o *Overlay) {
+	for _, line := range o.lines {
+		xproto.ImageText8(
+			wm.xc,
+			byte(len(line.text)),
+			xproto.Drawable(o.window),
+			o.gc,
+			line.x, line.y,
+			line.text,
+		)
+	}
+}
+
+func (as *APIServer) overlayRoutes(router *mux.Router) {
+	router.HandleFunc("/overlays/", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			jsonResponse(w, r, 200,
+				map[string]interface{}{
+					"items": as.wm.sortedOverlays(),
+				},
+			)
+		case "POST":
+			o := &Overlay{}
+			if err := json.NewDecoder(r.Body).Decode(o); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			o.ID = 0
+			if err := as.wm.ShowOverlay(o); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			jsonResponse(w, r, http.StatusCreated, map[string]interface{}{"item": o})
+		}
+	})).Methods("GET", "POST")
+
+	router.HandleFunc("/overlays/{id:[0-9]+}", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		o, ok := as.wm.overlays[id]
+		if !ok {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			o = &Overlay{}
+			if err := json.NewDecoder(r.Body).Decode(o); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			o.ID = id
+			if err := as.wm.ShowOverlay(o); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			as.wm.DeleteOverlay(id)
+			jsonResponse(w, r, 200, nil)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": o})
+	})).Methods("GET", "PUT", "DELETE")
+}
+
+// clickThrough gives the window an empty input shape, which lets clicks
+// through to the windows below. It needs XFixes.
+func (wm *WM) clickThrough(win xproto.Window) error {
+	region, err := xfixes.NewRegionId(wm.xc)
+	if err != nil {
+		return err
+	}
+	xfixes.CreateRegion(wm.xc, region, nil)
+	xfixes.SetWindowShapeRegion(wm.xc, win, shape.SkInput, 0, 0, region)
+	xfixes.DestroyRegion(wm.xc, region)
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// PlaylistItem is a client shown for a while by a Playlist.
+type PlaylistItem struct {
+	Match    Match    `yaml:"match" json:"match"`
+	Duration Duration `yaml:"duration" json:"duration"`
+}
+
+// Playlist cycles through a list of clients on a screen, showing and
+// raising one at a time, and hiding the rest.
+type Playlist struct {
+	Items []PlaylistItem
+	// Index is the item currently shown.
+	Index int
+	// Paused stops the rotation; Pinned stops it at an item chosen
+	// by the operator.
+	Paused bool
+	Pinned bool
+	// Since is when the current item was shown.
+	Since time.Time
+
+	screen int
+	timer  *time.Timer
+	// remaining is the time left for the current item while paused.
+	remaining time.Duration
+}
+
+func validatePlaylistItems(items []PlaylistItem) error {
+	if len(items) == 0 {
+		return errors.New("empty playlist")
+	}
+	for i := range items {
+		if err := items[i].Match.Validate(); err != nil {
+			return fmt.Errorf("items[%d].match: %v", i, err)
+		}
+		if time.Duration(items[i].Duration) < time.Second {
+			return fmt.Errorf("items[%d].duration: must be at least 1s", i)
+		}
+	}
+	return nil
+}
+
+// SetPlaylist starts a playlist on the screen, replacing any previous
+// one. The caller must hold wm.mu.
+func (wm *WM) SetPlaylist(screen int, items []PlaylistItem) error {
+	if screen < 0 || screen >= len(wm.attachedScreens) {
+		return fmt.Errorf("no screen %d", screen)
+	}
+	if err := validatePlaylistItems(items); err != nil {
+		return err
+	}
+	wm.StopPlaylist(screen)
+	p := &Playlist{Items: items, screen: screen}
+	wm.playlists[screen] = p
+	wm.playlistShow(p, 0)
+	return nil
+}
+
+// StopPlaylist stops the playlist on the screen, if any. Clients are
+// left as they are. The caller must hold wm.mu.
+func (wm *WM) StopPlaylist(screen int) {
+	if p, ok := wm.playlists[screen]; ok {
+		p.stopTimer()
+		delete(wm.playlists, screen)
+	}
+}
+
+// StepPlaylist shows the item step items away from the current one on
+// the screen's playlist, like skipping it through the API: the
+// playlist is unpinned, and keeps rotating from there. The caller
+// must hold wm.mu.
+func (wm *WM) StepPlaylist(screen, step int) error {
+	p, ok := wm.playlists[screen]
+	if !ok {
+		return fmt.Errorf("no playlist on screen %d", screen)
+	}
+	p.Pinned = false
+	n := len(p.Items)
+	wm.playlistShow(p, ((p.Index+step)%n+n)%n)
+	return nil
+}
+
+func (p *Playlist) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// playlistShow shows the item at index, or the next item after it
+// that has a matching client, and schedules the next advance. The
+// caller must hold wm.mu.
+func (wm *WM) playlistShow(p *Playlist, index int) {
+	p.stopTimer()
+	var c *Client
+	for i := 0; i < len(p.Items); i++ {
+		n := (index + i) % len(p.Items)
+		if c = wm.FindClient(&p.Items[n].Match); c != nil {
+			index = n
+			break
+		}
+		if p.Pinned {
+			break
+		}
+	}
+	p.Index = index % len(p.Items)
+	p.Since = time.Now()
+	p.remaining = time.Duration(p.Items[p.Index].Duration)
+	if c != nil {
+		if err := wm.playlistPresent(p, c); err != nil {
+			log.Printf("playlist on screen %d: %v", p.screen, err)
+		}
+	}
+	wm.emit("playlist.advanced", map[string]interface{}{
+		"screen":   p.screen,
+		"index":    p.Index,
+		"client":   c,
+		"clientID": clientID(c),
+	})
+	if !p.Paused && !p.Pinned {
+		wm.playlistSchedule(p, p.remaining)
+	}
+}
+
+// playlistPresent makes c the only visible client of the playlist,
+// fullscreen on its screen, and on top.
+func (wm *WM) playlistPresent(p *Playlist, c *Client) error {
+	c.MakeFullscreen(&wm.attachedScreens[p.screen])
+	c.StackMode = xproto.StackModeAbove
+	if err := c.Configure(); err != nil {
+		return err
+	}
+	if err := wm.ShowClient(c); err != nil {
+		return err
+	}
+	// Hide the others only once the new one is up, so that the
+	// screen does not flash.
+	for i := range p.Items {
+		for _, other := range wm.FindClients(&p.Items[i].Match) {
+			if other != c && other.Visible {
+				if err := wm.HideClient(other); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (wm *WM) playlistSchedule(p *Playlist, d time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		wm.mu.Lock()
+		defer wm.mu.Unlock()
+		if p.timer != timer {
+			// Stopped or rescheduled in the meantime.
+			return
+		}
+		wm.playlistShow(p, p.Index+1)
+	})
+	p.timer = timer
+}
+
+// pausePlaylist stops the rotation, remembering the time left for the
+// current item.
+func (wm *WM) pausePlaylist(p *Playlist) {
+	if p.Paused {
+		return
+	}
+	p.Paused = true
+	if p.timer != nil {
+		p.stopTimer()
+		p.remaining -= time.Since(p.Since)
+	}
+}
+
+// resumePlaylist restarts the rotation, showing the current item for
+// the rest of its time.
+func (wm *WM) resumePlaylist(p *Playlist) {
+	if !p.Paused {
+		return
+	}
+	p.Paused = false
+	if !p.Pinned {
+		p.Since = time.Now()
+		wm.playlistSchedule(p, p.remaining)
+	}
+}
+
+// playlistHides reports whether a new client should start hidden,
+// because it belongs to a playlist but is not its current item.
+func (wm *WM) playlistHides(c *Client) bool {
+	for _, p := range wm.playlists {
+		for i := range p.Items {
+			if p.Items[i].Match.Matches(c) {
+				return i != p.Index || wm.FindClient(&p.Items[i].Match) != c
+			}
+		}
+	}
+	return false
+}
+
+func (as *APIServer) playlistRoutes(router *mux.Router) {
+	getPlaylist := func(w http.ResponseWriter, r *http.Request) *Playlist {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		p, ok := as.wm.playlists[n]
+		if !ok {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return nil
+		}
+		return p
+	}
+
+	router.HandleFunc("/screens/{n:[0-9]+}/playlist", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var data struct{ Items []PlaylistItem }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.SetPlaylist(n, data.Items); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			as.wm.StopPlaylist(n)
+			jsonResponse(w, r, 200, nil)
+			return
+		}
+		if p := getPlaylist(w, r); p != nil {
+			jsonResponse(w, r, 200, map[string]interface{}{"item": p})
+		}
+	})).Methods("GET", "PUT", "DELETE")
+
+	router.HandleFunc("/screens/{n:[0-9]+}/playlist/{action:pause|resume|skip}", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		p := getPlaylist(w, r)
+		if p == nil {
+			return
+		}
+		switch mux.Vars(r)["action"] {
+		case "pause":
+			as.wm.pausePlaylist(p)
+		case "resume":
+			as.wm.resumePlaylist(p)
+		case "skip":
+			p.Pinned = false
+			as.wm.playlistShow(p, p.Index+1)
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": p})
+	})).Methods("POST")
+
+	router.HandleFunc("/screens/{n:[0-9]+}/playlist/pin", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		p := getPlaylist(w, r)
+		if p == nil {
+			return
+		}
+		switch r.Method {
+		case "POST":
+			var data struct{ Index int }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if data.Index < 0 || data.Index >= len(p.Items) {
+				errorResponse(w, r, http.StatusUnprocessableEntity,
+					fmt.Errorf("no item %d", data.Index))
+				return
+			}
+			p.Pinned = true
+			as.wm.playlistShow(p, data.Index)
+		case "DELETE":
+			if p.Pinned {
+				p.Pinned = false
+				as.wm.playlistShow(p, p.Index+1)
+			}
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": p})
+	})).Methods("POST", "DELETE")
+}
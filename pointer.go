@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// PointerConfinement keeps the pointer inside a screen or a client,
+// with XFixes pointer barriers around it. Barriers only hold relative
+// devices, like mice; touchscreens are kept on their screen by their
+// coordinate transformation matrix instead.
+type PointerConfinement struct {
+	Screen *int `yaml:"screen" json:"screen,omitempty"`
+	// Client can only be set through the API.
+	Client xproto.Window `yaml:"-" json:"client,omitempty"`
+}
+
+// Validate checks that the confinement has exactly one target.
+func (pc *PointerConfinement) Validate() error {
+	if (pc.Screen == nil) == (pc.Client == 0) {
+		return errors.New("needs either a screen or a client")
+	}
+	if pc.Screen != nil && *pc.Screen < 0 {
+		return fmt.Errorf("bad screen %d", *pc.Screen)
+	}
+	return nil
+}
+
+// pointerRect returns the area of a screen or client, in root window
+// coordinates.
+func (wm *WM) pointerRect(screen *int, c *Client) (xproto.Rectangle, error) {
+	if c != nil {
+		return xproto.Rectangle{X: c.X, Y: c.Y, Width: c.W, Height: c.H}, nil
+	}
+	if *screen >= len(wm.attachedScreens) {
+		return xproto.Rectangle{}, fmt.Errorf("no screen %d", *screen)
+	}
+	s := &wm.attachedScreens[*screen]
+	return xproto.Rectangle{X: s.XOrg, Y: s.YOrg, Width: s.Width, Height: s.Height}, nil
+}
+
+// WarpPointer moves the pointer to x and y, relative to the screen or
+// the client if given, or else to the root window. The caller must
+// hold wm.mu.
+func (wm *WM) WarpPointer(x, y int16, screen *int, c *Client) error {
+	if c != nil {
+		return c.WarpPointer(x, y)
+	}
+	if screen != nil {
+		r, err := wm.pointerRect(screen, nil)
+		if err != nil {
+			return err
+		}
+		x, y = r.X+x, r.Y+y
+	}
+	return xproto.WarpPointerChecked(
+		wm.xc,
+		0,             // src
+		wm.xroot.Root, // dst
+		0, 0, 0, 0,    // src x, y, w, h
+		x, y,
+	).Check()
+}
+
+// ConfinePointer keeps the pointer inside the screen or client, or
+// lets it go if pc is nil. The caller must hold wm.mu.
+func (wm *WM) ConfinePointer(pc *PointerConfinement) error {
+	if pc != nil {
+		if err := pc.Validate(); err != nil {
+			return err
+		}
+		if !wm.hasBarriers {
+			return errors.New("Pointer barriers need XFIXES 5")
+		}
+		if pc.Client != 0 && wm.GetClient(pc.Client) == nil {
+			return fmt.Errorf("no client %d", pc.Client)
+		}
+	}
+	old := wm.pointerConfinement
+	wm.pointerConfinement = pc
+	if err := wm.updateConfinement(); err != nil {
+		wm.pointerConfinement = old
+		wm.updateConfinement()
+		return err
+	}
+	if pc != nil {
+		wm.emit("pointer.confined", map[string]interface{}{
+			"confinement": pc,
+			"rect":        wm.confinedTo,
+		})
+	} else if old != nil {
+		wm.emit("pointer.released", nil)
+	}
+	return nil
+}
+
+// updateConfinement puts the barriers around the confinement area,
+// after it was set or moved, and brings the pointer into it. The
+// caller must hold wm.mu.
+func (wm *WM) updateConfinement() error {
+	pc := wm.pointerConfinement
+	var r xproto.Rectangle
+	if pc != nil {
+		var err error
+		if r, err = wm.pointerRect(pc.Screen, wm.GetClient(pc.Client)); err != nil {
+			return err
+		}
+		// Barriers take unsigned coordinates, and the pointer
+		// can't leave the root window anyway.
+		r = wm.clampToRoot(r)
+		if len(wm.barriers) > 0 && r == wm.confinedTo {
+			return nil
+		}
+	}
+	for _, b := range wm.barriers {
+		xfixes.DeletePointerBarrier(wm.xc, b)
+	}
+	wm.barriers = nil
+	wm.confinedTo = r
+	if pc == nil || r.Width == 0 || r.Height == 0 {
+		return nil
+	}
+	// Pointers moving out are stopped on the last pixel inside.
+	x0, y0 := uint16(r.X), uint16(r.Y)
+	x1, y1 := x0+r.Width, y0+r.Height
+	for _, line := range [][4]uint16{
+		{x0, y0, x1, y0}, // top
+		{x0, y1, x1, y1}, // bottom
+		{x0, y0, x0, y1}, // left
+		{x1, y0, x1, y1}, // right
+	} {
+		b, err := xfixes.NewBarrierId(wm.xc)
+		if err != nil {
+			return err
+		}
+		if err = xfixes.CreatePointerBarrierChecked(
+			wm.xc,
+			b,
+			wm.xroot.Root,
+			line[0], line[1], line[2], line[3],
+			0,      // directions: block both ways
+			0, nil, // all devices
+		).Check(); err != nil {
+			return err
+		}
+		wm.barriers = append(wm.barriers, b)
+	}
+	pointer, err := xproto.QueryPointer(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		return err
+	}
+	if pointer.RootX < r.X || pointer.RootX >= r.X+int16(r.Width) ||
+		pointer.RootY < r.Y || pointer.RootY >= r.Y+int16(r.Height) {
+		return wm.WarpPointer(r.X+int16(r.Width/2), r.Y+int16(r.Height/2), nil, nil)
+	}
+	return nil
+}
+
+// clampToRoot returns the part of r that is on the root window, or an
+// empty rectangle if there is none.
+func (wm *WM) clampToRoot(r xproto.Rectangle) xproto.Rectangle {
+	x0, y0 := int(r.X), int(r.Y)
+	x1, y1 := x0+int(r.Width), y0+int(r.Height)
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if w := int(wm.xroot.WidthInPixels); x1 > w {
+		x1 = w
+	}
+	if h := int(wm.xroot.HeightInPixels); y1 > h {
+		y1 = h
+	}
+	if x1 <= x0 || y1 <= y0 {
+		return xproto.Rectangle{}
+	}
+	return xproto.Rectangle{
+		X: int16(x0), Y: int16(y0),
+		Width: uint16(x1 - x0), Height: uint16(y1 - y0),
+	}
+}
+
+// forgetConfinement lets the pointer go if it was confined to a client
+// that went away. The caller must hold wm.mu.
+func (wm *WM) forgetConfinement(c *Client) {
+	if pc := wm.pointerConfinement; pc != nil && c != nil && pc.Client == c.window {
+		if err := wm.ConfinePointer(nil); err != nil {
+			log.Printf("releasing pointer: %v", err)
+		}
+	}
+}
+
+func (as *APIServer) pointerRoutes(router *mux.Router) {
+	router.HandleFunc("/input/pointer", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		pointer, err := xproto.QueryPointer(as.wm.xc, as.wm.xroot.Root).Reply()
+		if err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"x":           pointer.RootX,
+			"y":           pointer.RootY,
+			"screen":      as.wm.screenAt(pointer.RootX, pointer.RootY),
+			"confinement": as.wm.pointerConfinement,
+		})
+	})).Methods("GET")
+
+	router.HandleFunc("/input/pointer/warp", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		// X and Y are relative to the screen or client, if given.
+		var data struct {
+			X, Y   int16
+			Screen *int
+			Client xproto.Window
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		var c *Client
+		if data.Client != 0 {
+			if c = as.wm.GetClient(data.Client); c == nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity,
+					fmt.Errorf("no client %d", data.Client))
+				return
+			}
+		}
+		if c != nil && data.Screen != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity,
+				errors.New("Screen and Client are exclusive"))
+			return
+		}
+		if err := as.wm.WarpPointer(data.X, data.Y, data.Screen, c); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		jsonResponse(w, r, 200, nil)
+	})).Methods("POST")
+
+	router.HandleFunc("/input/pointer/confine", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			pc := &PointerConfinement{}
+			if err := json.NewDecoder(r.Body).Decode(pc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.ConfinePointer(pc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			if err := as.wm.ConfinePointer(nil); err != nil {
+				errorResponse(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			jsonResponse(w, r, 200, nil)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{
+			"item": as.wm.pointerConfinement,
+			"rect": as.wm.confinedTo,
+		})
+	})).Methods("GET", "PUT", "DELETE")
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BurntSushi/xgb/dpms"
+	"github.com/BurntSushi/xgb/screensaver"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// dpmsLevels maps the API names of DPMS power levels.
+var dpmsLevels = map[string]uint16{
+	"on":      dpms.DPMSModeOn,
+	"standby": dpms.DPMSModeStandby,
+	"suspend": dpms.DPMSModeSuspend,
+	"off":     dpms.DPMSModeOff,
+}
+
+var errorNoDPMS = errors.New("DPMS is not available")
+
+// PowerConfig controls display blanking and power saving.
+type PowerConfig struct {
+	// DisableBlanking turns off the X screen saver and DPMS, so
+	// that the displays never blank on their own.
+	DisableBlanking bool `yaml:"disable_blanking" json:"disable_blanking"`
+	// Timeouts is applied on startup if set.
+	Timeouts *PowerTimeouts `yaml:"timeouts" json:"timeouts"`
+}
+
+// PowerTimeouts are the times of inactivity after which the screen
+// saver activates, and the displays enter DPMS power saving levels.
+// Zero disables the level.
+type PowerTimeouts struct {
+	Saver   Duration `yaml:"saver" json:"saver"`
+	Standby Duration `yaml:"standby" json:"standby"`
+	Suspend Duration `yaml:"suspend" json:"suspend"`
+	Off     Duration `yaml:"off" json:"off"`
+}
+
+// PowerStatus is the display power state, as reported by the API.
+type PowerStatus struct {
+	// DPMS is set if the server supports DPMS.
+	DPMS bool
+	// Enabled is set if DPMS power saving is enabled.
+	Enabled  bool
+	Level    string
+	Timeouts PowerTimeouts
+	// SaverActive is set while the screen saver is on.
+	SaverActive bool
+}
+
+// initPower initializes the DPMS and MIT-SCREEN-SAVER extensions, and
+// subscribes to screen saver notifications. Their absence is not
+// fatal; power control just won't work.
+func (wm *WM) initPower() error {
+	if err := dpms.Init(wm.xc); err != nil {
+		log.Printf("DPMS: %v", err)
+	} else {
+		capable, err := dpms.Capable(wm.xc).Reply()
+		if err != nil {
+			return err
+		}
+		wm.hasDPMS = capable.Capable
+	}
+	if err := screensaver.Init(wm.xc); err != nil {
+		log.Printf("MIT-SCREEN-SAVER: %v", err)
+		return nil
+	}
+	wm.hasScreenSaver = true
+	return screensaver.SelectInputChecked(
+		wm.xc,
+		xproto.Drawable(wm.xroot.Root),
+		screensaver.EventNotifyMask|screensaver.EventCycleMask,
+	).Check()
+}
+
+// SetPowerLevel forces the displays into a DPMS power level.
+//
+// ForceLevel fails unless DPMS is enabled. If it was disabled, like
+// with disable_blanking, it is only enabled to hold the displays at a
+// lower level, with its timeouts cleared, so that it doesn't blank
+// them on its own once input woke them. It is disabled again, which
+// turns the displays on, for level "on".
+func (wm *WM) SetPowerLevel(level string) error {
+	if !wm.hasDPMS {
+		return errorNoDPMS
+	}
+	mode, ok := dpmsLevels[level]
+	if !ok {
+		return fmt.Errorf("bad DPMS level %q", level)
+	}
+	info, err := dpms.Info(wm.xc).Reply()
+	if err != nil {
+		return err
+	}
+	switch {
+	case mode == dpms.DPMSModeOn && wm.dpmsHeld != nil:
+		if err := wm.releaseDPMS(); err != nil {
+			return err
+		}
+	case mode == dpms.DPMSModeOn && !info.State:
+		// Displays are on while DPMS is disabled.
+	default:
+		if !info.State {
+			timeouts, err := dpms.GetTimeouts(wm.xc).Reply()
+			if err != nil {
+				return err
+			}
+			if err := dpms.SetTimeoutsChecked(wm.xc, 0, 0, 0).Check(); err != nil {
+				return err
+			}
+			wm.dpmsHeld = timeouts
+			if err := dpms.EnableChecked(wm.xc).Check(); err != nil {
+				return err
+			}
+		}
+		if err := dpms.ForceLevelChecked(wm.xc, mode).Check(); err != nil {
+			return err
+		}
+	}
+	wm.emit("power.level", map[string]interface{}{"level": level})
+	return nil
+}
+
+// releaseDPMS disables DPMS after it was enabled to hold a power level,
+// and puts its timeouts back.
+func (wm *WM) releaseDPMS() error {
+	if err := wm.restoreDPMSTimeouts(); err != nil {
+		return err
+	}
+	return dpms.DisableChecked(wm.xc).Check()
+}
+
+// restoreDPMSTimeouts puts back the DPMS timeouts cleared to hold a
+// power level, if they were.
+func (wm *WM) restoreDPMSTimeouts() error {
+	t := wm.dpmsHeld
+	if t == nil {
+		return nil
+	}
+	wm.dpmsHeld = nil
+	return dpms.SetTimeoutsChecked(wm.xc,
+		t.StandbyTimeout, t.SuspendTimeout, t.OffTimeout).Check()
+}
+
+// GetPowerStatus queries the current DPMS and screen saver state.
+func (wm *WM) GetPowerStatus() (*PowerStatus, error) {
+	status := &PowerStatus{DPMS: wm.hasDPMS}
+	saver, err := xproto.GetScreenSaver(wm.xc).Reply()
+	if err != nil {
+		return nil, err
+	}
+	status.Timeouts.Saver = Duration(time.Duration(saver.Timeout) * time.Second)
+	if wm.hasScreenSaver {
+		info, err := screensaver.QueryInfo(wm.xc, xproto.Drawable(wm.xroot.Root)).Reply()
+		if err != nil {
+			return nil, err
+		}
+		status.SaverActive = info.State == screensaver.StateOn ||
+			info.State == screensaver.StateCycle
+	}
+	if !wm.hasDPMS {
+		return status, nil
+	}
+	info, err := dpms.Info(wm.xc).Reply()
+	if err != nil {
+		return nil, err
+	}
+	status.Enabled = info.State
+	for name, level := range dpmsLevels {
+		if level == info.PowerLevel {
+			status.Level = name
+		}
+	}
+	timeouts, err := dpms.GetTimeouts(wm.xc).Reply()
+	if err != nil {
+		return nil, err
+	}
+	status.Timeouts.Standby = Duration(time.Duration(timeouts.StandbyTimeout) * time.Second)
+	status.Timeouts.Suspend = Duration(time.Duration(timeouts.SuspendTimeout) * time.Second)
+	status.Timeouts.Off = Duration(time.Duration(timeouts.OffTimeout) * time.Second)
+	return status, nil
+}
+
+func durationSeconds(d Duration) (uint16, error) {
+	s := time.Duration(d) / time.Second
+	if s < 0 || s > 32767 {
+		return 0, fmt.Errorf("timeout %v out of range", time.Duration(d))
+	}
+	return uint16(s), nil
+}
+
+// SetPowerTimeouts sets the screen saver and DPMS timeouts.
+func (wm *WM) SetPowerTimeouts(t *PowerTimeouts) error {
+	saver, err := durationSeconds(t.Saver)
+	if err != nil {
+		return err
+	}
+	standby, err := durationSeconds(t.Standby)
+	if err != nil {
+		return err
+	}
+	suspend, err := durationSeconds(t.Suspend)
+	if err != nil {
+		return err
+	}
+	off, err := durationSeconds(t.Off)
+	if err != nil {
+		return err
+	}
+	current, err := xproto.GetScreenSaver(wm.xc).Reply()
+	if err != nil {
+		return err
+	}
+	if err = xproto.SetScreenSaverChecked(
+		wm.xc,
+		int16(saver),            // timeout
+		int16(current.Interval), // interval
+		current.PreferBlanking,  // prefer blanking
+		current.AllowExposures,  // allow exposures
+	).Check(); err != nil {
+		return err
+	}
+	if !wm.hasDPMS {
+		return nil
+	}
+	if t := wm.dpmsHeld; t != nil {
+		// They apply once DPMS no longer holds a power level.
+		t.StandbyTimeout, t.SuspendTimeout, t.OffTimeout = standby, suspend, off
+		return nil
+	}
+	return dpms.SetTimeoutsChecked(wm.xc, standby, suspend, off).Check()
+}
+
+// SetBlanking enables or disables the X screen saver and DPMS power
+// saving. Enabling restores the server's default screen saver
+// settings.
+func (wm *WM) SetBlanking(enabled bool) error {
+	var err error
+	if enabled {
+		err = xproto.SetScreenSaverChecked(wm.xc, -1, -1,
+			xproto.BlankingDefault, xproto.ExposuresDefault).Check()
+	} else {
+		err = xproto.SetScreenSaverChecked(wm.xc, 0, 0,
+			xproto.BlankingNotPreferred, xproto.ExposuresDefault).Check()
+	}
+	if err != nil || !wm.hasDPMS {
+		return err
+	}
+	if err := wm.restoreDPMSTimeouts(); err != nil {
+		return err
+	}
+	if enabled {
+		return dpms.EnableChecked(wm.xc).Check()
+	}
+	return dpms.DisableChecked(wm.xc).Check()
+}
+
+// ForceScreenSaver activates the screen saver, or deactivates it as
+// if there was user input.
+func (wm *WM) ForceScreenSaver(active bool) error {
+	mode := byte(xproto.ScreenSaverReset)
+	if active {
+		mode = xproto.ScreenSaverActive
+	}
+	return xproto.ForceScreenSaverChecked(wm.xc, mode).Check()
+}
+
+// applyPowerConfig applies the power section of the running config.
+func (wm *WM) applyPowerConfig() error {
+	cfg := &wm.config.Power
+	if cfg.Timeouts != nil {
+		if err := wm.SetPowerTimeouts(cfg.Timeouts); err != nil {
+			return err
+		}
+	}
+	if cfg.DisableBlanking {
+		return wm.SetBlanking(false)
+	}
+	return nil
+}
+
+func (wm *WM) handleScreenSaverNotifyEvent(e screensaver.NotifyEvent) error {
+	switch e.State {
+	case screensaver.StateOn, screensaver.StateCycle:
+		wm.emit("screensaver.on", map[string]interface{}{"forced": e.Forced})
+	case screensaver.StateOff:
+		wm.emit("screensaver.off", map[string]interface{}{"forced": e.Forced})
+	}
+	return nil
+}
+
+func (as *APIServer) powerRoutes(router *mux.Router) {
+	statusResponse := func(w http.ResponseWriter, r *http.Request) {
+		status, err := as.wm.GetPowerStatus()
+		if err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": status})
+	}
+
+	router.HandleFunc("/screens/power", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			var data struct{ Level string }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.SetPowerLevel(data.Level); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		statusResponse(w, r)
+	})).Methods("GET", "PUT")
+
+	router.HandleFunc("/screens/power/timeouts", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		var data PowerTimeouts
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := as.wm.SetPowerTimeouts(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		statusResponse(w, r)
+	})).Methods("PUT")
+
+	router.HandleFunc("/screens/power/blanking", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Enabled bool }
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := as.wm.SetBlanking(data.Enabled); err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		statusResponse(w, r)
+	})).Methods("PUT")
+
+	router.HandleFunc("/screens/power/saver", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		var data struct{ Active bool }
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			errorResponse(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := as.wm.ForceScreenSaver(data.Active); err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		statusResponse(w, r)
+	})).Methods("PUT")
+}
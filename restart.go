@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// Environment variables used to hand state over to the new process
+// during an in-place restart.
+const (
+	envRestartState = "HEADLESS_WM_RESTART_STATE"
+	envListenFDs    = "HEADLESS_WM_LISTEN_FDS"
+)
+
+// restartState is the WM state carried over an in-place restart.
+type restartState struct {
+	Clients      map[xproto.Window]*Client
+	ActiveClient xproto.Window
+	Layout       []*ClientLayout
+	EventSeq     uint64
+	EventHistory []json.RawMessage
+	Apps         []*App
+}
+
+// checkExecutable returns an error if path is not an executable file.
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s: not an executable file", path)
+	}
+	return nil
+}
+
+// Restart serializes the WM state, and re-executes the WM binary at
+// path (or the current binary, if path is empty) in place. The
+// listening sockets are inherited by the new process, so API clients
+// only see a brief pause. Restart only returns on error. The caller
+// must hold wm.mu.
+func (wm *WM) Restart(path string) (err error) {
+	if path == "" {
+		if path, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	if err = checkExecutable(path); err != nil {
+		return err
+	}
+
+	state := &restartState{
+		Clients: wm.clients,
+		Apps:    []*App{},
+	}
+	if wm.activeClient != nil {
+		state.ActiveClient = wm.activeClient.window
+	}
+	for _, l := range wm.layout {
+		state.Layout = append(state.Layout, l)
+	}
+	for _, app := range wm.apps {
+		state.Apps = append(state.Apps, app)
+	}
+	wm.emit("wm.restart", map[string]interface{}{"path": path})
+	state.EventSeq, state.EventHistory = wm.events.snapshot()
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "headless-wm-restart-*.json")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	// Hand the listening sockets over. The files must stay open
+	// until exec.
+	fds := []string{}
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if wm.api != nil {
+		for addr, l := range wm.api.listeners {
+			tl, ok := l.(*net.TCPListener)
+			if !ok {
+				continue
+			}
+			lf, err := tl.File()
+			if err != nil {
+				return err
+			}
+			files = append(files, lf)
+			if _, _, errno := syscall.Syscall(
+				syscall.SYS_FCNTL, lf.Fd(), syscall.F_SETFD, 0,
+			); errno != 0 {
+				return errno
+			}
+			fds = append(fds, fmt.Sprintf("%s=%d", addr, lf.Fd()))
+		}
+	}
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envRestartState+"=") &&
+			!strings.HasPrefix(kv, envListenFDs+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envRestartState+"="+f.Name(),
+		envListenFDs+"="+strings.Join(fds, ","),
+	)
+	argv := append([]string{path}, os.Args[1:]...)
+	log.Printf("restarting: %s", path)
+	return syscall.Exec(path, argv, env)
+}
+
+// loadRestartState reads the state left behind by Restart, if we
+// were started by one. The state file and environment are cleaned up,
+// so that apps we launch don't see them.
+func loadRestartState() (*restartState, string, error) {
+	path := os.Getenv(envRestartState)
+	fds := os.Getenv(envListenFDs)
+	os.Unsetenv(envRestartState)
+	os.Unsetenv(envListenFDs)
+	if path == "" {
+		return nil, fds, nil
+	}
+	defer os.Remove(path)
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fds, err
+	}
+	state := &restartState{}
+	if err = json.Unmarshal(bs, state); err != nil {
+		return nil, fds, err
+	}
+	return state, fds, nil
+}
+
+// inheritListeners starts serving on the listening sockets handed
+// over by Restart. spec is a comma-separated list of addr=fd.
+func (as *APIServer) inheritListeners(spec string) {
+	if spec == "" {
+		return
+	}
+	as.wm.mu.Lock()
+	defer as.wm.mu.Unlock()
+	for _, item := range strings.Split(spec, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+		addr := item[:i]
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			log.Printf("bad inherited listener %q", item)
+			continue
+		}
+		f := os.NewFile(uintptr(fd), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("inherited listener %s: %v", addr, err)
+			continue
+		}
+		log.Printf("Listening on http://%s (inherited)", addr)
+		as.listeners[addr] = l
+		go as.serve(l)
+	}
+}
+
+// rehydrate applies the state carried over a restart, once the
+// existing windows have been adopted. The caller must hold wm.mu.
+func (wm *WM) rehydrate(state *restartState) {
+	for _, l := range state.Layout {
+		wm.layout[l.key()] = l
+	}
+	for win, saved := range state.Clients {
+		c := wm.GetClient(win)
+		if c == nil {
+			continue
+		}
+		c.X, c.Y, c.W, c.H = saved.X, saved.Y, saved.W, saved.H
+		c.StackMode = saved.StackMode
+		c.Layer = saved.Layer
+		if saved.OpacitySet {
+			c.Opacity, c.OpacitySet = saved.Opacity, true
+		}
+		// A fade may have been cut short by the restart. Without
+		// fades, an opacity the WM never set is the client's own.
+		if c.OpacitySet || wm.config.Fade.In > 0 || wm.config.Fade.Out > 0 {
+			if err := c.writeOpacity(c.Opacity); err != nil {
+				log.Printf("restoring client %d: %v", win, err)
+			}
+		}
+		c.Visible = saved.Visible
+		if err := c.Configure(); err != nil {
+			log.Printf("restoring client %d: %v", win, err)
+		}
+	}
+	if c := wm.GetClient(state.ActiveClient); c != nil {
+		if err := wm.FocusClient(c, xproto.TimeCurrentTime); err != nil {
+			log.Printf("restoring focus: %v", err)
+		}
+	}
+	wm.events.restore(state.EventSeq, state.EventHistory)
+	for _, app := range state.Apps {
+		if _, ok := wm.apps[app.Name]; !ok {
+			wm.adoptApp(app)
+		}
+	}
+}
+
+// initWMRetrying calls initWM, retrying for a short while if another
+// WM is running. This covers the previous instance of ourselves
+// still being torn down by the X server after a restart.
+func (wm *WM) initWMRetrying() (err error) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err = wm.initWM()
+		if !errors.Is(err, errorAnotherWM) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
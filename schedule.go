@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// schedulerTick is how often the scheduler checks for due schedules.
+const schedulerTick = 1 * time.Second
+
+// Schedule sources.
+const (
+	ScheduleFromConfig = "config"
+	ScheduleFromAPI    = "api"
+)
+
+// Schedule runs a list of actions at times given by a cron
+// expression.
+//
+// Execution is deterministic when the wall clock jumps: each schedule
+// remembers its next run time, and runs once when the clock reaches
+// it. If the clock jumps forward over several run times, the schedule
+// runs only once, and its next run time is computed from the new
+// time. If the clock jumps backward, run times that have already been
+// run are not repeated. Due schedules run in order of their names.
+type Schedule struct {
+	Name string `yaml:"name" json:"name"`
+	// Cron is a five-field cron expression, or a macro like
+	// "@daily".
+	Cron string `yaml:"cron" json:"cron"`
+	// Timezone is an IANA time zone name, like "Europe/Warsaw".
+	// Defaults to the config's timezone.
+	Timezone string   `yaml:"timezone" json:"timezone,omitempty"`
+	Actions  []Action `yaml:"actions" json:"actions"`
+
+	Source    string    `yaml:"-" json:"source"`
+	LastRun   time.Time `yaml:"-" json:"lastRun"`
+	NextRun   time.Time `yaml:"-" json:"nextRun"`
+	LastError string    `yaml:"-" json:"lastError"`
+
+	spec *cronSpec
+	loc  *time.Location
+}
+
+// Validate checks the schedule against the config it will run with.
+func (s *Schedule) Validate(cfg *Config) error {
+	if s.Name == "" {
+		return errors.New("missing name")
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	tz := s.Timezone
+	if tz == "" {
+		tz = cfg.Timezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return err
+	}
+	if len(s.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for i := range s.Actions {
+		if err := s.Actions[i].Validate(cfg); err != nil {
+			return fmt.Errorf("actions[%d]: %v", i, err)
+		}
+	}
+	s.spec, s.loc = spec, loc
+	return nil
+}
+
+// SetSchedule adds or replaces a schedule. The caller must hold
+// wm.mu.
+func (wm *WM) SetSchedule(s *Schedule) error {
+	return wm.setSchedule(s, wm.schedules[s.Name])
+}
+
+// setSchedule adds a schedule, which replaces prev, if not nil. The
+// last run time is kept, and so is the next one if the timing did not
+// change, so that a clock jump has the same effect with a reload in
+// between. The caller must hold wm.mu.
+func (wm *WM) setSchedule(s, prev *Schedule) error {
+	if err := s.Validate(wm.config); err != nil {
+		return fmt.Errorf("schedule %q: %v", s.Name, err)
+	}
+	s.NextRun = s.spec.Next(time.Now().In(s.loc))
+	if prev != nil {
+		s.LastRun = prev.LastRun
+		if prev.Cron == s.Cron && prev.loc.String() == s.loc.String() {
+			s.NextRun = prev.NextRun
+		}
+	}
+	wm.schedules[s.Name] = s
+	return nil
+}
+
+// updateSchedules replaces the schedules from the config with the
+// ones in the running config. Schedules created through the API are
+// kept, unless the config has one with the same name. The caller must
+// hold wm.mu.
+func (wm *WM) updateSchedules() {
+	old := wm.schedules
+	wm.schedules = map[string]*Schedule{}
+	for name, s := range old {
+		if s.Source != ScheduleFromConfig {
+			wm.schedules[name] = s
+		}
+	}
+	for i := range wm.config.Schedules {
+		s := wm.config.Schedules[i]
+		s.Source = ScheduleFromConfig
+		if err := wm.setSchedule(&s, old[s.Name]); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// runScheduler runs due schedules until the WM exits.
+func (wm *WM) runScheduler() {
+	for now := range time.NewTicker(schedulerTick).C {
+		wm.mu.Lock()
+		// Schedules that come due in maintenance mode run once
+		// it ends, like after a clock jump.
+		if wm.maintenance == nil {
+			wm.runDueSchedules(now)
+		}
+		wm.mu.Unlock()
+	}
+}
+
+// runDueSchedules runs the schedules whose next run time is not after
+// now. The caller must hold wm.mu.
+func (wm *WM) runDueSchedules(now time.Time) {
+	// Compare wall clock times; the monotonic clock does not
+	// follow clock changes.
+	now = now.Round(0)
+	names := []string{}
+	for name, s := range wm.schedules {
+		if !s.NextRun.IsZero() && !s.NextRun.After(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := wm.schedules[name]
+		s.LastRun = now
+		s.NextRun = s.spec.Next(now.In(s.loc))
+		err := wm.runActions(s.Actions)
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+			log.Printf("schedule %q: %v", name, err)
+		}
+		wm.emit("schedule.run", map[string]interface{}{
+			"schedule": s,
+		})
+	}
+}
+
+func (as *APIServer) scheduleRoutes(router *mux.Router) {
+	router.HandleFunc("/schedules/", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			jsonResponse(w, r, 200,
+				map[string]interface{}{
+					"items": as.wm.schedules,
+				},
+			)
+		case "POST":
+			s := &Schedule{}
+			if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if _, ok := as.wm.schedules[s.Name]; ok {
+				errorResponse(w, r, http.StatusConflict,
+					fmt.Errorf("schedule %q exists", s.Name))
+				return
+			}
+			s.Source = ScheduleFromAPI
+			if err := as.wm.SetSchedule(s); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			jsonResponse(w, r, http.StatusCreated, map[string]interface{}{"item": s})
+		}
+	})).Methods("GET", "POST")
+
+	router.HandleFunc("/schedules/{name}", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		s, ok := as.wm.schedules[name]
+		if !ok && r.Method != "PUT" {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			s = &Schedule{}
+			if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			s.Name = name
+			s.Source = ScheduleFromAPI
+			if err := as.wm.SetSchedule(s); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		case "DELETE":
+			delete(as.wm.schedules, name)
+			jsonResponse(w, r, 200, nil)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": s})
+	})).Methods("GET", "PUT", "DELETE")
+
+	router.HandleFunc("/schedules/{name}/run", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := as.wm.schedules[mux.Vars(r)["name"]]
+		if !ok {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		if err := as.wm.runActions(s.Actions); err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"item": s})
+	})).Methods("POST")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testSchedule returns a schedule whose action doesn't touch the X
+// server: nothing matches it.
+func testSchedule(name, cron string) Schedule {
+	return Schedule{
+		Name:     name,
+		Cron:     cron,
+		Timezone: "UTC",
+		Actions: []Action{{
+			Type:  ActionClose,
+			Match: &Match{Class: "no-such-class"},
+		}},
+	}
+}
+
+func TestRunDueSchedulesClockJumps(t *testing.T) {
+	wm := NewWM()
+	s := testSchedule("hourly", "@hourly")
+	if err := wm.SetSchedule(&s); err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, min int) time.Time {
+		return time.Date(2021, 6, 1, hour, min, 0, 0, time.UTC)
+	}
+	s.NextRun = at(10, 0)
+
+	// A jump forward over several run times runs once, and the
+	// next run time follows the new time.
+	wm.runDueSchedules(at(13, 30))
+	if !s.LastRun.Equal(at(13, 30)) {
+		t.Errorf("LastRun = %v, want %v", s.LastRun, at(13, 30))
+	}
+	if !s.NextRun.Equal(at(14, 0)) {
+		t.Errorf("NextRun = %v, want %v", s.NextRun, at(14, 0))
+	}
+	wm.runDueSchedules(at(13, 31))
+	if !s.LastRun.Equal(at(13, 30)) {
+		t.Errorf("ran again at 13:31")
+	}
+
+	// A jump backward doesn't repeat the runs.
+	wm.runDueSchedules(at(14, 0))
+	for _, now := range []time.Time{at(11, 0), at(12, 0), at(14, 0).Add(-time.Second)} {
+		wm.runDueSchedules(now)
+		if !s.LastRun.Equal(at(14, 0)) {
+			t.Errorf("ran again at %v after the clock was set back", now)
+		}
+	}
+	if !s.NextRun.Equal(at(15, 0)) {
+		t.Errorf("NextRun = %v, want %v", s.NextRun, at(15, 0))
+	}
+}
+
+func TestUpdateSchedulesKeepsRunTimes(t *testing.T) {
+	wm := NewWM()
+	wm.config.Schedules = []Schedule{
+		testSchedule("a", "@hourly"),
+		testSchedule("b", "@daily"),
+	}
+	wm.updateSchedules()
+	api := testSchedule("c", "@weekly")
+	api.Source = ScheduleFromAPI
+	if err := wm.SetSchedule(&api); err != nil {
+		t.Fatal(err)
+	}
+
+	lastRun := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	nextRun := time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC)
+	for _, s := range wm.schedules {
+		s.LastRun, s.NextRun = lastRun, nextRun
+	}
+
+	wm.config.Schedules = []Schedule{
+		testSchedule("a", "@hourly"),
+		testSchedule("b", "0 12 * * *"),
+	}
+	wm.updateSchedules()
+
+	if len(wm.schedules) != 3 {
+		t.Fatalf("got %d schedules, want 3", len(wm.schedules))
+	}
+	for name, s := range wm.schedules {
+		if !s.LastRun.Equal(lastRun) {
+			t.Errorf("%s: LastRun = %v, want %v", name, s.LastRun, lastRun)
+		}
+	}
+	if s := wm.schedules["a"]; !s.NextRun.Equal(nextRun) {
+		t.Errorf("unchanged schedule: NextRun = %v, want %v", s.NextRun, nextRun)
+	}
+	if s := wm.schedules["b"]; s.NextRun.Equal(nextRun) || s.NextRun.Minute() != 0 || s.NextRun.Hour() != 12 {
+		t.Errorf("changed schedule: NextRun = %v, want the next 12:00", s.NextRun)
+	}
+	if wm.schedules["c"] != &api {
+		t.Errorf("API schedule was replaced")
+	}
+}
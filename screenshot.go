@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// maxImageStrip is the most bytes read with one GetImage request.
+const maxImageStrip = 4 << 20
+
+// unchannel scales the colour channel in the mask to 8 bits.
+func unchannel(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	c := (v & mask) >> shift
+	if width < 8 {
+		return uint8(c * 0xff / (1<<width - 1))
+	}
+	return uint8(c >> (width - 8))
+}
+
+// rawImage is an area of a drawable as read from the X server, before
+// its pixels are converted. Reading it needs the drawable, so it is
+// done holding wm.mu, and converting it is done without.
+type rawImage struct {
+	width, height int
+	pf            *pixelFormat
+	stride        int
+	// strips are the GetImage replies, of rows rows each but the
+	// last.
+	strips [][]byte
+	rows   int
+}
+
+// fetchImage reads an area of the drawable, which has the pixel format.
+func (wm *WM) fetchImage(d xproto.Drawable, r xproto.Rectangle, pf *pixelFormat) (*rawImage, error) {
+	ri := &rawImage{
+		width:  int(r.Width),
+		height: int(r.Height),
+		pf:     pf,
+		stride: (int(r.Width)*pf.bytesPerPixel + pf.scanlinePad - 1) / pf.scanlinePad * pf.scanlinePad,
+	}
+	if ri.stride == 0 {
+		return ri, nil
+	}
+	ri.rows = maxImageStrip / ri.stride
+	if ri.rows == 0 {
+		ri.rows = 1
+	}
+	for y0 := 0; y0 < ri.height; y0 += ri.rows {
+		n := ri.rows
+		if y0+n > ri.height {
+			n = ri.height - y0
+		}
+		reply, err := xproto.GetImage(
+			wm.xc,
+			xproto.ImageFormatZPixmap,
+			d,
+			r.X, r.Y+int16(y0), r.Width, uint16(n),
+			^uint32(0), // plane mask
+		).Reply()
+		if err != nil {
+			return nil, err
+		}
+		if len(reply.Data) < ri.stride*n {
+			return nil, errors.New("short GetImage reply")
+		}
+		ri.strips = append(ri.strips, reply.Data)
+	}
+	return ri, nil
+}
+
+// decode converts the pixels. Bits outside the colour masks are taken
+// as alpha, and images without any are opaque.
+func (ri *rawImage) decode() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, ri.width, ri.height))
+	pf := ri.pf
+	alpha := uint32(0)
+	if pf.depth < 32 {
+		alpha = uint32(1)<<pf.depth - 1
+	} else {
+		alpha = ^uint32(0)
+	}
+	alpha &^= pf.red | pf.green | pf.blue
+	for s, data := range ri.strips {
+		y0 := s * ri.rows
+		for y := 0; y < ri.rows && y0+y < ri.height; y++ {
+			for x := 0; x < ri.width; x++ {
+				o := y*ri.stride + x*pf.bytesPerPixel
+				v := uint32(0)
+				for i := 0; i < pf.bytesPerPixel; i++ {
+					if pf.msbFirst {
+						v = v<<8 | uint32(data[o+i])
+					} else {
+						v |= uint32(data[o+i]) << (8 * i)
+					}
+				}
+				p := img.PixOffset(x, y0+y)
+				img.Pix[p] = unchannel(v, pf.red)
+				img.Pix[p+1] = unchannel(v, pf.green)
+				img.Pix[p+2] = unchannel(v, pf.blue)
+				img.Pix[p+3] = 0xff
+				if alpha != 0 {
+					img.Pix[p+3] = unchannel(v, alpha)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// fetchScreenshot reads an area of the root window, as shown. The
+// caller must hold wm.mu.
+func (wm *WM) fetchScreenshot(r xproto.Rectangle) (*rawImage, error) {
+	pf, err := wm.rootPixelFormat()
+	if err != nil {
+		return nil, err
+	}
+	d := xproto.Drawable(wm.xroot.Root)
+	if cm := wm.compositor; cm != nil {
+		// Catch up with the damage first. Otherwise the back
+		// buffer is current, and painting it again would only
+		// damage the root window for the VNC sessions and
+		// streams watching it.
+		if cm.repaint != nil || cm.back == 0 ||
+			cm.backW != wm.xroot.WidthInPixels || cm.backH != wm.xroot.HeightInPixels {
+			if cm.repaint != nil {
+				cm.repaint.Stop()
+				cm.repaint = nil
+			}
+			if err := wm.paintCompositor(); err != nil {
+				return nil, err
+			}
+		}
+		d = xproto.Drawable(cm.back)
+	}
+	return wm.fetchImage(d, r, pf)
+}
+
+// fetchClientScreenshot reads the client's window. With the compositor,
+// this works when the window is covered, and after it was hidden, with
+// what it showed last. Without it, the window must be visible, and
+// covered parts come out as whatever is on top. The caller must hold
+// wm.mu.
+func (wm *WM) fetchClientScreenshot(c *Client) (*rawImage, error) {
+	cm := wm.compositor
+	if cm == nil {
+		if !c.Visible {
+			return nil, fmt.Errorf("client %d is hidden; that needs the compositor", c.window)
+		}
+		attrs, err := xproto.GetWindowAttributes(wm.xc, c.window).Reply()
+		if err != nil {
+			return nil, err
+		}
+		geom, err := xproto.GetGeometry(wm.xc, xproto.Drawable(c.window)).Reply()
+		if err != nil {
+			return nil, err
+		}
+		pf, err := wm.visualPixelFormat(geom.Depth, attrs.Visual)
+		if err != nil {
+			return nil, err
+		}
+		return wm.fetchImage(xproto.Drawable(c.window),
+			xproto.Rectangle{Width: geom.Width, Height: geom.Height}, pf)
+	}
+	if err := wm.syncCompWindows(); err != nil {
+		return nil, err
+	}
+	cw := cm.windows[c.window]
+	if cw == nil || cw.inputOnly {
+		return nil, fmt.Errorf("client %d is not composited", c.window)
+	}
+	if cw.mapped {
+		if err := wm.nameCompPixmap(cw); err != nil {
+			return nil, err
+		}
+	}
+	if cw.pixmap == 0 {
+		return nil, fmt.Errorf("client %d was never shown", c.window)
+	}
+	pf, err := wm.visualPixelFormat(cw.depth, cw.visual)
+	if err != nil {
+		return nil, err
+	}
+	return wm.fetchImage(xproto.Drawable(cw.pixmap),
+		xproto.Rectangle{Width: cw.pw, Height: cw.ph}, pf)
+}
+
+// pngResponse writes the image as a PNG. The server's write timeout
+// is too short to encode and send a large one, so it is encoded first,
+// and sent on the hijacked connection with a longer deadline, like the
+// streams.
+func pngResponse(w http.ResponseWriter, r *http.Request, img image.Image) {
+	buf := &bytes.Buffer{}
+	enc := &png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(buf, img); err != nil {
+		errorResponse(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(200)
+		w.Write(buf.Bytes())
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("screenshot: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: image/png\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n", buf.Len())
+	rw.Write(buf.Bytes())
+	if err := rw.Flush(); err != nil {
+		log.Printf("screenshot: %v", err)
+	}
+}
+
+func (as *APIServer) screenshotRoutes(router *mux.Router) {
+	// The images are converted and encoded without holding the
+	// lock.
+	capture := func(w http.ResponseWriter, r *http.Request, f func() (*rawImage, int, error)) {
+		as.wm.mu.Lock()
+		raw, status, err := f()
+		as.wm.mu.Unlock()
+		if err != nil {
+			errorResponse(w, r, status, err)
+			return
+		}
+		pngResponse(w, r, raw.decode())
+	}
+
+	router.HandleFunc("/screenshot", func(w http.ResponseWriter, r *http.Request) {
+		capture(w, r, func() (*rawImage, int, error) {
+			img, err := as.wm.fetchScreenshot(xproto.Rectangle{
+				Width:  as.wm.xroot.WidthInPixels,
+				Height: as.wm.xroot.HeightInPixels,
+			})
+			return img, http.StatusInternalServerError, err
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/screens/{n:[0-9]+}/screenshot", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		capture(w, r, func() (*rawImage, int, error) {
+			if n >= len(as.wm.attachedScreens) {
+				return nil, http.StatusNotFound, fmt.Errorf("no screen %d", n)
+			}
+			s := &as.wm.attachedScreens[n]
+			img, err := as.wm.fetchScreenshot(xproto.Rectangle{
+				X: s.XOrg, Y: s.YOrg, Width: s.Width, Height: s.Height,
+			})
+			return img, http.StatusInternalServerError, err
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/clients/{id:[0-9]+}/screenshot", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		capture(w, r, func() (*rawImage, int, error) {
+			c := as.wm.GetClient(xproto.Window(id))
+			if c == nil {
+				return nil, http.StatusNotFound, fmt.Errorf("no client %d", id)
+			}
+			img, err := as.wm.fetchClientScreenshot(c)
+			return img, http.StatusConflict, err
+		})
+	}).Methods("GET")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// Stacking layers, from bottom to top. Clients are kept in the order
+// of their layers; within a layer, they can be restacked freely.
+const (
+	LayerBelow   = "below"
+	LayerNormal  = "normal"
+	LayerAbove   = "above"
+	LayerOverlay = "overlay"
+)
+
+var layerRanks = map[string]int{
+	LayerBelow:   0,
+	LayerNormal:  1,
+	LayerAbove:   2,
+	LayerOverlay: 3,
+}
+
+func validLayer(layer string) bool {
+	_, ok := layerRanks[layer]
+	return ok || layer == ""
+}
+
+// layerRank returns the position of the client's layer. An empty layer
+// is normal.
+func (c *Client) layerRank() int {
+	if rank, ok := layerRanks[c.Layer]; ok {
+		return rank
+	}
+	return layerRanks[LayerNormal]
+}
+
+// stackingOrder returns the managed clients from bottom to top, as the
+// X server has them.
+func (wm *WM) stackingOrder() ([]*Client, error) {
+	tree, err := xproto.QueryTree(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	clients := []*Client{}
+	for _, win := range tree.Children {
+		if c := wm.GetClient(win); c != nil {
+			clients = append(clients, c)
+		}
+	}
+	return clients, nil
+}
+
+// restack stacks the clients in the order given (bottom to top), after
+// moving them into their layers. The caller must hold wm.mu.
+func (wm *WM) restack(order []*Client) error {
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].layerRank() < order[j].layerRank()
+	})
+	for i := 1; i < len(order); i++ {
+		if err := xproto.ConfigureWindowChecked(
+			wm.xc,
+			order[i].window,
+			xproto.ConfigWindowSibling|xproto.ConfigWindowStackMode,
+			[]uint32{uint32(order[i-1].window), xproto.StackModeAbove},
+		).Check(); err != nil {
+			return err
+		}
+	}
+	wm.setClientListStacking(order)
+	wm.raiseOverlays()
+	ids := make([]xproto.Window, len(order))
+	for i, c := range order {
+		ids[i] = c.window
+	}
+	wm.emit("stacking.changed", map[string]interface{}{"order": ids})
+	return nil
+}
+
+// enforceLayers restacks the clients if a client was stacked out of
+// its layer, e.g. raised by a ConfigureWindow, and puts the overlays
+// back on top. It also keeps _NET_CLIENT_LIST_STACKING up to date. The
+// caller must hold wm.mu.
+func (wm *WM) enforceLayers() error {
+	order, err := wm.stackingOrder()
+	if err != nil {
+		return err
+	}
+	sorted := sort.SliceIsSorted(order, func(i, j int) bool {
+		return order[i].layerRank() < order[j].layerRank()
+	})
+	if !sorted {
+		return wm.restack(order)
+	}
+	wm.setClientListStacking(order)
+	wm.raiseOverlays()
+	return nil
+}
+
+// setClientListStacking sets _NET_CLIENT_LIST_STACKING on the root
+// window.
+func (wm *WM) setClientListStacking(order []*Client) {
+	ids := make([]uint32, len(order))
+	for i, c := range order {
+		ids[i] = uint32(c.window)
+	}
+	if err := xproto.ChangePropertyChecked(
+		wm.xc,
+		xproto.PropModeReplace,
+		wm.xroot.Root,
+		atomNETClientListStacking,
+		xproto.AtomWindow,
+		32, // format
+		uint32(len(ids)),
+		encodeUint32s(ids...),
+	).Check(); err != nil {
+		log.Printf("_NET_CLIENT_LIST_STACKING: %v", err)
+	}
+}
+
+// RaiseClient stacks the client on top of its layer or, if sibling is
+// not nil, right above the sibling (within the layer's bounds). The
+// caller must hold wm.mu.
+func (wm *WM) RaiseClient(c, sibling *Client) error {
+	return wm.moveInStack(c, sibling, true)
+}
+
+// LowerClient stacks the client at the bottom of its layer or, if
+// sibling is not nil, right below the sibling (within the layer's
+// bounds). The caller must hold wm.mu.
+func (wm *WM) LowerClient(c, sibling *Client) error {
+	return wm.moveInStack(c, sibling, false)
+}
+
+func (wm *WM) moveInStack(c, sibling *Client, up bool) error {
+	current, err := wm.stackingOrder()
+	if err != nil {
+		return err
+	}
+	order := []*Client{}
+	for _, other := range current {
+		if other != c {
+			order = append(order, other)
+		}
+	}
+	// Find where to insert c: next to the sibling, or at the edge
+	// of c's layer.
+	pos := len(order)
+	for i, other := range order {
+		if sibling != nil {
+			if other == sibling {
+				pos = i
+				if up {
+					pos++
+				}
+				break
+			}
+		} else if up && other.layerRank() > c.layerRank() ||
+			!up && other.layerRank() >= c.layerRank() {
+			pos = i
+			break
+		}
+	}
+	order = append(order[:pos], append([]*Client{c}, order[pos:]...)...)
+	return wm.restack(order)
+}
+
+// SetStacking restacks the listed clients in the given order (bottom
+// to top), above the unlisted clients of the same layer. The caller
+// must hold wm.mu.
+func (wm *WM) SetStacking(ids []xproto.Window) error {
+	listed := map[*Client]bool{}
+	clients := []*Client{}
+	for _, id := range ids {
+		c := wm.GetClient(id)
+		if c == nil {
+			return fmt.Errorf("no client %d", id)
+		}
+		if listed[c] {
+			return fmt.Errorf("client %d listed twice", id)
+		}
+		listed[c] = true
+		clients = append(clients, c)
+	}
+	current, err := wm.stackingOrder()
+	if err != nil {
+		return err
+	}
+	order := []*Client{}
+	for _, c := range current {
+		if !listed[c] {
+			order = append(order, c)
+		}
+	}
+	return wm.restack(append(order, clients...))
+}
+
+// SetLayer moves the client to a stacking layer. The caller must hold
+// wm.mu.
+func (wm *WM) SetLayer(c *Client, layer string) error {
+	if !validLayer(layer) {
+		return fmt.Errorf("unknown layer %q", layer)
+	}
+	c.Layer = layer
+	order, err := wm.stackingOrder()
+	if err != nil {
+		return err
+	}
+	return wm.restack(order)
+}
+
+func (as *APIServer) stackingRoutes(router *mux.Router) {
+	router.HandleFunc("/stacking", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var data struct{ Order []xproto.Window }
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.SetStacking(data.Order); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		order, err := as.wm.stackingOrder()
+		if err != nil {
+			errorResponse(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		items := []map[string]interface{}{}
+		for _, c := range order {
+			items = append(items, map[string]interface{}{
+				"id":     c.window,
+				"client": c,
+			})
+		}
+		jsonResponse(w, r, 200, map[string]interface{}{"items": items})
+	})).Methods("GET", "POST")
+}
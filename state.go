@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ClientLayout is the operator-assigned layout of a client, as
+// persisted in the state file. Window IDs don't survive app restarts,
+// so clients are matched by WM_CLASS and WM_WINDOW_ROLE instead.
+type ClientLayout struct {
+	Class    string
+	Instance string
+	Role     string
+	// Screen is the index of the screen the client was on.
+	Screen int
+	// Fullscreen is set if the client covered the whole screen. It
+	// is then made fullscreen on restore, even if the screen size
+	// has changed.
+	Fullscreen bool
+	// X and Y are relative to the screen origin.
+	X, Y      int16
+	W, H      uint16
+	StackMode uint32
+	Layer     string
+	// Opacity is only saved if the WM set it, and may be 0.
+	Opacity *float64
+}
+
+// layoutKey identifies clients across restarts.
+func layoutKey(class, instance, role string) string {
+	return class + "/" + instance + "/" + role
+}
+
+func (l *ClientLayout) key() string {
+	return layoutKey(l.Class, l.Instance, l.Role)
+}
+
+// defaultStateFile returns the state file path used if the config
+// does not name one.
+func defaultStateFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "headless-wm", "layout.json")
+}
+
+func (wm *WM) stateFile() string {
+	if wm.config.StateFile != "" {
+		return wm.config.StateFile
+	}
+	return defaultStateFile()
+}
+
+// savedState is what the state file holds. Older versions held just
+// the list of layouts.
+type savedState struct {
+	Layouts []*ClientLayout
+	// Devices are the device mappings set through the API.
+	Devices []*DeviceMapping `json:",omitempty"`
+}
+
+// loadState reads the persisted client layouts and device mappings. A
+// missing state file is not an error.
+func (wm *WM) loadState() error {
+	path := wm.stateFile()
+	if path == "" {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state savedState
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("[")) {
+		err = json.Unmarshal(bs, &state.Layouts)
+	} else {
+		err = json.Unmarshal(bs, &state)
+	}
+	if err != nil {
+		return err
+	}
+	for _, l := range state.Layouts {
+		wm.layout[l.key()] = l
+	}
+	wm.deviceOverrides = state.Devices
+	return nil
+}
+
+// saveState writes the client layouts and device mappings to the
+// state file. Errors are logged, as there is nobody to report them to.
+func (wm *WM) saveState() {
+	path := wm.stateFile()
+	if path == "" {
+		return
+	}
+	state := savedState{
+		Layouts: make([]*ClientLayout, 0, len(wm.layout)),
+		Devices: wm.deviceOverrides,
+	}
+	for _, l := range wm.layout {
+		state.Layouts = append(state.Layouts, l)
+	}
+	bs, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err = writeFileAtomic(path, bs); err != nil {
+		log.Printf("saving state: %v", err)
+	}
+}
+
+// writeFileAtomic replaces the file at path with data, so that
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// rememberLayout records the current layout of the client, and saves
+// it to the state file.
+func (wm *WM) rememberLayout(c *Client) {
+	n := wm.screenAt(c.X+int16(c.W/2), c.Y+int16(c.H/2))
+	screen := &wm.attachedScreens[n]
+	l := &ClientLayout{
+		Class:    c.Class,
+		Instance: c.Instance,
+		Role:     c.Role,
+		Screen:   n,
+		Fullscreen: c.X == screen.XOrg && c.Y == screen.YOrg &&
+			c.W == screen.Width && c.H == screen.Height,
+		X:         c.X - screen.XOrg,
+		Y:         c.Y - screen.YOrg,
+		W:         c.W,
+		H:         c.H,
+		StackMode: c.StackMode,
+		Layer:     c.Layer,
+	}
+	if c.OpacitySet {
+		o := c.Opacity
+		l.Opacity = &o
+	}
+	wm.layout[l.key()] = l
+	wm.saveState()
+}
+
+// restoreLayout applies a persisted layout to a new client, if there
+// is one. It returns false if there was no layout for this client.
+func (wm *WM) restoreLayout(c *Client) bool {
+	l, ok := wm.layout[layoutKey(c.Class, c.Instance, c.Role)]
+	if !ok {
+		return false
+	}
+	n := l.Screen
+	if n < 0 || n >= len(wm.attachedScreens) {
+		n = wm.config.DefaultScreen
+		if n >= len(wm.attachedScreens) {
+			n = 0
+		}
+	}
+	screen := &wm.attachedScreens[n]
+	if l.Fullscreen {
+		c.MakeFullscreen(screen)
+	} else {
+		c.X = screen.XOrg + l.X
+		c.Y = screen.YOrg + l.Y
+		c.W = l.W
+		c.H = l.H
+	}
+	c.StackMode = l.StackMode
+	if l.Layer != "" {
+		c.Layer = l.Layer
+	}
+	if l.Opacity != nil {
+		c.Opacity, c.OpacitySet = *l.Opacity, true
+	}
+	return true
+}
+
+// screenAt returns the index of the screen containing the point, or
+// the nearest screen if none does.
+func (wm *WM) screenAt(x, y int16) int {
+	best, bestDist := 0, -1
+	for i, s := range wm.attachedScreens {
+		dx, dy := 0, 0
+		if int(x) < int(s.XOrg) {
+			dx = int(s.XOrg) - int(x)
+		} else if int(x) >= int(s.XOrg)+int(s.Width) {
+			dx = int(x) - int(s.XOrg) - int(s.Width) + 1
+		}
+		if int(y) < int(s.YOrg) {
+			dy = int(s.YOrg) - int(y)
+		} else if int(y) >= int(s.YOrg)+int(s.Height) {
+			dy = int(y) - int(s.YOrg) - int(s.Height) + 1
+		}
+		if dist := dx*dx + dy*dy; bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/gorilla/mux"
+)
+
+// streamBoundary separates the frames of a stream.
+const streamBoundary = "frame"
+
+// streamKeepalive is how often a frame is sent when nothing changes,
+// so that viewers and proxies don't give up on the stream.
+const streamKeepalive = 10 * time.Second
+
+// streamWriteTimeout is how long a viewer may take to receive a frame.
+const streamWriteTimeout = 10 * time.Second
+
+// StreamConfig configures the MJPEG live view streams.
+type StreamConfig struct {
+	// FPS is the most frames sent per second. Viewers may ask for
+	// less with ?fps=. Defaults to 5.
+	FPS int `yaml:"fps" json:"fps"`
+	// Quality is the JPEG quality, 1 to 100. Viewers may ask for
+	// another one with ?quality=. Defaults to 75.
+	Quality int `yaml:"quality" json:"quality"`
+	// Bandwidth caps each stream, in bytes per second. Frames are
+	// dropped to stay under it. Zero means no cap.
+	Bandwidth int `yaml:"bandwidth" json:"bandwidth"`
+	// MaxViewers is the most streams open at once. Defaults to 4.
+	MaxViewers int `yaml:"max_viewers" json:"max_viewers"`
+}
+
+func (sc *StreamConfig) setDefaults() {
+	if sc.FPS == 0 {
+		sc.FPS = 5
+	}
+	if sc.Quality == 0 {
+		sc.Quality = 75
+	}
+	if sc.MaxViewers == 0 {
+		sc.MaxViewers = 4
+	}
+}
+
+// Validate checks the stream config for errors.
+func (sc *StreamConfig) Validate() error {
+	if sc.FPS < 1 || sc.FPS > 60 {
+		return fmt.Errorf("fps: %d out of range", sc.FPS)
+	}
+	if sc.Quality < 1 || sc.Quality > 100 {
+		return fmt.Errorf("quality: %d out of range", sc.Quality)
+	}
+	if sc.Bandwidth < 0 {
+		return errors.New("bandwidth: must not be negative")
+	}
+	if sc.MaxViewers < 0 {
+		return errors.New("max_viewers: must not be negative")
+	}
+	return nil
+}
+
+// damageWatch tells when a drawable was damaged.
+type damageWatch struct {
+	// damage is zero without DAMAGE, and then the watch never
+	// fires.
+	damage damage.Damage
+	// dirty is signalled when the drawable was damaged.
+	dirty chan struct{}
+	// area is the bounding box of the damage since it was last
+	// taken, in the drawable's coordinates. It is guarded by wm.mu.
+	area image.Rectangle
+}
+
+// damaged adds the area to the damage, and signals the watch, unless it
+// already was. The caller must hold wm.mu.
+func (dw *damageWatch) damaged(area xproto.Rectangle) {
+	dw.area = dw.area.Union(imageRect(area))
+	select {
+	case dw.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the damage since it was last taken. The caller must
+// hold wm.mu.
+func (dw *damageWatch) take() image.Rectangle {
+	area := dw.area
+	dw.area = image.Rectangle{}
+	return area
+}
+
+// watchDamage starts watching the drawable for damage, where DAMAGE is
+// available. The bounding box of the damage is reported, so that only
+// that needs to be read back. The caller must hold wm.mu.
+func (wm *WM) watchDamage(d xproto.Drawable) (*damageWatch, error) {
+	dw := &damageWatch{dirty: make(chan struct{}, 1)}
+	if !wm.hasDamage {
+		return dw, nil
+	}
+	id, err := damage.NewDamageId(wm.xc)
+	if err != nil {
+		return nil, err
+	}
+	if err = damage.CreateChecked(wm.xc, id, d, damage.ReportLevelBoundingBox).Check(); err != nil {
+		return nil, err
+	}
+	dw.damage = id
+	wm.damageWatches[id] = dw
+	return dw, nil
+}
+
+// unwatchDamage stops the watch. The caller must hold wm.mu.
+func (wm *WM) unwatchDamage(dw *damageWatch) {
+	if dw.damage != 0 {
+		damage.Destroy(wm.xc, dw.damage)
+		delete(wm.damageWatches, dw.damage)
+	}
+}
+
+// imageRect converts an X rectangle.
+func imageRect(r xproto.Rectangle) image.Rectangle {
+	return image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.Width), int(r.Y)+int(r.Height))
+}
+
+// xRect converts a rectangle for X.
+func xRect(r image.Rectangle) xproto.Rectangle {
+	return xproto.Rectangle{
+		X: int16(r.Min.X), Y: int16(r.Min.Y),
+		Width: uint16(r.Dx()), Height: uint16(r.Dy()),
+	}
+}
+
+// rootCapture keeps a frame of an area of the root window, and reads
+// back only what was damaged in it since.
+type rootCapture struct {
+	watch *damageWatch
+	// frame is the last frame, of rect in root coordinates.
+	frame *image.RGBA
+	rect  image.Rectangle
+	// part is what was read since, of partArea.
+	part     *rawImage
+	partArea image.Rectangle
+}
+
+// fetchRoot reads what was damaged in rect since the last frame, or all
+// of it for the first frame, when rect changed, without DAMAGE, or if
+// full is set. It returns false if nothing in rect was damaged. Only
+// the X round trips are made here, and the frame is put together by
+// next, without the lock. The caller must hold wm.mu.
+func (wm *WM) fetchRoot(rc *rootCapture, rect image.Rectangle, full bool) (bool, error) {
+	area := rc.watch.take().Intersect(rect)
+	if rc.frame == nil || rect != rc.rect || full || rc.watch.damage == 0 {
+		area = rect
+	}
+	if area.Empty() {
+		return false, nil
+	}
+	raw, err := wm.fetchScreenshot(xRect(area))
+	if err != nil {
+		return false, err
+	}
+	rc.rect, rc.part, rc.partArea = rect, raw, area
+	return true, nil
+}
+
+// next returns the frame, with what was read since put in. The last
+// frame is left as it was, to compare with.
+func (rc *rootCapture) next() *image.RGBA {
+	if rc.part == nil {
+		return rc.frame
+	}
+	img := rc.part.decode()
+	if rc.partArea != rc.rect {
+		frame := image.NewRGBA(rc.frame.Rect)
+		copy(frame.Pix, rc.frame.Pix)
+		draw.Draw(frame, rc.partArea.Sub(rc.rect.Min), img, image.Point{}, draw.Src)
+		img = frame
+	}
+	rc.frame, rc.part = img, nil
+	return img
+}
+
+// stream is a live view being sent to a viewer.
+type stream struct {
+	// target is what is streamed, like "screen 0".
+	target string
+	remote string
+	// rect is the area of the root window streamed, for screens.
+	// Only what was damaged in it is read again. The caller must
+	// hold wm.mu.
+	rect func() (image.Rectangle, error)
+	// capture reads a frame, for clients. The caller must hold
+	// wm.mu.
+	capture func() (*rawImage, error)
+	// drawable is watched for damage.
+	drawable xproto.Drawable
+	watch    *damageWatch
+}
+
+// startStream counts the viewer in, and starts watching the stream's
+// drawable for damage. The caller must hold wm.mu.
+func (wm *WM) startStream(s *stream) error {
+	if wm.streamViewers >= wm.config.Streams.MaxViewers {
+		return fmt.Errorf("too many viewers (max %d)", wm.config.Streams.MaxViewers)
+	}
+	dw, err := wm.watchDamage(s.drawable)
+	if err != nil {
+		return err
+	}
+	s.watch = dw
+	wm.streamViewers++
+	log.Printf("stream of %s to %s started", s.target, s.remote)
+	wm.emit("stream.started", map[string]interface{}{
+		"target": s.target,
+		"remote": s.remote,
+	})
+	return nil
+}
+
+// stopStream counts the viewer out. The caller must hold wm.mu.
+func (wm *WM) stopStream(s *stream) {
+	wm.unwatchDamage(s.watch)
+	wm.streamViewers--
+	log.Printf("stream of %s to %s stopped", s.target, s.remote)
+	wm.emit("stream.stopped", map[string]interface{}{
+		"target": s.target,
+		"remote": s.remote,
+	})
+}
+
+// streamParam reads an integer query parameter, between 1 and max.
+func streamParam(r *http.Request, name string, def, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("bad %s %q", name, value)
+	}
+	return n, nil
+}
+
+// serveStream sends frames as multipart/x-mixed-replace JPEGs, until
+// the viewer goes away or the target can't be captured anymore. The
+// connection is hijacked, to get around the server's write timeout.
+func (as *APIServer) serveStream(w http.ResponseWriter, r *http.Request, s *stream) {
+	as.wm.mu.Lock()
+	sc := as.wm.config.Streams
+	as.wm.mu.Unlock()
+	fps, err := streamParam(r, "fps", sc.FPS, sc.FPS)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	quality, err := streamParam(r, "quality", sc.Quality, 100)
+	if err != nil {
+		errorResponse(w, r, http.StatusBadRequest, err)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		errorResponse(w, r, http.StatusInternalServerError, errors.New("can't stream here"))
+		return
+	}
+	s.remote = r.RemoteAddr
+
+	as.wm.mu.Lock()
+	err = as.wm.startStream(s)
+	as.wm.mu.Unlock()
+	if err != nil {
+		errorResponse(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer func() {
+		as.wm.mu.Lock()
+		as.wm.stopStream(s)
+		as.wm.mu.Unlock()
+	}()
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("stream: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	// The viewer sends nothing more; reading tells us when it
+	// hangs up.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := rw.Read(buf); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: multipart/x-mixed-replace; boundary=%s\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Connection: close\r\n\r\n", streamBoundary)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+	// Without DAMAGE, every tick is a new frame.
+	dirty := true
+	rc := &rootCapture{watch: s.watch}
+	var lastFrame, sendAfter time.Time
+	buf := &bytes.Buffer{}
+	for {
+		select {
+		case <-gone:
+			return
+		case <-s.watch.dirty:
+			dirty = true
+			continue
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if s.watch.damage != 0 && !dirty && now.Sub(lastFrame) < streamKeepalive {
+			continue
+		}
+		if now.Before(sendAfter) {
+			// Over the bandwidth cap; the frame is dropped,
+			// and sent once there is room.
+			continue
+		}
+		// Only the X round trips are made holding the lock.
+		as.wm.mu.Lock()
+		var raw *rawImage
+		changed := true
+		if s.rect != nil {
+			var rect image.Rectangle
+			if rect, err = s.rect(); err == nil {
+				changed, err = as.wm.fetchRoot(rc, rect, false)
+			}
+		} else {
+			raw, err = s.capture()
+		}
+		as.wm.mu.Unlock()
+		if err != nil {
+			log.Printf("stream of %s: %v", s.target, err)
+			return
+		}
+		dirty = false
+		if !changed && now.Sub(lastFrame) < streamKeepalive {
+			continue
+		}
+		img := rc.next()
+		if raw != nil {
+			img = raw.decode()
+		}
+		if img == nil {
+			continue
+		}
+		buf.Reset()
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			log.Printf("stream of %s: %v", s.target, err)
+			return
+		}
+		if err := writeStreamFrame(conn, rw, buf.Bytes()); err != nil {
+			return
+		}
+		lastFrame = now
+		if sc.Bandwidth > 0 {
+			if sendAfter.Before(now) {
+				sendAfter = now
+			}
+			sendAfter = sendAfter.Add(time.Duration(buf.Len()) * time.Second / time.Duration(sc.Bandwidth))
+		}
+	}
+}
+
+// writeStreamFrame sends a JPEG as the next part of the stream.
+func writeStreamFrame(conn interface{ SetWriteDeadline(time.Time) error }, rw *bufio.ReadWriter, frame []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	fmt.Fprintf(rw, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+		streamBoundary, len(frame))
+	rw.Write(frame)
+	rw.WriteString("\r\n")
+	return rw.Flush()
+}
+
+func (as *APIServer) streamRoutes(router *mux.Router) {
+	router.HandleFunc("/screens/{n:[0-9]+}/stream", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(mux.Vars(r)["n"])
+		as.wm.mu.Lock()
+		ok := n < len(as.wm.attachedScreens)
+		as.wm.mu.Unlock()
+		if !ok {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		as.serveStream(w, r, &stream{
+			target:   fmt.Sprintf("screen %d", n),
+			drawable: xproto.Drawable(as.wm.xroot.Root),
+			rect: func() (image.Rectangle, error) {
+				if n >= len(as.wm.attachedScreens) {
+					return image.Rectangle{}, fmt.Errorf("no screen %d", n)
+				}
+				s := &as.wm.attachedScreens[n]
+				return imageRect(xproto.Rectangle{
+					X: s.XOrg, Y: s.YOrg, Width: s.Width, Height: s.Height,
+				}), nil
+			},
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/clients/{id:[0-9]+}/stream", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		win := xproto.Window(id)
+		as.wm.mu.Lock()
+		ok := as.wm.GetClient(win) != nil
+		as.wm.mu.Unlock()
+		if !ok {
+			jsonResponse(w, r, http.StatusNotFound, nil)
+			return
+		}
+		as.serveStream(w, r, &stream{
+			target:   fmt.Sprintf("client %d", win),
+			drawable: xproto.Drawable(win),
+			capture: func() (*rawImage, error) {
+				c := as.wm.GetClient(win)
+				if c == nil {
+					return nil, fmt.Errorf("client %d is gone", win)
+				}
+				return as.wm.fetchClientScreenshot(c)
+			},
+		})
+	}).Methods("GET")
+}
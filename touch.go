@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// xgb reads every event as 32 bytes, but XI2 events are GenericEvents
+// with more data after them, which would throw it off. Touch events
+// are read on a connection of their own instead, which only selects
+// them, and is spoken to without xgb.
+//
+// The raw touch events are used: they are sent to the root window for
+// every touch, whichever client the touch goes to, so clients keep
+// getting their touches as before.
+
+// XI2 request minor opcodes and event types for touches.
+const (
+	xiSelectEvents    = 46
+	xiRawTouchBegin   = 22
+	xiRawTouchEnd     = 24
+	xiAllMasterDevice = 1
+)
+
+// maxTouchTap is how long touches are followed as one tap, in case the
+// end of one was missed.
+const maxTouchTap = 10 * time.Second
+
+// touchTap is a tap with one or more fingers on a touch device, from
+// the first finger down until the last one is lifted.
+type touchTap struct {
+	start   time.Time
+	touches map[uint32]bool
+	// fingers is the most fingers that were down at once.
+	fingers int
+}
+
+// runTouchMonitor follows the touches for multi-finger taps, until the
+// WM exits or the connection fails.
+func (wm *WM) runTouchMonitor() {
+	wm.mu.Lock()
+	opcode, root, ok := wm.xiOpcode, wm.xroot.Root, wm.hasXInput
+	wm.mu.Unlock()
+	if !ok {
+		return
+	}
+	conn, err := dialX(os.Getenv("DISPLAY"))
+	if err != nil {
+		log.Printf("touch events: %v", err)
+		return
+	}
+	defer conn.Close()
+	// XI 2.2 has to be announced on each connection.
+	buf := make([]byte, 8+20)
+	buf[0], buf[1] = opcode, xiQueryVersion
+	xgb.Put16(buf[2:], 2)
+	xgb.Put16(buf[4:], 2)
+	xgb.Put16(buf[6:], 2)
+	req := buf[8:]
+	req[0], req[1] = opcode, xiSelectEvents
+	xgb.Put16(req[2:], uint16(len(req)/4))
+	xgb.Put32(req[4:], uint32(root))
+	xgb.Put16(req[8:], 1) // one mask
+	xgb.Put16(req[12:], xiAllMasterDevice)
+	xgb.Put16(req[14:], 1) // mask length, in 4-byte units
+	xgb.Put32(req[16:], 1<<xiRawTouchBegin|1<<xiRawTouchEnd)
+	if _, err = conn.Write(buf); err != nil {
+		log.Printf("touch events: %v", err)
+		return
+	}
+	for {
+		ev := make([]byte, 32)
+		if _, err = io.ReadFull(conn, ev); err != nil {
+			log.Printf("touch events: %v", err)
+			return
+		}
+		typ := ev[0] & 0x7f
+		if typ == 1 || typ == xproto.GeGeneric {
+			// Replies and GenericEvents have more data.
+			more := make([]byte, 4*int(xgb.Get32(ev[4:])))
+			if _, err = io.ReadFull(conn, more); err != nil {
+				log.Printf("touch events: %v", err)
+				return
+			}
+		}
+		switch {
+		case typ == 0:
+			log.Printf("touch events: X error %d", ev[1])
+		case typ == xproto.GeGeneric && ev[1] == opcode:
+			wm.mu.Lock()
+			wm.handleRawTouch(xgb.Get16(ev[8:]), xgb.Get16(ev[20:]), xgb.Get32(ev[16:]))
+			wm.mu.Unlock()
+		}
+	}
+}
+
+// handleRawTouch follows the touches of each device, and looks for tap
+// gestures once all fingers are lifted. The caller must hold wm.mu.
+func (wm *WM) handleRawTouch(evtype, device uint16, touch uint32) {
+	now := time.Now()
+	tap := wm.touchTaps[device]
+	switch evtype {
+	case xiRawTouchBegin:
+		if tap == nil || now.Sub(tap.start) > maxTouchTap {
+			tap = &touchTap{start: now, touches: map[uint32]bool{}}
+			wm.touchTaps[device] = tap
+		}
+		tap.touches[touch] = true
+		if len(tap.touches) > tap.fingers {
+			tap.fingers = len(tap.touches)
+		}
+	case xiRawTouchEnd:
+		if tap == nil {
+			return
+		}
+		delete(tap.touches, touch)
+		if len(tap.touches) == 0 {
+			delete(wm.touchTaps, device)
+			wm.gesturesTap(tap.fingers, now.Sub(tap.start))
+		}
+	}
+}
+
+// gesturesTap triggers the tap gestures for the number of fingers, if
+// the tap was short enough. It is located by the pointer, which follows
+// the first finger. The caller must hold wm.mu.
+func (wm *WM) gesturesTap(fingers int, held time.Duration) {
+	if fingers < 2 {
+		return
+	}
+	pointer, err := xproto.QueryPointer(wm.xc, wm.xroot.Root).Reply()
+	if err != nil {
+		log.Printf("gestures: %v", err)
+		return
+	}
+	screen := wm.screenAt(pointer.RootX, pointer.RootY)
+	for i := range wm.config.Gestures {
+		g := &wm.config.Gestures[i]
+		if g.Type == GestureTap && g.Fingers == fingers && g.onScreen(screen) &&
+			held <= time.Duration(g.Duration) {
+			wm.triggerGesture(g, pointer.RootX, pointer.RootY, screen)
+		}
+	}
+}
+
+// dialX opens a connection to the X server, like xgb does, for the
+// display name, and authenticates with the MIT-MAGIC-COOKIE-1 from the
+// Xauthority file, if there is one. The connection is little-endian.
+func dialX(display string) (net.Conn, error) {
+	i := strings.LastIndex(display, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("bad display %q", display)
+	}
+	number := display[i+1:]
+	if j := strings.LastIndex(number, "."); j >= 0 {
+		number = number[:j]
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad display %q", display)
+	}
+	var conn net.Conn
+	host, protocol := display[:i], "tcp"
+	if j := strings.LastIndex(host, "/"); j >= 0 && display[0] != '/' {
+		protocol, host = host[:j], host[j+1:]
+	}
+	switch {
+	case display[0] == '/':
+		conn, err = net.Dial("unix", display[:i]+":"+number)
+	case host == "" || host == "unix":
+		host = ""
+		conn, err = net.Dial("unix", "/tmp/.X11-unix/X"+number)
+	default:
+		conn, err = net.Dial(protocol, net.JoinHostPort(host, strconv.Itoa(6000+n)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	name, data := xauthCookie(host, number)
+	buf := make([]byte, 12+xgb.Pad(len(name))+xgb.Pad(len(data)))
+	buf[0] = 'l'
+	xgb.Put16(buf[2:], 11)
+	xgb.Put16(buf[6:], uint16(len(name)))
+	xgb.Put16(buf[8:], uint16(len(data)))
+	copy(buf[12:], name)
+	copy(buf[12+xgb.Pad(len(name)):], data)
+	head := make([]byte, 8)
+	if _, err = conn.Write(buf); err == nil {
+		_, err = io.ReadFull(conn, head)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The setup information isn't needed; what we need comes from
+	// the main connection.
+	setup := make([]byte, 4*int(xgb.Get16(head[6:])))
+	if _, err = io.ReadFull(conn, setup); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if head[0] != 1 {
+		conn.Close()
+		reason := setup
+		if head[0] == 0 && int(head[1]) <= len(setup) {
+			reason = setup[:head[1]]
+		}
+		return nil, fmt.Errorf("connection refused: %s", strings.TrimRight(string(reason), "\x00"))
+	}
+	return conn, nil
+}
+
+// xauthCookie returns the MIT-MAGIC-COOKIE-1 for the display from the
+// Xauthority file, or nothing if there is none.
+func xauthCookie(host, number string) (string, []byte) {
+	const (
+		familyLocal = 256
+		familyWild  = 65535
+	)
+	if host == "" || host == "localhost" {
+		host, _ = os.Hostname()
+	}
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		path = os.Getenv("HOME") + "/.Xauthority"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil
+	}
+	defer f.Close()
+	field := func() ([]byte, error) {
+		var n uint16
+		if err := binary.Read(f, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(f, b)
+		return b, err
+	}
+	for {
+		var family uint16
+		if err := binary.Read(f, binary.BigEndian, &family); err != nil {
+			return "", nil
+		}
+		var fields [4][]byte
+		for i := range fields {
+			if fields[i], err = field(); err != nil {
+				return "", nil
+			}
+		}
+		addr, disp, name, data := string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+		if (family == familyWild || family == familyLocal && addr == host) &&
+			(disp == "" || disp == number) && name == "MIT-MAGIC-COOKIE-1" {
+			return name, data
+		}
+	}
+}
@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/bits"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+	"github.com/gorilla/mux"
+)
+
+// vncUpdateInterval is the shortest time between two updates sent to a
+// VNC viewer.
+const vncUpdateInterval = 50 * time.Millisecond
+
+// vncPollInterval is how often the screen is compared for changes
+// without DAMAGE.
+const vncPollInterval = 500 * time.Millisecond
+
+// vncHandshakeTimeout is how long a viewer may take to log in.
+const vncHandshakeTimeout = 30 * time.Second
+
+// vncAuthDelay slows down password guessing.
+const vncAuthDelay = time.Second
+
+// vncMaxHandshakes is the most viewers logging in at once. With
+// vncAuthDelay, it caps how fast passwords can be guessed over all
+// connections, not just one.
+const vncMaxHandshakes = 4
+
+// vncTile is the size of the squares compared for changes, and of the
+// rectangles sent.
+const vncTile = 64
+
+// vncIndicatorOff disables the indicator overlay.
+const vncIndicatorOff = "none"
+
+// RFB security types, encodings and client messages.
+const (
+	rfbSecurityVNC = 2
+
+	rfbEncodingRaw         = 0
+	rfbEncodingZRLE        = 16
+	rfbEncodingDesktopSize = -223
+
+	rfbSetPixelFormat           = 0
+	rfbSetEncodings             = 2
+	rfbFramebufferUpdateRequest = 3
+	rfbKeyEvent                 = 4
+	rfbPointerEvent             = 5
+	rfbClientCutText            = 6
+)
+
+// RemoteConfig configures remote access to the kiosk.
+type RemoteConfig struct {
+	VNC VNCConfig `yaml:"vnc" json:"vnc"`
+}
+
+// VNCConfig configures the built-in VNC (RFB) server.
+type VNCConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Listen is the address to listen on. Defaults to ":5900".
+	Listen string `yaml:"listen" json:"listen"`
+	// Password gives control, and ViewPassword only a view. One
+	// of them is needed. VNC authentication uses up to 8
+	// characters.
+	Password     string `yaml:"password" json:"password"`
+	ViewPassword string `yaml:"view_password" json:"view_password"`
+	// ViewOnly makes all sessions view-only.
+	ViewOnly bool `yaml:"view_only" json:"view_only"`
+	// Screen is the screen served. If unset, it is the whole root
+	// window.
+	Screen *int `yaml:"screen" json:"screen"`
+	// MaxSessions is the most sessions open at once. Defaults to 2.
+	MaxSessions int `yaml:"max_sessions" json:"max_sessions"`
+	// Indicator is where the overlay telling that the kiosk is
+	// being viewed or controlled goes, like an overlay position,
+	// or "none". Defaults to top-right.
+	Indicator string `yaml:"indicator" json:"indicator"`
+}
+
+func (vc *VNCConfig) setDefaults() {
+	if vc.Listen == "" {
+		vc.Listen = ":5900"
+	}
+	if vc.MaxSessions == 0 {
+		vc.MaxSessions = 2
+	}
+	if vc.Indicator == "" {
+		vc.Indicator = CornerTopRight
+	}
+}
+
+// Validate checks the VNC config for errors.
+func (vc *VNCConfig) Validate() error {
+	if vc.Enabled && vc.Password == "" && vc.ViewPassword == "" {
+		return errors.New("password: needed, or a view_password")
+	}
+	if len(vc.Password) > 8 {
+		return errors.New("password: longer than 8 characters")
+	}
+	if len(vc.ViewPassword) > 8 {
+		return errors.New("view_password: longer than 8 characters")
+	}
+	if vc.ViewPassword != "" && vc.ViewPassword == vc.Password {
+		return errors.New("view_password: same as password")
+	}
+	if vc.Screen != nil && *vc.Screen < 0 {
+		return fmt.Errorf("screen: bad screen %d", *vc.Screen)
+	}
+	if vc.MaxSessions < 0 {
+		return errors.New("max_sessions: must not be negative")
+	}
+	switch vc.Indicator {
+	case "", vncIndicatorOff, PositionCenter, PositionTop, PositionBottom,
+		CornerTopLeft, CornerTopRight, CornerBottomLeft, CornerBottomRight:
+	default:
+		return fmt.Errorf("indicator: unknown position %q", vc.Indicator)
+	}
+	return nil
+}
+
+// vncServer is the running VNC server.
+type vncServer struct {
+	config   VNCConfig
+	listener net.Listener
+	sessions map[*vncSession]bool
+	// handshakes counts the viewers logging in. reserved counts
+	// the sessions being started, which have their slot under
+	// MaxSessions from before they logged in.
+	handshakes int
+	reserved   int
+	// indicators are the IDs of the overlays shown while there are
+	// sessions.
+	indicators []int
+}
+
+// vncLogin is a password, and what it gives access to.
+type vncLogin struct {
+	password string
+	viewOnly bool
+}
+
+// rfbPixelFormat is a viewer's pixel format. Only true colour ones are
+// supported.
+type rfbPixelFormat struct {
+	BPP, Depth                      uint8
+	BigEndian, TrueColour           uint8
+	RedMax, GreenMax, BlueMax       uint16
+	RedShift, GreenShift, BlueShift uint8
+	_                               [3]uint8
+}
+
+// vncSession is a logged in viewer. Once it started, ViewOnly is
+// guarded by wm.mu, as it changes with the config.
+type vncSession struct {
+	Remote   string    `json:"remote"`
+	ViewOnly bool      `json:"view_only"`
+	Since    time.Time `json:"since"`
+
+	server *vncServer
+	conn   net.Conn
+	watch  *damageWatch
+	// password is what the viewer logged in with.
+	password string
+
+	// mu guards what the viewer asked for, which is read by the
+	// updates.
+	mu          sync.Mutex
+	format      rfbPixelFormat
+	zrle        bool
+	desktopSize bool
+	// requested is set when the viewer asked for an update, and
+	// full if it asked for all of the screen.
+	requested, full bool
+	// requests is signalled when the viewer asked for an update.
+	requests chan struct{}
+
+	// buttons and keys are the pointer buttons and the keycodes,
+	// by keysym, held down by the viewer. They are guarded by
+	// wm.mu.
+	buttons byte
+	keys    map[uint32]xproto.Keycode
+
+	// width and height are the size of the viewer's framebuffer,
+	// and zbuf, zw and tile the ZRLE state. They are only used by
+	// the updates.
+	width, height int
+	zbuf          bytes.Buffer
+	zw            *zlib.Writer
+	tile          []byte
+}
+
+// vncRect is the part of the root window served. The caller must hold
+// wm.mu.
+func (wm *WM) vncRect(vs *vncServer) (xproto.Rectangle, error) {
+	if n := vs.config.Screen; n != nil {
+		if *n >= len(wm.attachedScreens) {
+			return xproto.Rectangle{}, fmt.Errorf("no screen %d", *n)
+		}
+		s := &wm.attachedScreens[*n]
+		return xproto.Rectangle{X: s.XOrg, Y: s.YOrg, Width: s.Width, Height: s.Height}, nil
+	}
+	return xproto.Rectangle{Width: wm.xroot.WidthInPixels, Height: wm.xroot.HeightInPixels}, nil
+}
+
+// logins lists what can be logged in with.
+func (vc *VNCConfig) logins() []vncLogin {
+	var logins []vncLogin
+	if vc.Password != "" {
+		logins = append(logins, vncLogin{vc.Password, vc.ViewOnly})
+	}
+	if vc.ViewPassword != "" {
+		logins = append(logins, vncLogin{vc.ViewPassword, true})
+	}
+	return logins
+}
+
+// StartVNC starts the VNC server. If it already runs on the same
+// address, the new config is taken over. Sessions then get what their
+// password gives now, and are disconnected if it doesn't work anymore.
+// The caller must hold wm.mu.
+func (wm *WM) StartVNC(vc *VNCConfig) error {
+	if len(vc.logins()) == 0 {
+		return errors.New("VNC needs a password")
+	}
+	if vc.Screen != nil && *vc.Screen >= len(wm.attachedScreens) {
+		return fmt.Errorf("no screen %d", *vc.Screen)
+	}
+	if vs := wm.vnc; vs != nil {
+		if vs.config.Listen == vc.Listen {
+			vs.config = *vc
+			wm.updateVNCSessions(vs)
+			wm.updateVNCIndicator(vs)
+			return nil
+		}
+		wm.StopVNC()
+	}
+	l, err := net.Listen("tcp", vc.Listen)
+	if err != nil {
+		return err
+	}
+	vs := &vncServer{
+		config:   *vc,
+		listener: l,
+		sessions: map[*vncSession]bool{},
+	}
+	wm.vnc = vs
+	go wm.acceptVNC(vs)
+	log.Printf("VNC server listening on %s", l.Addr())
+	wm.emit("vnc.started", map[string]interface{}{"listen": l.Addr().String()})
+	return nil
+}
+
+// StopVNC stops the VNC server, and disconnects its sessions. The
+// caller must hold wm.mu.
+func (wm *WM) StopVNC() {
+	vs := wm.vnc
+	if vs == nil {
+		return
+	}
+	wm.vnc = nil
+	vs.listener.Close()
+	for s := range vs.sessions {
+		s.conn.Close()
+	}
+	vs.sessions = map[*vncSession]bool{}
+	wm.updateVNCIndicator(vs)
+	log.Printf("VNC server on %s stopped", vs.listener.Addr())
+	wm.emit("vnc.stopped", map[string]interface{}{"listen": vs.listener.Addr().String()})
+}
+
+// updateVNCSessions checks the sessions' passwords against the config,
+// after it changed. The caller must hold wm.mu.
+func (wm *WM) updateVNCSessions(vs *vncServer) {
+	logins := vs.config.logins()
+	for s := range vs.sessions {
+		valid := false
+		for _, login := range logins {
+			if login.password == s.password {
+				valid = true
+				if login.viewOnly && !s.ViewOnly {
+					wm.releaseVNCInput(s)
+				}
+				s.ViewOnly = login.viewOnly
+				break
+			}
+		}
+		if !valid {
+			log.Printf("VNC session from %s: password no longer valid", s.Remote)
+			delete(vs.sessions, s)
+			s.conn.Close()
+		}
+	}
+}
+
+// applyVNCConfig starts or stops the VNC server. The caller must hold
+// wm.mu.
+func (wm *WM) applyVNCConfig(vc *VNCConfig) error {
+	if !vc.Enabled {
+		wm.StopVNC()
+		return nil
+	}
+	return wm.StartVNC(vc)
+}
+
+// updateVNCIndicator shows the indicator overlays while there are
+// sessions, and removes them when there are none. The caller must hold
+// wm.mu.
+func (wm *WM) updateVNCIndicator(vs *vncServer) {
+	for _, id := range vs.indicators {
+		// It may have been deleted through the API.
+		wm.DeleteOverlay(id)
+	}
+	vs.indicators = nil
+	if len(vs.sessions) == 0 || vs.config.Indicator == vncIndicatorOff {
+		return
+	}
+	text := "Remote viewing"
+	for s := range vs.sessions {
+		if !s.ViewOnly {
+			text = "Remote control"
+		}
+	}
+	screens := []int{}
+	if vs.config.Screen != nil {
+		screens = append(screens, *vs.config.Screen)
+	} else {
+		for n := range wm.attachedScreens {
+			screens = append(screens, n)
+		}
+	}
+	for _, n := range screens {
+		o := &Overlay{
+			Text:       text,
+			Screen:     n,
+			Position:   vs.config.Indicator,
+			Background: "#c00000",
+		}
+		if err := wm.ShowOverlay(o); err != nil {
+			log.Printf("VNC indicator: %v", err)
+			continue
+		}
+		vs.indicators = append(vs.indicators, o.ID)
+	}
+}
+
+// acceptVNC serves the viewers connecting, until the server is
+// stopped.
+func (wm *WM) acceptVNC(vs *vncServer) {
+	for {
+		conn, err := vs.listener.Accept()
+		if err != nil {
+			wm.mu.Lock()
+			running := wm.vnc == vs
+			wm.mu.Unlock()
+			if running {
+				log.Printf("VNC: %v", err)
+			}
+			return
+		}
+		wm.mu.Lock()
+		busy := vs.handshakes >= vncMaxHandshakes
+		if !busy {
+			vs.handshakes++
+		}
+		wm.mu.Unlock()
+		if busy {
+			conn.Close()
+			continue
+		}
+		go wm.serveVNC(vs, conn)
+	}
+}
+
+// serveVNC logs the viewer in, and then sends it updates and takes its
+// input until it goes away. The viewer was counted in vs.handshakes.
+func (wm *WM) serveVNC(vs *vncServer, conn net.Conn) {
+	defer conn.Close()
+	s := &vncSession{
+		Remote:   conn.RemoteAddr().String(),
+		Since:    time.Now(),
+		server:   vs,
+		conn:     conn,
+		requests: make(chan struct{}, 1),
+		keys:     map[uint32]xproto.Keycode{},
+		// This is what ServerInit announces.
+		format: rfbPixelFormat{
+			BPP: 32, Depth: 24, TrueColour: 1,
+			RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+			RedShift: 16, GreenShift: 8, BlueShift: 0,
+		},
+	}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(vncHandshakeTimeout))
+	err := wm.vncHandshake(s, r, w)
+	wm.mu.Lock()
+	vs.handshakes--
+	if err != nil {
+		wm.mu.Unlock()
+		log.Printf("VNC %s: %v", s.Remote, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	// The reserved slot is taken by the session from here.
+	vs.reserved--
+	if wm.vnc != vs {
+		wm.mu.Unlock()
+		return
+	}
+	dw, err := wm.watchDamage(xproto.Drawable(wm.xroot.Root))
+	if err != nil {
+		wm.mu.Unlock()
+		log.Printf("VNC %s: %v", s.Remote, err)
+		return
+	}
+	s.watch = dw
+	vs.sessions[s] = true
+	wm.updateVNCIndicator(vs)
+	log.Printf("VNC session from %s started (view-only: %v)", s.Remote, s.ViewOnly)
+	wm.emit("vnc.connected", map[string]interface{}{"session": s})
+	wm.mu.Unlock()
+
+	gone := make(chan struct{})
+	go func() {
+		err := wm.readVNC(s, r)
+		if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+			log.Printf("VNC %s: %v", s.Remote, err)
+		}
+		close(gone)
+	}()
+	if err := wm.updateVNC(s, w, gone); err != nil {
+		log.Printf("VNC %s: %v", s.Remote, err)
+	}
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.unwatchDamage(dw)
+	wm.releaseVNCInput(s)
+	if vs.sessions[s] {
+		delete(vs.sessions, s)
+		wm.updateVNCIndicator(vs)
+	}
+	log.Printf("VNC session from %s ended", s.Remote)
+	wm.emit("vnc.disconnected", map[string]interface{}{"session": s})
+}
+
+// vncHandshake negotiates the protocol version, checks the password,
+// and sends the framebuffer size and pixel format. RFB 3.3, 3.7 and
+// 3.8 are supported, with VNC authentication. A session slot is
+// reserved before the password is checked, and is released again if
+// the viewer isn't let in.
+func (wm *WM) vncHandshake(s *vncSession, r *bufio.Reader, w *bufio.Writer) (err error) {
+	w.WriteString("RFB 003.008\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("bad protocol version %q", version)
+	}
+	switch {
+	case minor >= 8:
+		minor = 8
+	case minor == 7:
+	default:
+		minor = 3
+	}
+
+	wm.mu.Lock()
+	vs := s.server
+	logins := vs.config.logins()
+	full := len(vs.sessions)+vs.reserved >= vs.config.MaxSessions
+	if !full {
+		vs.reserved++
+	}
+	wm.mu.Unlock()
+	if full {
+		// Zero security types, and the reason.
+		if minor == 3 {
+			binary.Write(w, binary.BigEndian, uint32(0))
+		} else {
+			w.WriteByte(0)
+		}
+		writeRFBString(w, "Too many sessions")
+		w.Flush()
+		return errors.New("too many sessions")
+	}
+	defer func() {
+		if err != nil {
+			wm.mu.Lock()
+			vs.reserved--
+			wm.mu.Unlock()
+		}
+	}()
+
+	if minor == 3 {
+		binary.Write(w, binary.BigEndian, uint32(rfbSecurityVNC))
+	} else {
+		w.Write([]byte{1, rfbSecurityVNC})
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if minor > 3 {
+		t, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if t != rfbSecurityVNC {
+			return fmt.Errorf("unknown security type %d", t)
+		}
+	}
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	w.Write(challenge)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(r, response); err != nil {
+		return err
+	}
+	ok := false
+	for _, login := range logins {
+		if subtle.ConstantTimeCompare(vncEncrypt(login.password, challenge), response) == 1 {
+			ok = true
+			s.password, s.ViewOnly = login.password, login.viewOnly
+			break
+		}
+	}
+	if !ok {
+		time.Sleep(vncAuthDelay)
+		binary.Write(w, binary.BigEndian, uint32(1))
+		if minor == 8 {
+			writeRFBString(w, "Authentication failed")
+		}
+		w.Flush()
+		wm.mu.Lock()
+		wm.emit("vnc.refused", map[string]interface{}{"remote": s.Remote})
+		wm.mu.Unlock()
+		return errors.New("authentication failed")
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// ClientInit asks whether to share the desktop, which it
+	// always is.
+	if _, err := r.ReadByte(); err != nil {
+		return err
+	}
+	wm.mu.Lock()
+	rect, err := wm.vncRect(vs)
+	wm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.width, s.height = int(rect.Width), int(rect.Height)
+	binary.Write(w, binary.BigEndian, uint16(rect.Width))
+	binary.Write(w, binary.BigEndian, uint16(rect.Height))
+	binary.Write(w, binary.BigEndian, s.format)
+	writeRFBString(w, "headless-wm")
+	return w.Flush()
+}
+
+// writeRFBString writes a string with its length first.
+func writeRFBString(w *bufio.Writer, str string) {
+	binary.Write(w, binary.BigEndian, uint32(len(str)))
+	w.WriteString(str)
+}
+
+// vncEncrypt is the response to the challenge for the password. VNC
+// uses DES with the bits of each key byte reversed.
+func vncEncrypt(password string, challenge []byte) []byte {
+	key := make([]byte, 8)
+	for i := 0; i < len(key) && i < len(password); i++ {
+		key[i] = bits.Reverse8(password[i])
+	}
+	block, _ := des.NewCipher(key)
+	out := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(out[i:i+8], challenge[i:i+8])
+	}
+	return out
+}
+
+// readVNC handles the viewer's messages, until it goes away.
+func (wm *WM) readVNC(s *vncSession, r *bufio.Reader) error {
+	buf := make([]byte, 19)
+	for {
+		t, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case rfbSetPixelFormat:
+			if _, err := io.ReadFull(r, buf[:19]); err != nil {
+				return err
+			}
+			var pf rfbPixelFormat
+			binary.Read(bytes.NewReader(buf[3:19]), binary.BigEndian, &pf)
+			if pf.TrueColour == 0 {
+				return errors.New("colour maps are not supported")
+			}
+			if pf.BPP != 8 && pf.BPP != 16 && pf.BPP != 32 {
+				return fmt.Errorf("%d bits per pixel are not supported", pf.BPP)
+			}
+			s.mu.Lock()
+			s.format = pf
+			s.mu.Unlock()
+		case rfbSetEncodings:
+			if _, err := io.ReadFull(r, buf[:3]); err != nil {
+				return err
+			}
+			encodings := make([]int32, binary.BigEndian.Uint16(buf[1:3]))
+			if err := binary.Read(r, binary.BigEndian, encodings); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.zrle, s.desktopSize = false, false
+			for _, e := range encodings {
+				switch e {
+				case rfbEncodingZRLE:
+					s.zrle = true
+				case rfbEncodingDesktopSize:
+					s.desktopSize = true
+				}
+			}
+			s.mu.Unlock()
+		case rfbFramebufferUpdateRequest:
+			// The area asked for is ignored; whatever changed
+			// is sent.
+			if _, err := io.ReadFull(r, buf[:9]); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.requested = true
+			if buf[0] == 0 {
+				s.full = true
+			}
+			s.mu.Unlock()
+			select {
+			case s.requests <- struct{}{}:
+			default:
+			}
+		case rfbKeyEvent:
+			if _, err := io.ReadFull(r, buf[:7]); err != nil {
+				return err
+			}
+			wm.vncKey(s, binary.BigEndian.Uint32(buf[3:7]), buf[0] != 0)
+		case rfbPointerEvent:
+			if _, err := io.ReadFull(r, buf[:5]); err != nil {
+				return err
+			}
+			wm.vncPointer(s, buf[0],
+				binary.BigEndian.Uint16(buf[1:3]), binary.BigEndian.Uint16(buf[3:5]))
+		case rfbClientCutText:
+			if _, err := io.ReadFull(r, buf[:7]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(buf[3:7]))); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown message type %d", t)
+		}
+	}
+}
+
+// vncKey presses or releases the key for the keysym with XTEST, unless
+// the session is view-only. Keysyms without a key are ignored. Unlike
+// SendKeys, this counts as user input for the idle thresholds, as
+// someone is at work.
+func (wm *WM) vncKey(s *vncSession, sym uint32, down bool) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if !wm.hasXTest || s.ViewOnly {
+		return
+	}
+	if !down {
+		code, ok := s.keys[sym]
+		if !ok {
+			return
+		}
+		delete(s.keys, sym)
+		xtest.FakeInput(wm.xc, xproto.KeyRelease, byte(code), 0, wm.xroot.Root, 0, 0, 0)
+		return
+	}
+	codes, _ := wm.keyMap.keycodes(xproto.Keysym(sym))
+	if len(codes) == 0 {
+		return
+	}
+	s.keys[sym] = codes[0]
+	xtest.FakeInput(wm.xc, xproto.KeyPress, byte(codes[0]), 0, wm.xroot.Root, 0, 0, 0)
+}
+
+// vncPointer moves the pointer to where it is in the viewer, and
+// presses and releases the buttons that changed, with XTEST, unless the
+// session is view-only.
+func (wm *WM) vncPointer(s *vncSession, buttons byte, x, y uint16) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if !wm.hasXTest || s.ViewOnly {
+		return
+	}
+	r, err := wm.vncRect(s.server)
+	if err != nil || r.Width == 0 || r.Height == 0 {
+		return
+	}
+	// Keep the pointer on the screen: the viewer may send any
+	// position, and its framebuffer may be out of date.
+	if x >= r.Width {
+		x = r.Width - 1
+	}
+	if y >= r.Height {
+		y = r.Height - 1
+	}
+	xtest.FakeInput(wm.xc, xproto.MotionNotify, 0, 0, wm.xroot.Root,
+		r.X+int16(x), r.Y+int16(y), 0)
+	wm.vncButtons(s, buttons)
+}
+
+// vncButtons presses and releases the buttons, to match the mask. The
+// caller must hold wm.mu.
+func (wm *WM) vncButtons(s *vncSession, buttons byte) {
+	for b := uint(0); b < 8; b++ {
+		bit := byte(1) << b
+		if (buttons^s.buttons)&bit == 0 {
+			continue
+		}
+		typ := byte(xproto.ButtonRelease)
+		if buttons&bit != 0 {
+			typ = xproto.ButtonPress
+		}
+		xtest.FakeInput(wm.xc, typ, byte(b+1), 0, wm.xroot.Root, 0, 0, 0)
+	}
+	s.buttons = buttons
+}
+
+// releaseVNCInput releases the keys and buttons the viewer left held
+// down. The caller must hold wm.mu.
+func (wm *WM) releaseVNCInput(s *vncSession) {
+	if !wm.hasXTest {
+		return
+	}
+	for sym, code := range s.keys {
+		delete(s.keys, sym)
+		xtest.FakeInput(wm.xc, xproto.KeyRelease, byte(code), 0, wm.xroot.Root, 0, 0, 0)
+	}
+	wm.vncButtons(s, 0)
+}
+
+// updateVNC sends the viewer what changed, whenever it asks for it,
+// until it goes away. With DAMAGE, only the damaged part of the screen
+// is read back.
+func (wm *WM) updateVNC(s *vncSession, w *bufio.Writer, gone <-chan struct{}) error {
+	ticker := time.NewTicker(vncUpdateInterval)
+	defer ticker.Stop()
+	dirty := true
+	rc := &rootCapture{watch: s.watch}
+	var captured time.Time
+	for {
+		select {
+		case <-gone:
+			return nil
+		case <-s.watch.dirty:
+			dirty = true
+			continue
+		case <-s.requests:
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		requested, full := s.requested, s.full
+		s.mu.Unlock()
+		if !requested {
+			continue
+		}
+		if !full {
+			if s.watch.damage != 0 && !dirty {
+				continue
+			}
+			if s.watch.damage == 0 && time.Since(captured) < vncPollInterval {
+				continue
+			}
+		}
+		wm.mu.Lock()
+		rect, err := wm.vncRect(s.server)
+		changed := false
+		if err == nil {
+			changed, err = wm.fetchRoot(rc, imageRect(rect), full)
+		}
+		wm.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		dirty = false
+		captured = time.Now()
+		if !changed {
+			continue
+		}
+		prev := rc.frame
+		img := rc.next()
+		if full || (prev != nil && prev.Bounds() != img.Bounds()) {
+			prev = nil
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := s.sendUpdate(w, prev, img); err != nil {
+			return err
+		}
+	}
+}
+
+// sendUpdate sends the tiles of img that changed since prev, or all of
+// them if prev is nil. If nothing changed, the viewer's request stays
+// pending. The framebuffer is resized if the viewer supports it.
+func (s *vncSession) sendUpdate(w *bufio.Writer, prev, img *image.RGBA) error {
+	size := img.Bounds().Size()
+	s.mu.Lock()
+	resize := s.desktopSize && (size.X != s.width || size.Y != s.height)
+	if resize {
+		s.width, s.height = size.X, size.Y
+	}
+	tiles := changedTiles(prev, img, image.Rect(0, 0, s.width, s.height).Intersect(img.Bounds()))
+	if len(tiles) == 0 && !resize {
+		s.mu.Unlock()
+		return nil
+	}
+	s.requested, s.full = false, false
+	pf, zrle := s.format, s.zrle
+	s.mu.Unlock()
+
+	n := len(tiles)
+	if resize {
+		n++
+	}
+	w.Write([]byte{0, 0}) // FramebufferUpdate
+	binary.Write(w, binary.BigEndian, uint16(n))
+	if resize {
+		writeRFBRect(w, image.Rect(0, 0, size.X, size.Y), rfbEncodingDesktopSize)
+	}
+	px := make([]byte, 4)
+	for _, t := range tiles {
+		if zrle {
+			writeRFBRect(w, t, rfbEncodingZRLE)
+			s.writeZRLE(w, img, t, &pf)
+			continue
+		}
+		writeRFBRect(w, t, rfbEncodingRaw)
+		for y := t.Min.Y; y < t.Max.Y; y++ {
+			for x := t.Min.X; x < t.Max.X; x++ {
+				w.Write(pf.pixel(px, img, x, y))
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// changedTiles lists the tiles of the area that differ between prev
+// and img, or all of them if prev is nil.
+func changedTiles(prev, img *image.RGBA, area image.Rectangle) []image.Rectangle {
+	var tiles []image.Rectangle
+	for y := area.Min.Y; y < area.Max.Y; y += vncTile {
+		for x := area.Min.X; x < area.Max.X; x += vncTile {
+			t := image.Rect(x, y, x+vncTile, y+vncTile).Intersect(area)
+			if prev == nil || tileChanged(prev, img, t) {
+				tiles = append(tiles, t)
+			}
+		}
+	}
+	return tiles
+}
+
+// tileChanged compares a tile of two images of the same size.
+func tileChanged(prev, img *image.RGBA, t image.Rectangle) bool {
+	for y := t.Min.Y; y < t.Max.Y; y++ {
+		i := img.PixOffset(t.Min.X, y)
+		j := i + 4*t.Dx()
+		if !bytes.Equal(prev.Pix[i:j], img.Pix[i:j]) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRFBRect writes a rectangle header.
+func writeRFBRect(w *bufio.Writer, r image.Rectangle, encoding int32) {
+	binary.Write(w, binary.BigEndian, []uint16{
+		uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()),
+	})
+	binary.Write(w, binary.BigEndian, encoding)
+}
+
+// writeZRLE writes the tile ZRLE-encoded, either as a solid colour or
+// as raw compressed pixels. All rectangles of a session share one zlib
+// stream.
+func (s *vncSession) writeZRLE(w *bufio.Writer, img *image.RGBA, t image.Rectangle, pf *rfbPixelFormat) {
+	if s.zw == nil {
+		s.zw = zlib.NewWriter(&s.zbuf)
+	}
+	offset, size := pf.cpixel()
+	px := make([]byte, 4)
+	first := img.PixOffset(t.Min.X, t.Min.Y)
+	solid := true
+	for y := t.Min.Y; y < t.Max.Y && solid; y++ {
+		for x := t.Min.X; x < t.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			if !bytes.Equal(img.Pix[i:i+3], img.Pix[first:first+3]) {
+				solid = false
+				break
+			}
+		}
+	}
+	tile := s.tile[:0]
+	if solid {
+		tile = append(tile, 1)
+		tile = append(tile, pf.pixel(px, img, t.Min.X, t.Min.Y)[offset:offset+size]...)
+	} else {
+		tile = append(tile, 0)
+		for y := t.Min.Y; y < t.Max.Y; y++ {
+			for x := t.Min.X; x < t.Max.X; x++ {
+				tile = append(tile, pf.pixel(px, img, x, y)[offset:offset+size]...)
+			}
+		}
+	}
+	s.tile = tile
+	s.zw.Write(tile)
+	s.zw.Flush()
+	binary.Write(w, binary.BigEndian, uint32(s.zbuf.Len()))
+	w.Write(s.zbuf.Bytes())
+	s.zbuf.Reset()
+}
+
+// pixel encodes the image's pixel at x and y in the pixel format, into
+// buf, and returns the bytes used.
+func (pf *rfbPixelFormat) pixel(buf []byte, img *image.RGBA, x, y int) []byte {
+	i := img.PixOffset(x, y)
+	v := uint32(img.Pix[i])*uint32(pf.RedMax)/0xff<<pf.RedShift |
+		uint32(img.Pix[i+1])*uint32(pf.GreenMax)/0xff<<pf.GreenShift |
+		uint32(img.Pix[i+2])*uint32(pf.BlueMax)/0xff<<pf.BlueShift
+	var order binary.ByteOrder = binary.LittleEndian
+	if pf.BigEndian != 0 {
+		order = binary.BigEndian
+	}
+	switch pf.BPP {
+	case 8:
+		buf[0] = byte(v)
+		return buf[:1]
+	case 16:
+		order.PutUint16(buf, uint16(v))
+		return buf[:2]
+	}
+	order.PutUint32(buf, v)
+	return buf[:4]
+}
+
+// cpixel returns where in a pixel ZRLE's compressed pixel is, and its
+// size. It is 3 bytes for 32 bit pixels that have their colours in
+// either the 3 lower or the 3 upper bytes.
+func (pf *rfbPixelFormat) cpixel() (offset, size int) {
+	size = int(pf.BPP / 8)
+	if pf.BPP != 32 || pf.Depth > 24 {
+		return 0, size
+	}
+	colours := uint32(pf.RedMax)<<pf.RedShift |
+		uint32(pf.GreenMax)<<pf.GreenShift |
+		uint32(pf.BlueMax)<<pf.BlueShift
+	lower := pf.BigEndian == 0
+	switch {
+	case colours&0xff000000 == 0:
+	case colours&0xff == 0:
+		lower = !lower
+	default:
+		return 0, size
+	}
+	if lower {
+		return 0, 3
+	}
+	return 1, 3
+}
+
+// vncStatus describes the VNC server for the API. The caller must hold
+// wm.mu.
+func (wm *WM) vncStatus() map[string]interface{} {
+	vs := wm.vnc
+	if vs == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	sessions := []*vncSession{}
+	for s := range vs.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Since.Before(sessions[j].Since)
+	})
+	return map[string]interface{}{
+		"enabled":  true,
+		"listen":   vs.listener.Addr().String(),
+		"screen":   vs.config.Screen,
+		"sessions": sessions,
+	}
+}
+
+func (as *APIServer) remoteRoutes(router *mux.Router) {
+	router.HandleFunc("/remote/vnc", as.locked(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			// Settings not given are kept.
+			vc := as.wm.config.Remote.VNC
+			if vs := as.wm.vnc; vs != nil {
+				vc = vs.config
+			}
+			if err := json.NewDecoder(r.Body).Decode(&vc); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			vc.setDefaults()
+			if err := vc.Validate(); err != nil {
+				errorResponse(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			if err := as.wm.applyVNCConfig(&vc); err != nil {
+				errorResponse(w, r, http.StatusConflict, err)
+				return
+			}
+		}
+		jsonResponse(w, r, 200, as.wm.vncStatus())
+	})).Methods("GET", "POST")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestVNCEncrypt(t *testing.T) {
+	tests := []struct {
+		name      string
+		password  string
+		challenge string
+		want      string
+	}{
+		// The well-known worked DES example, with key
+		// 133457799bbcdff1. VNC reverses the bits of each
+		// password byte to make the key.
+		{
+			name:      "reversed key",
+			password:  "\xc8\x2c\xea\x9e\xd9\x3d\xfb\x8f",
+			challenge: "0123456789abcdef0123456789abcdef",
+			want:      "85e813540f0ab40585e813540f0ab405",
+		},
+		// An empty password is an all-zero key.
+		{
+			name:      "empty",
+			password:  "",
+			challenge: "00000000000000000000000000000000",
+			want:      "8ca64de9c1b123a78ca64de9c1b123a7",
+		},
+		// The high bit of each byte is reversed into the
+		// parity bit, which DES ignores.
+		{
+			name:      "parity",
+			password:  "\x80\x80\x80\x80\x80\x80\x80\x80",
+			challenge: "00000000000000000000000000000000",
+			want:      "8ca64de9c1b123a78ca64de9c1b123a7",
+		},
+		// Passwords are cut to 8 characters.
+		{
+			name:      "long",
+			password:  "\xc8\x2c\xea\x9e\xd9\x3d\xfb\x8fmore",
+			challenge: "0123456789abcdef0123456789abcdef",
+			want:      "85e813540f0ab40585e813540f0ab405",
+		},
+	}
+	for _, tt := range tests {
+		challenge, _ := hex.DecodeString(tt.challenge)
+		want, _ := hex.DecodeString(tt.want)
+		if got := vncEncrypt(tt.password, challenge); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestCPixel(t *testing.T) {
+	tests := []struct {
+		name         string
+		pf           rfbPixelFormat
+		offset, size int
+	}{
+		{
+			name: "32 bit, low bytes, little-endian",
+			pf: rfbPixelFormat{BPP: 32, Depth: 24, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 16, GreenShift: 8, BlueShift: 0},
+			offset: 0, size: 3,
+		},
+		{
+			name: "32 bit, low bytes, big-endian",
+			pf: rfbPixelFormat{BPP: 32, Depth: 24, BigEndian: 1, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 16, GreenShift: 8, BlueShift: 0},
+			offset: 1, size: 3,
+		},
+		{
+			name: "32 bit, high bytes, little-endian",
+			pf: rfbPixelFormat{BPP: 32, Depth: 24, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 24, GreenShift: 16, BlueShift: 8},
+			offset: 1, size: 3,
+		},
+		{
+			name: "32 bit, high bytes, big-endian",
+			pf: rfbPixelFormat{BPP: 32, Depth: 24, BigEndian: 1, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 24, GreenShift: 16, BlueShift: 8},
+			offset: 0, size: 3,
+		},
+		{
+			name: "32 bit, spread over all bytes",
+			pf: rfbPixelFormat{BPP: 32, Depth: 24, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 24, GreenShift: 8, BlueShift: 0},
+			offset: 0, size: 4,
+		},
+		{
+			name: "32 bit, depth 32",
+			pf: rfbPixelFormat{BPP: 32, Depth: 32, TrueColour: 1,
+				RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+				RedShift: 16, GreenShift: 8, BlueShift: 0},
+			offset: 0, size: 4,
+		},
+		{
+			name: "16 bit",
+			pf: rfbPixelFormat{BPP: 16, Depth: 16, TrueColour: 1,
+				RedMax: 0x1f, GreenMax: 0x3f, BlueMax: 0x1f,
+				RedShift: 11, GreenShift: 5, BlueShift: 0},
+			offset: 0, size: 2,
+		},
+		{
+			name: "8 bit",
+			pf: rfbPixelFormat{BPP: 8, Depth: 8, TrueColour: 1,
+				RedMax: 7, GreenMax: 7, BlueMax: 3,
+				RedShift: 0, GreenShift: 3, BlueShift: 6},
+			offset: 0, size: 1,
+		},
+	}
+	for _, tt := range tests {
+		if offset, size := tt.pf.cpixel(); offset != tt.offset || size != tt.size {
+			t.Errorf("%s: got (%d, %d), want (%d, %d)", tt.name, offset, size, tt.offset, tt.size)
+		}
+	}
+}
+
+func TestChangedTiles(t *testing.T) {
+	// Two columns of full tiles and one 2 pixels wide, and a row of
+	// full tiles and one 6 pixels high.
+	bounds := image.Rect(0, 0, 2*vncTile+2, vncTile+6)
+	prev := image.NewRGBA(bounds)
+	all := []image.Rectangle{
+		image.Rect(0, 0, vncTile, vncTile),
+		image.Rect(vncTile, 0, 2*vncTile, vncTile),
+		image.Rect(2*vncTile, 0, 2*vncTile+2, vncTile),
+		image.Rect(0, vncTile, vncTile, vncTile+6),
+		image.Rect(vncTile, vncTile, 2*vncTile, vncTile+6),
+		image.Rect(2*vncTile, vncTile, 2*vncTile+2, vncTile+6),
+	}
+	if got := changedTiles(nil, prev, bounds); !reflect.DeepEqual(got, all) {
+		t.Errorf("without a previous image: got %v, want %v", got, all)
+	}
+
+	img := image.NewRGBA(bounds)
+	if got := changedTiles(prev, img, bounds); len(got) != 0 {
+		t.Errorf("unchanged: got %v", got)
+	}
+
+	img.Pix[img.PixOffset(vncTile+36, vncTile+1)] = 0xff
+	img.Pix[img.PixOffset(2*vncTile+1, 0)+3] = 0xff
+	want := []image.Rectangle{all[2], all[4]}
+	if got := changedTiles(prev, img, bounds); !reflect.DeepEqual(got, want) {
+		t.Errorf("changed: got %v, want %v", got, want)
+	}
+
+	// Changes outside the area are left out.
+	area := image.Rect(0, 0, 2*vncTile, vncTile)
+	if got := changedTiles(prev, img, area); len(got) != 0 {
+		t.Errorf("changes outside the area: got %v", got)
+	}
+}
@@ -2,30 +2,192 @@ package main
 
 import (
 	"errors"
+	"image"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/dpms"
+	"github.com/BurntSushi/xgb/render"
+	"github.com/BurntSushi/xgb/xfixes"
 	"github.com/BurntSushi/xgb/xinerama"
 	"github.com/BurntSushi/xgb/xproto"
 )
 
 // WM holds the global window manager state.
 type WM struct {
+	// mu serializes access to the WM state between the X event
+	// loop, the API server, and timers.
+	mu sync.Mutex
+
 	xc *xgb.Conn
 
 	xroot           xproto.ScreenInfo
 	attachedScreens []xinerama.ScreenInfo
 
-	clients      map[xproto.Window]*Client
-	activeClient *Client
+	clients       map[xproto.Window]*Client
+	activeClient  *Client
+	focusPolicies *FocusPolicies
+	// focusHistory lists the focused clients, most recent first.
+	focusHistory []*Client
+	// focusCursor is the index in focusHistory that
+	// FocusPrevious stepped back to.
+	focusCursor int
+
+	api    *APIServer
+	events *EventBus
+
+	config     *Config
+	configPath string
+	apps       map[string]*App
+
+	// layout holds the persisted client layouts, keyed by
+	// layoutKey.
+	layout map[string]*ClientLayout
+	// playlists maps screen indices to their running playlists.
+	playlists map[int]*Playlist
+	schedules map[string]*Schedule
+	// dpmsHeld are the DPMS timeouts from before DPMS was enabled
+	// only to hold a forced power level. They are put back when it
+	// is disabled again.
+	dpmsHeld *dpms.GetTimeoutsReply
+
+	hasDPMS        bool
+	hasScreenSaver bool
+	hasXTest       bool
+	hasXFixes      bool
+	hasBarriers    bool
+	hasXInput      bool
+	hasRandR       bool
+	// hasCompositing is set if the compositor can run, and
+	// pictFormats are the XRender formats of the visuals. hasDamage
+	// is set if streams can wait for damage.
+	hasCompositing bool
+	hasDamage      bool
+	pictFormats    map[xproto.Visualid]render.Pictformat
+	// compositor is set while the built-in compositor runs.
+	compositor *compositor
+
+	// xiOpcode is the major opcode of the XInput extension.
+	xiOpcode byte
+	// deviceMappings map input devices to screens or outputs, and
+	// deviceOverrides are the mappings set through the API, which
+	// are persisted and take precedence. knownDevices are the
+	// devices seen by the device monitor, by ID.
+	deviceMappings  []*DeviceMapping
+	deviceOverrides []*DeviceMapping
+	knownDevices    map[uint16]string
+
+	keyMap *keyMap
+	// keyGrabs maps the key combinations grabbed on the root
+	// window to what they are used for.
+	keyGrabs    map[keyCombo]*keyGrab
+	blockedKeys []KeyChord
+	hotkeys     map[string]*Hotkey
+	// keySeq is the hotkey sequence in progress, if any.
+	keySeq *keySequence
+
+	// maintenance is set while in maintenance mode.
+	maintenance       *Maintenance
+	maintenanceHotkey *Hotkey
+	// buttonsGrabbed is set while we grab all clicks on the root
+	// window.
+	buttonsGrabbed bool
+	cornerTaps     []time.Time
+	// gesturePress is the press being followed for gestures, and
+	// gestureTaps the recent corner taps of each gesture.
+	gesturePress *gesturePress
+	gestureTaps  map[string][]time.Time
+	// touchTaps are the taps in progress, by touch device.
+	touchTaps map[uint16]*touchTap
+	// fakeInputAt is when we last sent input with XTEST.
+	fakeInputAt time.Time
+	// lastInput is when the user last touched an input device.
+	lastInput time.Time
+	// idleActive holds the names of the idle thresholds reached
+	// since lastInput.
+	idleActive map[string]bool
+
+	// overlays are the WM's own message windows, by ID.
+	overlays      map[int]*Overlay
+	lastOverlayID int
+	// diagnosticsOverlay is the ID of the diagnostics overlay.
+	diagnosticsOverlay int
 
-	api *APIServer
+	// backgrounds are the screen backgrounds set through the API.
+	backgrounds map[int]*Background
+	// images are the decoded background images from the config,
+	// by path.
+	images map[string]*image.RGBA
+	// splash holds the screens still showing the splash image.
+	splash map[int]bool
+	// paintedBackgrounds is what each screen's background showed
+	// when the root window was last painted.
+	paintedBackgrounds []string
+	rootPixmap         xproto.Pixmap
+
+	// cursorConfig is the cursor config in effect.
+	cursorConfig *CursorConfig
+	rootCursor   xproto.Cursor
+	blankCursor  xproto.Cursor
+	cursorHidden bool
+	// pointerX and pointerY are where the pointer was last seen,
+	// on pointerScreen, and lastMotion is when it moved there.
+	pointerX, pointerY int16
+	pointerScreen      int
+	lastMotion         time.Time
+	// pointerConfinement is what the pointer is confined to, by
+	// the barriers around confinedTo.
+	pointerConfinement *PointerConfinement
+	confinedTo         xproto.Rectangle
+	barriers           []xfixes.Barrier
+
+	// damageWatches are the streams and remote sessions waiting
+	// for damage, by their damage object.
+	damageWatches map[damage.Damage]*damageWatch
+	// streamViewers counts the open streams.
+	streamViewers int
+	// vnc is set while the VNC server runs.
+	vnc *vncServer
+
+	// restored is the state carried over an in-place restart, if
+	// any.
+	restored *restartState
 }
 
 // NewWM allocates internal WM data structures and creates a WM
 // instance. No X11 calls are made until WM.Init() is called.
 func NewWM() *WM {
+	config := DefaultConfig()
 	return &WM{
 		clients: map[xproto.Window]*Client{},
+		events:  NewEventBus(config.Events.History),
+		config:  config,
+		apps:    map[string]*App{},
+
+		focusPolicies: config.focusPolicies(),
+		layout:        map[string]*ClientLayout{},
+
+		playlists: map[int]*Playlist{},
+		schedules: map[string]*Schedule{},
+
+		idleActive: map[string]bool{},
+		keyGrabs:   map[keyCombo]*keyGrab{},
+		hotkeys:    map[string]*Hotkey{},
+
+		gestureTaps:   map[string][]time.Time{},
+		touchTaps:     map[uint16]*touchTap{},
+		damageWatches: map[damage.Damage]*damageWatch{},
+
+		overlays: map[int]*Overlay{},
+
+		backgrounds: map[int]*Background{},
+		images:      map[string]*image.RGBA{},
+		splash:      map[int]bool{},
+
+		cursorConfig: &CursorConfig{},
 	}
 }
 
@@ -44,12 +206,37 @@ func (wm *WM) Init() (err error) {
 	if err = wm.initAtoms(); err != nil {
 		return
 	}
-	if err = wm.initWM(); err != nil {
+	if err = wm.initPower(); err != nil {
+		return
+	}
+	if err = wm.initKeys(); err != nil {
+		return
+	}
+	if err = wm.initXFixes(); err != nil {
+		return
+	}
+	wm.initDevices()
+	wm.initDamage()
+	wm.initCompositing()
+	if wm.restored != nil {
+		err = wm.initWMRetrying()
+	} else {
+		err = wm.initWM()
+	}
+	if err != nil {
 		return
 	}
+	if err = wm.loadState(); err != nil {
+		log.Printf("loading state: %v", err)
+	}
 	if err = wm.initClients(); err != nil {
 		return
 	}
+	wm.initBackgrounds()
+	if wm.restored != nil {
+		wm.rehydrate(wm.restored)
+		wm.restored = nil
+	}
 
 	return
 }
@@ -95,6 +282,26 @@ func (wm *WM) initScreens() error {
 	return nil
 }
 
+// initXFixes sets up XFixes, which makes overlays transparent to
+// input, hides the cursor, and confines the pointer with barriers.
+// Without it, overlays swallow clicks, the cursor is hidden with a
+// blank cursor, and the pointer can't be confined.
+func (wm *WM) initXFixes() error {
+	if err := xfixes.Init(wm.xc); err != nil {
+		log.Printf("XFIXES: %v", err)
+		return nil
+	}
+	// The version must be queried before any other request.
+	version, err := xfixes.QueryVersion(wm.xc, 5, 0).Reply()
+	if err != nil {
+		return err
+	}
+	wm.hasXFixes = true
+	// Pointer barriers came with version 5.
+	wm.hasBarriers = version.MajorVersion >= 5
+	return nil
+}
+
 func (wm *WM) updateScreens() error {
 	// TODO: randr
 	if r, err := xinerama.QueryScreens(wm.xc).Reply(); err != nil {
@@ -114,9 +321,9 @@ func (wm *WM) initClients() error {
 		return nil
 	}
 	for _, win := range tree.Children {
-		err = wm.handleNewWindow(win)
-		if err != nil {
-			return err
+		// Windows may go away while they are being adopted.
+		if err := wm.adoptWindow(win); err != nil {
+			log.Printf("adopting window %d: %v", win, err)
 		}
 	}
 	return nil
@@ -127,9 +334,25 @@ func (wm *WM) handleNewWindow(win xproto.Window) error {
 		return nil
 	}
 	c := NewClient(wm.xc, win)
-	// TODO: apply position/size policy
-	c.MakeFullscreen(&wm.attachedScreens[0])
-	err := c.Init()
+	var err error
+	if c.Instance, c.Class, err = c.GetClass(); err != nil {
+		return err
+	}
+	if c.Role, err = c.GetRole(); err != nil {
+		return err
+	}
+	if c.TransientFor, err = c.GetTransientFor(); err != nil {
+		return err
+	}
+	if c.Type, err = c.GetWindowType(); err != nil {
+		return err
+	}
+	if wm.restoreLayout(c) {
+		c.layoutRestored = true
+	} else if err = wm.placeClient(c); err != nil {
+		return err
+	}
+	err = c.Init()
 	if err != nil {
 		return err
 	}
@@ -137,19 +360,53 @@ func (wm *WM) handleNewWindow(win xproto.Window) error {
 	return nil
 }
 
+// defaultScreen returns the screen new windows are placed on.
+func (wm *WM) defaultScreen() *xinerama.ScreenInfo {
+	n := wm.config.DefaultScreen
+	if n >= len(wm.attachedScreens) {
+		n = 0
+	}
+	return &wm.attachedScreens[n]
+}
+
+// placeClient applies the configured position/size policy to a new
+// client.
+func (wm *WM) placeClient(c *Client) error {
+	if wm.config.Placement != PlacementFullscreen {
+		geom, err := xproto.GetGeometry(wm.xc, xproto.Drawable(c.window)).Reply()
+		if err != nil {
+			return err
+		}
+		c.X, c.Y, c.W, c.H = geom.X, geom.Y, geom.Width, geom.Height
+	}
+	wm.applyPlacement(c, wm.defaultScreen())
+	return nil
+}
+
+// applyPlacement applies the configured position/size policy to the
+// geometry the client has or asked for, on the given screen.
+func (wm *WM) applyPlacement(c *Client, screen *xinerama.ScreenInfo) {
+	switch wm.config.Placement {
+	case PlacementFullscreen:
+		c.MakeFullscreen(screen)
+	case PlacementCentered:
+		if c.W > screen.Width {
+			c.W = screen.Width
+		}
+		if c.H > screen.Height {
+			c.H = screen.Height
+		}
+		c.X = screen.XOrg + (int16(screen.Width)-int16(c.W))/2
+		c.Y = screen.YOrg + (int16(screen.Height)-int16(c.H))/2
+	}
+}
+
 func (wm *WM) initWM() error {
 	err := xproto.ChangeWindowAttributesChecked(
 		wm.xc,
 		wm.xroot.Root,
 		xproto.CwEventMask,
-		[]uint32{
-			xproto.EventMaskKeyPress |
-				xproto.EventMaskKeyRelease |
-				xproto.EventMaskButtonPress |
-				xproto.EventMaskButtonRelease |
-				xproto.EventMaskStructureNotify |
-				xproto.EventMaskSubstructureRedirect,
-		},
+		[]uint32{wm.rootEventMask()},
 	).Check()
 	if err != nil {
 		if _, ok := err.(xproto.AccessError); ok {
@@ -171,6 +428,14 @@ func (wm *WM) GetClient(w xproto.Window) *Client {
 	return c
 }
 
+// clientID returns the window ID of the client, or 0 for nil.
+func clientID(c *Client) xproto.Window {
+	if c == nil {
+		return 0
+	}
+	return c.window
+}
+
 // ForgetClient removes the client from managed clients list.
 func (wm *WM) ForgetClient(clientKey *Client) {
 	var winKey *xproto.Window = nil
@@ -182,4 +447,15 @@ func (wm *WM) ForgetClient(clientKey *Client) {
 	if winKey != nil {
 		delete(wm.clients, *winKey)
 	}
+	wm.forgetFocus(clientKey)
+	wm.forgetConfinement(clientKey)
+	if clientKey != nil {
+		wm.stopFade(clientKey)
+	}
+	order, err := wm.stackingOrder()
+	if err != nil {
+		log.Printf("stacking order: %v", err)
+		return
+	}
+	wm.setClientListStacking(order)
 }
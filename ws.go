@@ -18,7 +18,6 @@ func __wsHandlerEcho(ctx context.Context, c *websocket.Conn) {
 		log.Printf("recv: %#v", bs)
 		c.Write(ctx, t, bs)
 	}
-	c.Close(websocket.StatusNormalClosure, "")
 }
 
 func makeWSHandler(
@@ -1,18 +1,54 @@
 package main
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/BurntSushi/xgb"
 	"github.com/BurntSushi/xgb/xproto"
 )
 
 // ICCCM related atoms
 var (
-	atomWMProtocols     xproto.Atom
-	atomWMDeleteWindow  xproto.Atom
-	atomWMTakeFocus     xproto.Atom
-	atomWMName          xproto.Atom
-	atomNETActiveWindow xproto.Atom
-	atomNETWMName       xproto.Atom
+	atomWMProtocols      xproto.Atom
+	atomWMDeleteWindow   xproto.Atom
+	atomWMTakeFocus      xproto.Atom
+	atomWMName           xproto.Atom
+	atomWMWindowRole     xproto.Atom
+	atomNETActiveWindow  xproto.Atom
+	atomNETWMName        xproto.Atom
+	atomWMState          xproto.Atom
+	atomWMChangeState    xproto.Atom
+	atomNETWMState       xproto.Atom
+	atomNETWMStateHidden xproto.Atom
+
+	atomNETWMWindowType     xproto.Atom
+	atomNETWMUserTime       xproto.Atom
+	atomNETWMUserTimeWindow xproto.Atom
+
+	atomNETClientListStacking xproto.Atom
+	atomNETWMWindowOpacity    xproto.Atom
+	atomXRootPmapID           xproto.Atom
+	atomESetRootPmapID        xproto.Atom
+
+	atomCoordTransMatrix xproto.Atom
+	atomDeviceNode       xproto.Atom
+	atomFloat            xproto.Atom
+
+	// atomNETWMCMS is _NET_WM_CM_Sn, owned by the compositing
+	// manager of our screen.
+	atomNETWMCMS xproto.Atom
+)
+
+// windowTypes maps the _NET_WM_WINDOW_TYPE_* atoms to the type names
+// used in Client.Type, like "dialog".
+var windowTypes = map[xproto.Atom]string{}
+
+// ICCCM 4.1.3.1 WM_STATE values
+const (
+	WithdrawnState = 0
+	NormalState    = 1
+	IconicState    = 3
 )
 
 func (wm *WM) initAtoms() error {
@@ -20,8 +56,32 @@ func (wm *WM) initAtoms() error {
 	atomWMDeleteWindow = getAtom(wm.xc, "WM_DELETE_WINDOW")
 	atomWMTakeFocus = getAtom(wm.xc, "WM_TAKE_FOCUS")
 	atomWMName = getAtom(wm.xc, "WM_NAME")
+	atomWMWindowRole = getAtom(wm.xc, "WM_WINDOW_ROLE")
 	atomNETActiveWindow = getAtom(wm.xc, "_NET_ACTIVE_WINDOW")
 	atomNETWMName = getAtom(wm.xc, "_NET_WM_NAME")
+	atomWMState = getAtom(wm.xc, "WM_STATE")
+	atomWMChangeState = getAtom(wm.xc, "WM_CHANGE_STATE")
+	atomNETWMState = getAtom(wm.xc, "_NET_WM_STATE")
+	atomNETWMStateHidden = getAtom(wm.xc, "_NET_WM_STATE_HIDDEN")
+	atomNETWMWindowType = getAtom(wm.xc, "_NET_WM_WINDOW_TYPE")
+	atomNETWMUserTime = getAtom(wm.xc, "_NET_WM_USER_TIME")
+	atomNETWMUserTimeWindow = getAtom(wm.xc, "_NET_WM_USER_TIME_WINDOW")
+	atomNETClientListStacking = getAtom(wm.xc, "_NET_CLIENT_LIST_STACKING")
+	atomNETWMWindowOpacity = getAtom(wm.xc, "_NET_WM_WINDOW_OPACITY")
+	atomXRootPmapID = getAtom(wm.xc, "_XROOTPMAP_ID")
+	atomESetRootPmapID = getAtom(wm.xc, "ESETROOT_PMAP_ID")
+	atomCoordTransMatrix = getAtom(wm.xc, "Coordinate Transformation Matrix")
+	atomDeviceNode = getAtom(wm.xc, "Device Node")
+	atomFloat = getAtom(wm.xc, "FLOAT")
+	atomNETWMCMS = getAtom(wm.xc, "_NET_WM_CM_S"+strconv.Itoa(wm.xc.DefaultScreen))
+	for _, name := range []string{
+		"desktop", "dock", "toolbar", "menu", "utility", "splash",
+		"dialog", "dropdown_menu", "popup_menu", "tooltip",
+		"notification", "combo", "dnd", "normal",
+	} {
+		atom := getAtom(wm.xc, "_NET_WM_WINDOW_TYPE_"+strings.ToUpper(name))
+		windowTypes[atom] = name
+	}
 	return nil
 }
 
@@ -42,3 +102,22 @@ func decodeAtom(v []byte) xproto.Atom {
 	return xproto.Atom(uint32(v[0]) | uint32(v[1])<<8 |
 		uint32(v[2])<<16 | uint32(v[3])<<24)
 }
+
+// encodeUint32s encodes a list of CARDINAL / ATOM / WINDOW values as
+// a format 32 property value.
+func encodeUint32s(vs ...uint32) []byte {
+	bs := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		xgb.Put32(bs[4*i:], v)
+	}
+	return bs
+}
+
+// decodeUint32s is the inverse of encodeUint32s.
+func decodeUint32s(bs []byte) []uint32 {
+	vs := make([]uint32, len(bs)/4)
+	for i := range vs {
+		vs[i] = xgb.Get32(bs[4*i:])
+	}
+	return vs
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// xgb has no XInput bindings, so the few XInput2 requests we need are
+// encoded here. XI2 events are GenericEvents, which xgb can't read, so
+// we never select any on its connection; touch events are read on a
+// connection of their own, in touch.go.
+
+// XI2 request minor opcodes.
+const (
+	xiQueryVersion   = 47
+	xiQueryDevice    = 48
+	xiChangeProperty = 57
+	xiGetProperty    = 59
+)
+
+// XI2 device uses.
+const (
+	xiMasterPointer  = 1
+	xiMasterKeyboard = 2
+	xiSlavePointer   = 3
+	xiSlaveKeyboard  = 4
+	xiFloatingSlave  = 5
+)
+
+var xiDeviceUses = map[uint16]string{
+	xiMasterPointer:  "master-pointer",
+	xiMasterKeyboard: "master-keyboard",
+	xiSlavePointer:   "pointer",
+	xiSlaveKeyboard:  "keyboard",
+	xiFloatingSlave:  "floating",
+}
+
+// xiTouchClass is the class of devices that send touch events.
+const xiTouchClass = 8
+
+// xiErrorNames are the XInput errors, from the first error code on.
+var xiErrorNames = []string{"BadDevice", "BadEvent", "BadMode", "DeviceBusy", "BadClass"}
+
+// xiFirstError is the first XInput error code, or -1 until XInput is
+// initialized. It is read by decodeExtensionError, in xgb's reader
+// goroutine.
+var xiFirstError int32 = -1
+
+// xgb drops errors it has no decoder for, and the requests that caused
+// them never return. Its table of decoders can't be changed once a
+// connection reads from the server, so decodeExtensionError is set up
+// front for all extension error codes. The extensions xgb knows put in
+// their own decoders when they are initialized.
+func init() {
+	for code := 128; code < 256; code++ {
+		if _, ok := xgb.NewErrorFuncs[code]; !ok {
+			xgb.NewErrorFuncs[code] = decodeExtensionError
+		}
+	}
+}
+
+// extensionError is an error from XInput, or another extension xgb
+// doesn't know.
+type extensionError struct {
+	name     string
+	sequence uint16
+	badValue uint32
+}
+
+func (err extensionError) SequenceId() uint16 { return err.sequence }
+func (err extensionError) BadId() uint32      { return err.badValue }
+func (err extensionError) Error() string {
+	return fmt.Sprintf("%s {Sequence: %d, BadValue: %d}", err.name, err.sequence, err.badValue)
+}
+
+func decodeExtensionError(buf []byte) xgb.Error {
+	code := int(buf[1])
+	name := fmt.Sprintf("extension error %d", code)
+	if first := int(atomic.LoadInt32(&xiFirstError)); first >= 0 &&
+		code >= first && code-first < len(xiErrorNames) {
+		name = xiErrorNames[code-first]
+	}
+	return extensionError{
+		name:     name,
+		sequence: xgb.Get16(buf[2:]),
+		badValue: xgb.Get32(buf[4:]),
+	}
+}
+
+// xiDevice is a device from XIQueryDevice.
+type xiDevice struct {
+	id         uint16
+	use        uint16
+	attachment uint16
+	enabled    bool
+	name       string
+	touch      bool
+}
+
+// initXInput finds the XInput extension and announces XI 2.2 support,
+// which the XI2 requests need.
+func (wm *WM) initXInput() error {
+	reply, err := xproto.QueryExtension(wm.xc, 15, "XInputExtension").Reply()
+	if err != nil {
+		return err
+	}
+	if !reply.Present {
+		return errors.New("No XInputExtension")
+	}
+	wm.xiOpcode = reply.MajorOpcode
+	atomic.StoreInt32(&xiFirstError, int32(reply.FirstError))
+	buf := wm.xiRequest(xiQueryVersion, 4)
+	xgb.Put16(buf[4:], 2)
+	xgb.Put16(buf[6:], 2)
+	version, err := wm.xiReply(buf)
+	if err != nil {
+		return err
+	}
+	if major, minor := xgb.Get16(version[8:]), xgb.Get16(version[10:]); major < 2 || major == 2 && minor < 2 {
+		return fmt.Errorf("XInput %d.%d is too old", major, minor)
+	}
+	return nil
+}
+
+// xiRequest allocates an XI request with n bytes after the header.
+func (wm *WM) xiRequest(minor byte, n int) []byte {
+	buf := make([]byte, 4+xgb.Pad(n))
+	buf[0] = wm.xiOpcode
+	buf[1] = minor
+	xgb.Put16(buf[2:], uint16(len(buf)/4))
+	return buf
+}
+
+func (wm *WM) xiReply(buf []byte) ([]byte, error) {
+	cookie := wm.xc.NewCookie(true, true)
+	wm.xc.NewRequest(buf, cookie)
+	return cookie.Reply()
+}
+
+func (wm *WM) xiCheck(buf []byte) error {
+	cookie := wm.xc.NewCookie(true, false)
+	wm.xc.NewRequest(buf, cookie)
+	return cookie.Check()
+}
+
+// xiQueryDevices lists all input devices.
+func (wm *WM) xiQueryDevices() ([]xiDevice, error) {
+	buf := wm.xiRequest(xiQueryDevice, 4)
+	xgb.Put16(buf[4:], 0) // XIAllDevices
+	reply, err := wm.xiReply(buf)
+	if err != nil {
+		return nil, err
+	}
+	n := int(xgb.Get16(reply[8:]))
+	devices := make([]xiDevice, 0, n)
+	b := 32
+	for i := 0; i < n; i++ {
+		if b+12 > len(reply) {
+			return nil, errors.New("short XIQueryDevice reply")
+		}
+		d := xiDevice{
+			id:         xgb.Get16(reply[b:]),
+			use:        xgb.Get16(reply[b+2:]),
+			attachment: xgb.Get16(reply[b+4:]),
+			enabled:    reply[b+10] != 0,
+		}
+		numClasses := int(xgb.Get16(reply[b+6:]))
+		nameLen := int(xgb.Get16(reply[b+8:]))
+		b += 12
+		if b+nameLen > len(reply) {
+			return nil, errors.New("short XIQueryDevice reply")
+		}
+		d.name = string(reply[b : b+nameLen])
+		b += xgb.Pad(nameLen)
+		for j := 0; j < numClasses; j++ {
+			if b+4 > len(reply) {
+				return nil, errors.New("short XIQueryDevice reply")
+			}
+			if xgb.Get16(reply[b:]) == xiTouchClass {
+				d.touch = true
+			}
+			b += 4 * int(xgb.Get16(reply[b+2:]))
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// xiGetProperty reads a device property. It returns nil if the device
+// doesn't have it.
+func (wm *WM) xiGetProperty(device uint16, property xproto.Atom) (data []byte, format byte, err error) {
+	buf := wm.xiRequest(xiGetProperty, 20)
+	xgb.Put16(buf[4:], device)
+	xgb.Put32(buf[8:], uint32(property))
+	xgb.Put32(buf[12:], xproto.GetPropertyTypeAny)
+	xgb.Put32(buf[16:], 0)    // offset
+	xgb.Put32(buf[20:], 1024) // length, in 4-byte units
+	reply, err := wm.xiReply(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if xgb.Get32(reply[8:]) == 0 { // type None
+		return nil, 0, nil
+	}
+	items := int(xgb.Get32(reply[16:]))
+	format = reply[20]
+	size := items * int(format) / 8
+	if 32+size > len(reply) {
+		return nil, 0, errors.New("short XIGetProperty reply")
+	}
+	return reply[32 : 32+size], format, nil
+}
+
+// xiChangeProperty replaces a device property.
+func (wm *WM) xiChangeProperty(device uint16, property, typ xproto.Atom, format byte, items int, data []byte) error {
+	buf := wm.xiRequest(xiChangeProperty, 16+len(data))
+	xgb.Put16(buf[4:], device)
+	buf[6] = xproto.PropModeReplace
+	buf[7] = format
+	xgb.Put32(buf[8:], uint32(property))
+	xgb.Put32(buf[12:], uint32(typ))
+	xgb.Put32(buf[16:], uint32(items))
+	copy(buf[20:], data)
+	return wm.xiCheck(buf)
+}